@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// adminServe starts the http admin server in background, sel is the device
+// selector of the relay.
+func adminServe(addr string, sel usbSelector) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/abort", adminAbort)
+	mux.HandleFunc("/info", adminInfo)
+	mux.HandleFunc("/sessions", adminSessions)
+	mux.HandleFunc("/metrics", adminMetrics)
+	mux.HandleFunc("/step", adminStep)
+	mux.HandleFunc("/events", adminEvents)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		adminHealthz(w, r, sel)
+	})
+	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		adminReset(w, r, sel)
+	})
+	mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		adminTarget(w, r, sel)
+	})
+
+	log.Printf("launching admin server at %v", addr)
+	go func() {
+		log.Fatalf("admin server failed: %v", http.ListenAndServe(addr, mux))
+	}()
+}
+
+func adminAbort(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sessionAbort() {
+		http.Error(w, "no active session", http.StatusConflict)
+		return
+	}
+	fmt.Fprintln(w, "aborted")
+}
+
+// adminReset resets the device, narrowed to the serial given as parameter if
+// any, the server device rules and serial hashes still apply. Refused while
+// a session is running.
+func adminReset(w http.ResponseWriter, r *http.Request, sel usbSelector) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if serial := r.URL.Query().Get("serial"); serial != "" {
+		sel.serial = serial
+	}
+	err := usbDeviceResetIdle(sel)
+	if err == errUsbBusy {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("admin: device reset")
+	fmt.Fprintln(w, "reset")
+}
+
+// adminInfo returns device variables collected with --collect-info.
+func adminInfo(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deviceVarsSnapshot())
+}
+
+// adminSessions returns the active sessions.
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionsSnapshot())
+}
+
+// adminMetrics reports the commands sent by the sessions so far by verb, in
+// the prometheus text format.
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+
+	commandTotalsLock.Lock()
+	defer commandTotalsLock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP remote_fastboot_commands_total Fastboot commands sent by the clients.\n")
+	fmt.Fprintf(w, "# TYPE remote_fastboot_commands_total counter\n")
+	for _, verb := range sortedVerbs(commandTotals) {
+		fmt.Fprintf(w, "remote_fastboot_commands_total{verb=\"%v\"} %v\n", verb, commandTotals[verb])
+	}
+}
+
+// adminHealthz reports whether the device is usable. A device in a session is
+// reported as busy without being opened again.
+func adminHealthz(w http.ResponseWriter, r *http.Request, sel usbSelector) {
+
+	busy, err := usbDeviceProbe(sel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if busy {
+		fmt.Fprintln(w, "busy, healthy")
+		return
+	}
+	fmt.Fprintln(w, "healthy")
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// auditLog is a per-session record of the commands a client issued and the
+// device responses, bulk data is not recorded. A nil auditLog records nothing.
+type auditLog struct {
+	file   *os.File
+	logger *log.Logger
+}
+
+// auditOpen creates the audit file of a session in dir, named by the session
+// start time, the client address and the device name.
+func auditOpen(dir string, client string, device string) (*auditLog, error) {
+
+	name := fmt.Sprintf("%v_%v_%v.log", time.Now().Format("20060102-150405.000"), client, device)
+	// keep the name portable, addresses contain colons
+	name = strings.Map(func(r rune) rune {
+		if r == ':' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("create audit file failed: %v", err)
+	}
+	a := &auditLog{file: file, logger: log.New(file, "", log.LstdFlags|log.Lmicroseconds)}
+	a.Printf("session start, client: %v, device: %v", client, device)
+	return a, nil
+}
+
+func (a *auditLog) Printf(format string, v ...interface{}) {
+
+	if a == nil {
+		return
+	}
+	a.logger.Printf(format, v...)
+}
+
+func (a *auditLog) Close() {
+
+	if a == nil {
+		return
+	}
+	a.Printf("session end")
+	if err := a.file.Close(); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// backoff spaces out repeated device discovery attempts: the interval
+// doubles with every failure up to max, reset on success. Waits are jittered
+// by up to a quarter of the interval so servers sharing a hub don't poll it
+// in lockstep.
+type backoff struct {
+	initial  time.Duration
+	max      time.Duration
+	interval time.Duration
+	failures int
+	random   *rand.Rand
+	// no attempt before, see postpone
+	due time.Time
+}
+
+func newBackoff(initial time.Duration, max time.Duration) *backoff {
+
+	if max < initial {
+		max = initial
+	}
+	return &backoff{initial: initial, max: max, random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// next returns the time to wait after a failed attempt.
+func (b *backoff) next() time.Duration {
+
+	b.failures++
+	if b.interval == 0 {
+		b.interval = b.initial
+	} else if b.interval *= 2; b.interval > b.max {
+		b.interval = b.max
+	}
+	wait := b.interval
+	if jitter := int64(wait / 4); jitter > 0 {
+		wait += time.Duration(b.random.Int63n(jitter)) - time.Duration(jitter/2)
+	}
+	debugf(log.Default(), "discovery: %v failures, next attempt in %v (interval %v, max %v)",
+		b.failures, wait.Round(time.Millisecond), b.interval, b.max)
+	return wait
+}
+
+// postpone records a failed attempt without waiting: the next one is due
+// after the time next returns, see left.
+func (b *backoff) postpone() {
+
+	b.due = time.Now().Add(b.next())
+}
+
+// left returns the time until the next attempt is due after postpone, 0 if
+// it is.
+func (b *backoff) left() time.Duration {
+
+	if left := time.Until(b.due); left > 0 {
+		return left
+	}
+	return 0
+}
+
+// reset is called after a successful attempt.
+func (b *backoff) reset() {
+
+	if b.failures > 0 {
+		debugf(log.Default(), "discovery: succeeded after %v failures, backoff reset", b.failures)
+	}
+	b.interval = 0
+	b.failures = 0
+	b.due = time.Time{}
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+
+	b := newBackoff(time.Second, 4*time.Second)
+	for _, interval := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		// jitter is up to a quarter either way
+		if wait := b.next(); wait < interval*7/8 || wait > interval*9/8 {
+			t.Errorf("interval %v: waited %v", interval, wait)
+		}
+	}
+	b.reset()
+	if wait := b.next(); wait > time.Second*9/8 {
+		t.Errorf("after reset: waited %v", wait)
+	}
+}
+
+func TestBackoffPostpone(t *testing.T) {
+
+	b := newBackoff(time.Second, 30*time.Second)
+	if left := b.left(); left != 0 {
+		t.Errorf("before any failure: %v left", left)
+	}
+	// clients coming meanwhile are answered at once, nothing sleeps
+	start := time.Now()
+	b.postpone()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("postpone took %v", elapsed)
+	}
+	if left := b.left(); left < time.Second/2 || left > 2*time.Second {
+		t.Errorf("after a failure: %v left", left)
+	}
+	b.postpone()
+	if left := b.left(); left < time.Second {
+		t.Errorf("after two failures: %v left", left)
+	}
+	b.reset()
+	if left := b.left(); left != 0 {
+		t.Errorf("after reset: %v left", left)
+	}
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// number of timed downloads of the benchmark download phase
+const benchmarkDownloads = 5
+
+// zeroReader is an endless source of zero bytes for dummy downloads.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// benchmarkPercentile returns the p-th percentile of sorted samples.
+func benchmarkPercentile(samples []time.Duration, p int) time.Duration {
+
+	index := (len(samples)*p+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return samples[index]
+}
+
+func benchmarkPrint(name string, samples []time.Duration) {
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	fmt.Printf("%v: %v samples, min %v, p50 %v, p90 %v, p99 %v, max %v\n", name, len(samples), samples[0],
+		benchmarkPercentile(samples, 50), benchmarkPercentile(samples, 90), benchmarkPercentile(samples, 99),
+		samples[len(samples)-1])
+}
+
+// clientBenchmark measures command round trip over the server at address by
+// count getvar:version commands, then, if downloadSize is not zero, the
+// throughput of dummy downloads of that size. The downloaded data is never
+// flashed, it stays in the device download buffer.
+func clientBenchmark(address string, count int, downloadSize int64) error {
+
+	if count < 1 {
+		return fmt.Errorf("bad benchmark count %v", count)
+	}
+	start := time.Now()
+	conn, err := clientConnect(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	fmt.Printf("connected in %v\n", time.Since(start))
+
+	var samples []time.Duration
+	for i := 0; i < count; i++ {
+		start = time.Now()
+		if _, _, err = clientCommand(conn, "getvar:version"); err != nil {
+			return err
+		}
+		samples = append(samples, time.Since(start))
+	}
+	benchmarkPrint("getvar:version round trip", samples)
+
+	if downloadSize == 0 {
+		return nil
+	}
+	maxDownload, err := clientMaxDownloadSize(conn)
+	if err != nil {
+		return err
+	}
+	if maxDownload > 0 && downloadSize > maxDownload {
+		return fmt.Errorf("download size %v exceeds device max-download-size %v", downloadSize, maxDownload)
+	}
+	samples = nil
+	for i := 0; i < benchmarkDownloads; i++ {
+		start = time.Now()
+		if err = clientDownload(conn, zeroReader{}, downloadSize); err != nil {
+			return err
+		}
+		elapsed := time.Since(start)
+		samples = append(samples, elapsed)
+		fmt.Printf("download %v/%v: %v bytes in %v, %.1f MB/s\n", i+1, benchmarkDownloads, downloadSize, elapsed,
+			float64(downloadSize)/elapsed.Seconds()/1e6)
+	}
+	benchmarkPrint(fmt.Sprintf("download of %v bytes", downloadSize), samples)
+	return nil
+}
@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// circuitBreaker stops serving a device after --breaker-failures consecutive
+// failed sessions, failing to open the device or ending with an error, usb
+// errors included: for --breaker-cooldown sessions are rejected as
+// temporarily unavailable. The server probes the device when a session comes
+// after the cooldown, before the client gets it: if the probe fails the
+// cooldown starts over, else the device is served again. Devices are told
+// apart by what the session selects them with, see breakerKey.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	devices   map[string]*breakerState
+}
+
+type breakerState struct {
+	failures int
+	// sessions are rejected until then
+	openUntil time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, devices: map[string]*breakerState{}}
+}
+
+// breakerKey names the device selected by sel, empty for whichever single
+// device matches the device rules.
+func breakerKey(sel usbSelector) string {
+
+	if sel.serial != "" {
+		return sel.serial
+	}
+	if sel.portPath != "" {
+		return "port " + sel.portPath
+	}
+	if sel.bus != 0 {
+		return fmt.Sprintf("%v:%v", sel.bus, sel.address)
+	}
+	return ""
+}
+
+func breakerDevice(key string) string {
+
+	if key == "" {
+		return "device"
+	}
+	if name := deviceNameOf(key); name != "" {
+		return "device " + name
+	}
+	return "device " + key
+}
+
+// allow tells whether a session may use the device, else returns the time
+// left until it's probed. Once the cooldown is over the device is checked with
+// probe, no client is involved. A nil breaker allows everything.
+func (cb *circuitBreaker) allow(key string, probe func() error) (bool, time.Duration) {
+
+	if cb == nil {
+		return true, 0
+	}
+	state, ok := cb.devices[key]
+	if !ok || state.openUntil.IsZero() {
+		return true, 0
+	}
+	if left := time.Until(state.openUntil); left > 0 {
+		return false, left
+	}
+	log.Printf("breaker: cooldown over, probing %v", breakerDevice(key))
+	if err := probe(); err != nil {
+		state.openUntil = time.Now().Add(cb.cooldown)
+		log.Printf("breaker: probing %v failed: %v, unavailable for %v", breakerDevice(key), err, cb.cooldown)
+		return false, cb.cooldown
+	}
+	log.Printf("breaker: %v probed fine, served again", breakerDevice(key))
+	delete(cb.devices, key)
+	return true, 0
+}
+
+// failure counts a failed session, returns true if it opened the breaker.
+func (cb *circuitBreaker) failure(key string) bool {
+
+	if cb == nil {
+		return false
+	}
+	state, ok := cb.devices[key]
+	if !ok {
+		state = &breakerState{}
+		cb.devices[key] = state
+	}
+	state.failures++
+	if state.failures < cb.threshold {
+		debugf(log.Default(), "breaker: %v failed %v/%v times", breakerDevice(key), state.failures, cb.threshold)
+		return false
+	}
+	state.openUntil = time.Now().Add(cb.cooldown)
+	log.Printf("breaker: %v failed %v times in a row, unavailable for %v", breakerDevice(key), state.failures, cb.cooldown)
+	return true
+}
+
+// success resets the failures of the device.
+func (cb *circuitBreaker) success(key string) {
+
+	if cb == nil {
+		return
+	}
+	delete(cb.devices, key)
+}
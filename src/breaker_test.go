@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreakerThreshold(t *testing.T) {
+
+	cb := newCircuitBreaker(2, time.Hour)
+	probe := func() error {
+		t.Fatal("probed during the cooldown")
+		return nil
+	}
+	if cb.failure("1234") {
+		t.Fatal("opened after the first failure")
+	}
+	if ok, _ := cb.allow("1234", probe); !ok {
+		t.Fatal("rejected below the threshold")
+	}
+	cb.success("1234")
+	if cb.failure("1234") {
+		t.Fatal("success didn't reset the failures")
+	}
+	if !cb.failure("1234") {
+		t.Fatal("didn't open at the threshold")
+	}
+	if ok, left := cb.allow("1234", probe); ok || left <= 0 {
+		t.Errorf("open breaker: got %v, %v", ok, left)
+	}
+	if ok, _ := cb.allow("5678", probe); !ok {
+		t.Errorf("another device rejected")
+	}
+}
+
+func TestBreakerProbe(t *testing.T) {
+
+	cb := newCircuitBreaker(1, time.Hour)
+	cb.failure("1234")
+	// the cooldown is over
+	cb.devices["1234"].openUntil = time.Now().Add(-time.Second)
+	probes := 0
+	if ok, left := cb.allow("1234", func() error {
+		probes++
+		return errors.New("no device")
+	}); ok || left != time.Hour {
+		t.Errorf("failed probe: got %v, %v", ok, left)
+	}
+	if ok, _ := cb.allow("1234", func() error {
+		probes++
+		return nil
+	}); ok {
+		t.Errorf("allowed before the restarted cooldown is over")
+	}
+	if probes != 1 {
+		t.Errorf("probed %v times, want 1", probes)
+	}
+
+	cb.devices["1234"].openUntil = time.Now().Add(-time.Second)
+	if ok, _ := cb.allow("1234", func() error { return nil }); !ok {
+		t.Errorf("rejected after a good probe")
+	}
+	if ok, _ := cb.allow("1234", nil); !ok {
+		t.Errorf("rejected after the breaker closed")
+	}
+}
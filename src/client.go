@@ -0,0 +1,355 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Client mode talks to a remote-fastboot server (or any fastboot tcp device)
+// without the fastboot tool.
+
+const clientTimeout = 30 * time.Second
+
+// download data is streamed from the file in frames of this size
+const clientChunk = 1024 * 1024
+
+// time a device rebooting into fastbootd has to be served again
+const clientRebootTimeout = 90 * time.Second
+
+// a FAIL response of the device
+var errClientRemote = errors.New("remote")
+
+// the server didn't answer the handshake
+var errClientHandshake = errors.New("read handshake header failed")
+
+// clientConnect opens a connection and exchanges the FB01 handshake, or the
+// split connections with --split-connections. Control frames are asked for
+// first, see control.go, a server refusing them is connected to again.
+func clientConnect(address string) (net.Conn, error) {
+
+	if clientSplit {
+		return clientConnectSplit(address)
+	}
+	conn, err := clientConnectMagic(address, netControlMagic("FB01"))
+	if errors.Is(err, errClientHandshake) {
+		return clientConnectMagic(address, "FB01")
+	}
+	return conn, err
+}
+
+// clientConnectMagic is clientConnect sending magic as the handshake, the
+// connection returned is a controlConn if the server answered version 2 of
+// the magic.
+func clientConnectMagic(address string, magic string) (net.Conn, error) {
+
+	conn, err := clientDial(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write([]byte(magic)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write handshake header failed: %v", err)
+	}
+	var header []byte = make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil || string(header[0:2]) != "FB" {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %q %v", errClientHandshake, header, err)
+	}
+	if netControl(magic[0:4]) && string(header) == magic[0:4] {
+		return &controlConn{Conn: conn}, nil
+	}
+	return conn, nil
+}
+
+// clientCommand sends a command and waits for its final response.
+func clientCommand(conn net.Conn, command string) (string, string, error) {
+
+	if err := netWrite(conn, []byte(command)); err != nil {
+		return "", "", err
+	}
+	return clientResponse(conn, command)
+}
+
+// clientResponse waits for the final response to command, INFO and TEXT
+// lines are printed. Returns the token (OKAY or DATA) and its message.
+func clientResponse(conn net.Conn, command string) (string, string, error) {
+
+	token, message, err := clientReply(conn, command)
+	if err == nil && token == "FAIL" {
+		return "", "", fmt.Errorf("%v: %w: %v", command, errClientRemote, message)
+	}
+	return token, message, err
+}
+
+// clientReply is clientResponse returning FAIL as a token instead of an error.
+func clientReply(conn net.Conn, command string) (string, string, error) {
+
+	return clientReplyInfo(conn, command, func(line string) {
+		fmt.Printf("(bootloader) %v\n", line)
+	})
+}
+
+// clientReplyInfo is clientReply passing INFO and TEXT messages to info.
+func clientReplyInfo(conn net.Conn, command string, info func(string)) (string, string, error) {
+
+	for {
+		response, err := netRead(conn)
+		if err != nil {
+			return "", "", err
+		}
+		if len(response) < 4 {
+			return "", "", fmt.Errorf("%v: malformed response %q", command, response)
+		}
+		token, message := string(response[0:4]), string(response[4:])
+		switch token {
+		case "INFO", "TEXT":
+			info(message)
+		case "OKAY", "DATA", "FAIL":
+			return token, message, nil
+		default:
+			return "", "", fmt.Errorf("%v: unknown response %q", command, response)
+		}
+	}
+}
+
+// clientDownload streams size bytes of reader to the device.
+func clientDownload(conn net.Conn, reader io.Reader, size int64) error {
+
+	return clientDownloadShowing(conn, reader, size, false)
+}
+
+// clientDownloadShowing is clientDownload showing the progress frames of a
+// server started with --progress-info as they come, see progressinfo.go.
+func clientDownloadShowing(conn net.Conn, reader io.Reader, size int64, progress bool) error {
+
+	if size > 0xffffffff {
+		return fmt.Errorf("download of %v bytes exceeds the 32-bit fastboot limit", size)
+	}
+	token, message, err := clientCommand(conn, fmt.Sprintf("download:%08x", size))
+	if err != nil {
+		return err
+	}
+	if token != "DATA" {
+		return fmt.Errorf("download: DATA expected, got %v%v", token, message)
+	}
+	// the response is read as the data goes, the error is reported by
+	// netWrite or the reader
+	type reply struct {
+		token, message string
+		err            error
+	}
+	var replies chan reply
+	if progress {
+		replies = make(chan reply, 1)
+		go func() {
+			token, message, err := clientReplyInfo(conn, "download", clientShowProgress)
+			replies <- reply{token, message, err}
+		}()
+	}
+	var buffer []byte = make([]byte, clientChunk)
+	for sent := int64(0); sent < size; {
+		n := int64(len(buffer))
+		if size-sent < n {
+			n = size - sent
+		}
+		if _, err = io.ReadFull(reader, buffer[0:n]); err != nil {
+			return fmt.Errorf("read image failed: %v", err)
+		}
+		if err = netWrite(conn, buffer[0:n]); err != nil {
+			return err
+		}
+		sent += n
+	}
+	if progress {
+		r := <-replies
+		fmt.Printf("\n")
+		token, message, err = r.token, r.message, r.err
+		if err == nil && token == "FAIL" {
+			err = fmt.Errorf("download: %w: %v", errClientRemote, message)
+		}
+	} else {
+		token, message, err = clientResponse(conn, "download")
+	}
+	if err == nil && token != "OKAY" {
+		err = fmt.Errorf("download: OKAY expected, got %v%v", token, message)
+	}
+	return err
+}
+
+// clientFlash flashes the file at path to partition over the server at
+// address: download of the file followed by flash:<partition>. A file
+// exceeding the device max-download-size is sent as several sparse images.
+// With verify the sha256 of each download is sent first, see verify.go, with
+// progress the server is asked for download progress.
+func clientFlash(address string, partition string, path string, verify bool, progress bool) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	conn, err := clientConnect(address)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+	if progress {
+		if progress, err = clientAskProgress(conn); err != nil {
+			return err
+		}
+	}
+
+	partition = strings.TrimSpace(partition)
+	// logical partitions can only be flashed by fastbootd, a bootloader
+	// doesn't know the variable and is left alone
+	logical, err := clientGetvarYes(conn, "is-logical:"+partition)
+	if err != nil {
+		return err
+	}
+	if logical {
+		userspace, err := clientGetvarYes(conn, "is-userspace")
+		if err != nil {
+			return err
+		}
+		if !userspace {
+			// conn stays set for the deferred Close if the reboot fails
+			rebooted, err := clientRebootFastbootd(address, conn)
+			if err != nil {
+				return err
+			}
+			conn = rebooted
+			if progress {
+				if progress, err = clientAskProgress(conn); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	maxDownload, err := clientMaxDownloadSize(conn)
+	if err != nil {
+		return err
+	}
+	if maxDownload == 0 || info.Size() <= maxDownload {
+		fmt.Printf("Sending '%v' (%v KB)\n", partition, info.Size()/1024)
+		if verify {
+			if _, err = clientSendSha256(conn, io.NewSectionReader(file, 0, info.Size())); err != nil {
+				return err
+			}
+		}
+		if err = clientDownloadShowing(conn, file, info.Size(), progress); err != nil {
+			return err
+		}
+		fmt.Printf("Writing '%v'\n", partition)
+		if _, _, err = clientCommand(conn, "flash:"+partition); err != nil {
+			return err
+		}
+		fmt.Printf("OKAY\n")
+		return nil
+	}
+
+	image, err := sparseRead(file, info.Size())
+	if err != nil {
+		return err
+	}
+	pieces, err := image.split(maxDownload)
+	if err != nil {
+		return err
+	}
+	start := uint32(0)
+	for i, chunks := range pieces {
+		reader, size := image.piece(file, chunks, start)
+		fmt.Printf("Sending sparse '%v' %v/%v (%v KB)\n", partition, i+1, len(pieces), size/1024)
+		if verify {
+			// the piece is built again to be hashed ahead of sending it
+			hashed, _ := image.piece(file, chunks, start)
+			if verify, err = clientSendSha256(conn, hashed); err != nil {
+				return err
+			}
+		}
+		if err = clientDownloadShowing(conn, reader, size, progress); err != nil {
+			return err
+		}
+		fmt.Printf("Writing '%v'\n", partition)
+		if _, _, err = clientCommand(conn, "flash:"+partition); err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			start += chunk.blocks
+		}
+	}
+	fmt.Printf("OKAY\n")
+	return nil
+}
+
+// clientShowProgress prints an INFO message, a progress frame as a
+// percentage updated in place.
+func clientShowProgress(line string) {
+
+	if strings.HasPrefix(line, progressInfoPrefix) {
+		var sent, total uint64
+		_, err := fmt.Sscanf(line[len(progressInfoPrefix):], "%d %d", &sent, &total)
+		if err == nil && total > 0 {
+			fmt.Printf("\r%3d%% %v/%v KB", sent*100/total, sent/1024, total/1024)
+			return
+		}
+	}
+	fmt.Printf("(bootloader) %v\n", line)
+}
+
+// clientGetvarYes tells whether the variable is "yes", a variable the device
+// doesn't know is not.
+func clientGetvarYes(conn net.Conn, name string) (bool, error) {
+
+	_, value, err := clientCommand(conn, "getvar:"+name)
+	if errors.Is(err, errClientRemote) {
+		return false, nil
+	}
+	return strings.TrimSpace(value) == "yes", err
+}
+
+// clientRebootFastbootd reboots the device into fastbootd (userspace
+// fastboot) and returns a new connection once the server serves the device
+// again with is-userspace set. conn is closed.
+func clientRebootFastbootd(address string, conn net.Conn) (net.Conn, error) {
+
+	fmt.Printf("Rebooting into fastbootd\n")
+	// the device may be gone before its OKAY reaches us
+	_, _, err := clientCommand(conn, "reboot-fastboot")
+	conn.Close()
+	if errors.Is(err, errClientRemote) {
+		return nil, err
+	}
+	deadline := time.Now().Add(clientRebootTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		if conn, err = clientConnect(address); err != nil {
+			continue
+		}
+		userspace, err := clientGetvarYes(conn, "is-userspace")
+		if err == nil && userspace {
+			return conn, nil
+		}
+		conn.Close()
+	}
+	return nil, fmt.Errorf("device not in fastbootd after %v", clientRebootTimeout)
+}
+
+// clientMaxDownloadSize returns the device max-download-size, 0 if the device
+// doesn't report it.
+func clientMaxDownloadSize(conn net.Conn) (int64, error) {
+
+	return clientGetvarSize(conn, "max-download-size")
+}
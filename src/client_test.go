@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientTestServer serves dev to a client session at the returned address,
+// as the server does: handshake then relay.
+func clientTestServer(t *testing.T, dev usbTransport) string {
+
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if magic, err := netReadHandshake(conn, false); err == nil && netWriteHandshake(conn, magic) == nil {
+				relay(context.Background(), conn, false, dev, log.New(io.Discard, "", 0), relayOptions{drainTimeout: time.Millisecond, control: netControl(magic)})
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// newNoFastbootdMock is a bootloader refusing to reboot into fastbootd.
+func newNoFastbootdMock() *usbMock {
+
+	return newUsbMock(func(data []byte) []usbMockRead {
+		switch string(data) {
+		case "getvar:is-logical:system":
+			return []usbMockRead{{data: []byte("OKAYyes")}}
+		case "getvar:is-userspace":
+			return []usbMockRead{{data: []byte("OKAYno")}}
+		case "reboot-fastboot":
+			return []usbMockRead{{data: []byte("FAILunknown command")}}
+		}
+		return []usbMockRead{{data: []byte("OKAY")}}
+	})
+}
+
+func TestClientScriptRebootFailed(t *testing.T) {
+
+	address := clientTestServer(t, newNoFastbootdMock())
+	path := filepath.Join(t.TempDir(), "unlock.txt")
+	if err := os.WriteFile(path, []byte("reboot fastbootd\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// fails without the deferred Close of the lost connection panicking
+	if err := clientScript(address, path); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestClientFlashRebootFailed(t *testing.T) {
+
+	address := clientTestServer(t, newNoFastbootdMock())
+	path := filepath.Join(t.TempDir(), "system.img")
+	if err := os.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientFlash(address, "system", path, false, false); err == nil {
+		t.Errorf("flash of a logical partition without fastbootd succeeded")
+	}
+}
+
+func TestClientScriptRebootBootloaderFailed(t *testing.T) {
+
+	dev := newUsbMock(func(data []byte) []usbMockRead {
+		return []usbMockRead{{data: []byte("FAILunknown command")}}
+	})
+	address := clientTestServer(t, dev)
+	path := filepath.Join(t.TempDir(), "unlock.txt")
+	if err := os.WriteFile(path, []byte("reboot bootloader\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := clientScript(address, path); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// Compressed framing is requested by a client sending netHandshakeCompress
+// instead of "FB01". The frame header stays the same, but every payload starts
+// with a flag byte: netFrameRaw or netFrameGzip followed by the gzip stream.
+// A netFrameKeepalive frame has no data and is skipped by the reader.
+const netHandshakeCompress = "FBZ1"
+
+const (
+	netFrameRaw       = 0
+	netFrameGzip      = 1
+	netFrameKeepalive = 2
+)
+
+// smaller payloads are never worth compressing
+const netCompressThreshold = 1024
+
+// netCodec reads and writes frames of a connection, compressing them
+// if it was negotiated. Reads and writes may be done by different goroutines.
+type netCodec struct {
+	compress bool
+	// largest raw frame the peer may send next, netMaxFrame if nil
+	limit        func() uint64
+	rawSent      uint64
+	wireSent     uint64
+	rawReceived  uint64
+	wireReceived uint64
+}
+
+func (c *netCodec) read(conn net.Conn) ([]byte, error) {
+
+	data, err := netReadLimit(conn, c.wireLimit)
+	if err != nil || !c.compress {
+		return data, err
+	}
+	for len(data) == 1 && data[0] == netFrameKeepalive {
+		if data, err = netReadLimit(conn, c.wireLimit); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("read packet failed: no compression flag")
+	}
+	c.wireReceived += uint64(len(data))
+	switch data[0] {
+	case netFrameRaw:
+		data = data[1:]
+	case netFrameGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("read packet failed: %v", err)
+		}
+		// a frame is no larger once decompressed than the peer may send
+		// raw, reading one byte past that tells a compression bomb
+		max := c.rawLimit()
+		compressed := data
+		data, err = io.ReadAll(io.LimitReader(reader, int64(max)+1))
+		netBufferRelease(compressed)
+		if err != nil {
+			return nil, fmt.Errorf("read packet failed: %v", err)
+		}
+		if uint64(len(data)) > max {
+			return nil, fmt.Errorf("read packet failed: decompressed frame exceeds %v", max)
+		}
+	default:
+		return nil, fmt.Errorf("read packet failed: bad compression flag %v", data[0])
+	}
+	c.rawReceived += uint64(len(data))
+	return data, nil
+}
+
+// wireLimit returns the largest frame the peer may send next: a compressed
+// frame is never sent larger than the raw one, plus its flag byte.
+func (c *netCodec) wireLimit() uint64 {
+
+	if c.limit == nil {
+		return netMaxFrame
+	}
+	if c.compress {
+		return c.rawLimit() + 1
+	}
+	return c.rawLimit()
+}
+
+func (c *netCodec) rawLimit() uint64 {
+
+	if c.limit == nil {
+		return netMaxFrame
+	}
+	return c.limit()
+}
+
+func (c *netCodec) write(conn net.Conn, data []byte) error {
+
+	if !c.compress {
+		return netWrite(conn, data)
+	}
+	frame := append([]byte{netFrameRaw}, data...)
+	if len(data) >= netCompressThreshold {
+		var buffer bytes.Buffer
+		buffer.WriteByte(netFrameGzip)
+		writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestSpeed)
+		writer.Write(data)
+		writer.Close()
+		if buffer.Len() < len(frame) {
+			frame = buffer.Bytes()
+		}
+	}
+	c.rawSent += uint64(len(data))
+	c.wireSent += uint64(len(frame))
+	return netWrite(conn, frame)
+}
+
+// writeKeepalive sends a frame the peer discards, only compressed framing
+// has one.
+func (c *netCodec) writeKeepalive(conn net.Conn) error {
+
+	if !c.compress {
+		return nil
+	}
+	return netWrite(conn, []byte{netFrameKeepalive})
+}
+
+func compressRatio(raw, wire uint64) float64 {
+
+	if wire == 0 {
+		return 1
+	}
+	return float64(raw) / float64(wire)
+}
+
+func (c *netCodec) logStats(logger *log.Logger) {
+
+	if !c.compress {
+		return
+	}
+	logger.Printf("compression: received %v bytes as %v (%.2fx), sent %v bytes as %v (%.2fx)",
+		c.rawReceived, c.wireReceived, compressRatio(c.rawReceived, c.wireReceived),
+		c.rawSent, c.wireSent, compressRatio(c.rawSent, c.wireSent))
+}
@@ -0,0 +1,309 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// relay options for the next session, may be changed by a config reload
+var relayConfigLock sync.Mutex
+var relayConfig relayOptions
+
+func relayConfigGet() relayOptions {
+
+	relayConfigLock.Lock()
+	defer relayConfigLock.Unlock()
+	return relayConfig
+}
+
+func relayConfigSet(opts relayOptions) {
+
+	relayConfigLock.Lock()
+	defer relayConfigLock.Unlock()
+	relayConfig = opts
+}
+
+// the settings without the config file: defaults, quirk profile, environment
+// and command line. A reload applies the file to them again, so a setting
+// removed from the file goes back to its baseline.
+var configBaseline struct {
+	opts    relayOptions
+	verbose int32
+	quiet   bool
+	names   map[string]string
+}
+
+// configBaselineSet records opts and the log settings in effect as the
+// baseline, called before the config file is first applied.
+func configBaselineSet(opts relayOptions) {
+
+	configBaseline.opts = opts
+	configBaseline.verbose = verbose.Load()
+	configBaseline.quiet = quietTransfers.Load()
+	configBaseline.names = deviceNamesGet()
+}
+
+// configSetting is an option which may be changed at runtime, named as its
+// long command-line form.
+type configSetting struct {
+	apply func(opts *relayOptions, value string) error
+	show  func(opts *relayOptions) string
+}
+
+func configList(value string) []string {
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func configBool(value string, set func(bool)) error {
+
+	b, err := strconv.ParseBool(value)
+	set(b)
+	return err
+}
+
+func configDuration(value string, set func(time.Duration)) error {
+
+	d, err := time.ParseDuration(value)
+	set(d)
+	return err
+}
+
+var configSettings = map[string]configSetting{
+	"allow-partition": {
+		apply: func(opts *relayOptions, value string) error {
+			opts.policy.allow = configList(value)
+			return nil
+		},
+		show: func(opts *relayOptions) string { return strings.Join(opts.policy.allow, ",") },
+	},
+	"deny-partition": {
+		apply: func(opts *relayOptions, value string) error {
+			opts.policy.deny = configList(value)
+			return nil
+		},
+		show: func(opts *relayOptions) string { return strings.Join(opts.policy.deny, ",") },
+	},
+	"readonly": {
+		apply: func(opts *relayOptions, value string) error {
+			return configBool(value, func(b bool) { opts.readonly = b })
+		},
+		show: func(opts *relayOptions) string { return strconv.FormatBool(opts.readonly) },
+	},
+	"parse": {
+		apply: func(opts *relayOptions, value string) error {
+			return configBool(value, func(b bool) { opts.parse = b })
+		},
+		show: func(opts *relayOptions) string { return strconv.FormatBool(opts.parse) },
+	},
+	"keep-session": {
+		apply: func(opts *relayOptions, value string) error {
+			return configBool(value, func(b bool) { opts.keepOnError = b })
+		},
+		show: func(opts *relayOptions) string { return strconv.FormatBool(opts.keepOnError) },
+	},
+	"min-command-interval": {
+		apply: func(opts *relayOptions, value string) error {
+			return configDuration(value, func(d time.Duration) { opts.minCommandInterval = d })
+		},
+		show: func(opts *relayOptions) string { return opts.minCommandInterval.String() },
+	},
+	"drain-timeout": {
+		apply: func(opts *relayOptions, value string) error {
+			return configDuration(value, func(d time.Duration) { opts.drainTimeout = d })
+		},
+		show: func(opts *relayOptions) string { return opts.drainTimeout.String() },
+	},
+	"max-session-bytes": {
+		apply: func(opts *relayOptions, value string) (err error) {
+			opts.maxSessionBytes, err = strconv.ParseUint(value, 0, 64)
+			return err
+		},
+		show: func(opts *relayOptions) string { return strconv.FormatUint(opts.maxSessionBytes, 10) },
+	},
+	"verbose": {
+		apply: func(opts *relayOptions, value string) error {
+			v, err := strconv.Atoi(value)
+			verbose.Store(int32(v))
+			return err
+		},
+		show: func(opts *relayOptions) string { return strconv.Itoa(int(verbose.Load())) },
+	},
+	"device-name": {
+		apply: func(opts *relayOptions, value string) error {
+			names, err := deviceNamesParse(configList(value))
+			if err == nil {
+				deviceNamesSet(names)
+			}
+			return err
+		},
+		show: func(opts *relayOptions) string { return deviceNamesString(deviceNamesGet()) },
+	},
+	"quiet-transfers": {
+		apply: func(opts *relayOptions, value string) error {
+			return configBool(value, func(b bool) { quietTransfers.Store(b) })
+		},
+		show: func(opts *relayOptions) string { return strconv.FormatBool(quietTransfers.Load()) },
+	},
+}
+
+// loadConfig reads "name = value" lines, # starts a comment.
+func loadConfig(path string) (map[string]string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[0:i])
+		}
+		if text == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%v:%v: \"name = value\" expected", path, line)
+		}
+		config[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return config, scanner.Err()
+}
+
+// applyConfig returns opts updated with the config file at path and the
+// list of changes. Options given on the command line or in the environment
+// take precedence, options which can't change at runtime are reported and
+// ignored.
+func applyConfig(path string, opts relayOptions) (relayOptions, []string, error) {
+
+	config, err := loadConfig(path)
+	if err != nil {
+		return opts, nil, err
+	}
+	var changes []string
+	for name, value := range config {
+		setting, ok := configSettings[name]
+		opt := optionLookup(name)
+		if !ok {
+			if opt == nil {
+				return opts, nil, fmt.Errorf("%v: unknown option %q", path, name)
+			}
+			log.Printf("config: %v can't change at runtime, set it on the command line and restart", name)
+			continue
+		}
+		if opt != nil && opt.Seen() {
+			log.Printf("config: %v ignored, it's given on the command line", name)
+			continue
+		}
+		if envSet[name] {
+			log.Printf("config: %v ignored, it's given as %v", name, envName(name))
+			continue
+		}
+		if profile, ok := quirkSet[name]; ok {
+			log.Printf("config: %v overrides the value of quirk %v", name, profile)
+		}
+		before := setting.show(&opts)
+		if err = setting.apply(&opts, value); err != nil {
+			return opts, nil, fmt.Errorf("%v: bad %v %q: %v", path, name, value, err)
+		}
+		if after := setting.show(&opts); after != before {
+			changes = append(changes, fmt.Sprintf("%v: %q -> %q", name, before, after))
+		}
+	}
+	if opts.readonly {
+		opts.parse = true
+	}
+	return opts, changes, opts.validate()
+}
+
+// configShow returns the value of every runtime setting.
+func configShow(opts *relayOptions) map[string]string {
+
+	values := map[string]string{}
+	for name, setting := range configSettings {
+		values[name] = setting.show(opts)
+	}
+	return values
+}
+
+// reloadConfig applies the config file at path to the baseline and makes it
+// the options of the next session, returns what changed from the current
+// ones. The current settings are kept if the file has errors.
+func reloadConfig(path string) ([]string, error) {
+
+	current := relayConfigGet()
+	before := configShow(&current)
+	// log settings are applied directly, restored if the reload fails
+	v, quiet, names := verbose.Load(), quietTransfers.Load(), deviceNamesGet()
+	verbose.Store(configBaseline.verbose)
+	quietTransfers.Store(configBaseline.quiet)
+	deviceNamesSet(configBaseline.names)
+	opts, _, err := applyConfig(path, configBaseline.opts)
+	if err != nil {
+		verbose.Store(v)
+		quietTransfers.Store(quiet)
+		deviceNamesSet(names)
+		return nil, err
+	}
+	relayConfigSet(opts)
+	after := configShow(&opts)
+	var settings []string
+	for name := range configSettings {
+		settings = append(settings, name)
+	}
+	sort.Strings(settings)
+	var changes []string
+	for _, name := range settings {
+		if before[name] != after[name] {
+			changes = append(changes, fmt.Sprintf("%v: %q -> %q", name, before[name], after[name]))
+		}
+	}
+	return changes, nil
+}
+
+// configReloadOnHangup re-reads the config file on SIGHUP. A running session
+// keeps its settings, the next one gets the new ones.
+func configReloadOnHangup(path string) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			log.Printf("SIGHUP received, reloading %v", path)
+			changes, err := reloadConfig(path)
+			if err != nil {
+				log.Printf("config: %v, keeping the current settings", err)
+				continue
+			}
+			if len(changes) == 0 {
+				log.Printf("config: nothing changed")
+			}
+			for _, change := range changes {
+				log.Printf("config: %v", change)
+			}
+		}
+	}()
+}
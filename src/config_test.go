@@ -0,0 +1,59 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigReloadRemovedKey(t *testing.T) {
+
+	defer relayConfigSet(relayConfigGet())
+	defer verbose.Store(verbose.Load())
+	baseline := relayOptions{drainTimeout: time.Second, policy: partitionPolicy{deny: []string{"frp"}}}
+	verbose.Store(0)
+	configBaselineSet(baseline)
+	relayConfigSet(baseline)
+
+	path := filepath.Join(t.TempDir(), "config")
+	write := func(config string) {
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("parse = true\ndeny-partition = boot,frp\nverbose = 2\n")
+	if _, err := reloadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if opts := relayConfigGet(); strings.Join(opts.policy.deny, ",") != "boot,frp" || verbose.Load() != 2 {
+		t.Fatalf("after the first reload: deny %v, verbose %v", opts.policy.deny, verbose.Load())
+	}
+
+	write("parse = true\n")
+	changes, err := reloadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := relayConfigGet()
+	if strings.Join(opts.policy.deny, ",") != "frp" || verbose.Load() != 0 || !opts.parse {
+		t.Errorf("keys removed: deny %v, verbose %v, parse %v", opts.policy.deny, verbose.Load(), opts.parse)
+	}
+	expected := []string{`deny-partition: "boot,frp" -> "frp"`, `verbose: "2" -> "0"`}
+	if strings.Join(changes, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("changes: got %q, %q expected", changes, expected)
+	}
+
+	// a bad file keeps the current settings
+	write("verbose = loud\n")
+	if _, err := reloadConfig(path); err == nil {
+		t.Errorf("bad file accepted")
+	}
+	if opts := relayConfigGet(); !opts.parse || verbose.Load() != 0 {
+		t.Errorf("after a bad file: parse %v, verbose %v", opts.parse, verbose.Load())
+	}
+}
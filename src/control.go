@@ -0,0 +1,108 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+)
+
+// Control frames are "relay:" commands answered by the relay itself, see
+// verify.go, progressinfo.go and rebootresume.go. A client asks for them with
+// version 2 of its handshake magic: FB02, FBZ2 or FBS2 instead of FB01, FBZ1
+// or FBS1, answered in kind by a relay knowing them. A relay without them
+// refuses the magic and a device answers FB01, either way the client knows
+// not to send them. They are never forwarded to the device: the relay fails
+// them if they weren't negotiated or the feature isn't enabled.
+const relayControlPrefix = "relay:"
+
+const netControlVersion = '2'
+
+// the FAIL message of a control frame whose feature isn't enabled
+const relayControlOff = "relay: not enabled on the server"
+
+var netControlMagics []string = []string{"FB01", netHandshakeCompress, netHandshakeSplit}
+
+func relayIsControl(command []byte) bool {
+
+	return bytes.HasPrefix(command, []byte(relayControlPrefix))
+}
+
+// netControl tells whether the handshake magic asks for control frames.
+func netControl(magic string) bool {
+
+	return len(magic) == 4 && magic[3] == netControlVersion
+}
+
+// netControlMagic returns version 2 of magic, empty if it has none.
+func netControlMagic(magic string) string {
+
+	for _, known := range netControlMagics {
+		if magic == known {
+			return magic[0:3] + string(netControlVersion)
+		}
+	}
+	return ""
+}
+
+// netBaseMagic returns version 1 of magic, asking for control frames or not.
+func netBaseMagic(magic string) string {
+
+	if netControl(magic) {
+		return magic[0:3] + "1"
+	}
+	return magic
+}
+
+// control handles a control frame, returns the response.
+func (r *relaySession) control(command string) []byte {
+
+	enabled := false
+	switch {
+	case command == progressControl:
+		enabled = r.opts.progressInfo
+	case strings.HasPrefix(command, verifyControlSha256):
+		enabled = r.opts.verifyDownload
+	case command == rebootResumeControl:
+		// else replaced with the reboot command by rebootResumeReplace
+		enabled = false
+	default:
+		r.logger.Printf("unknown control frame %q", command)
+		return []byte("FAILrelay: unknown control frame")
+	}
+	if !r.opts.control {
+		r.logger.Printf("control frame %q not negotiated in the handshake", command)
+		return []byte("FAILrelay: control frames not negotiated in the handshake")
+	}
+	if !enabled {
+		debugf(r.logger, "control frame %q: feature not enabled", command)
+		return []byte("FAIL" + relayControlOff)
+	}
+	if command == progressControl {
+		r.lock.Lock()
+		r.progressInfoState.enabled = true
+		r.lock.Unlock()
+		return []byte("OKAY")
+	}
+	return r.verifyControl(command)
+}
+
+// controlConn is a client connection whose handshake negotiated control
+// frames.
+type controlConn struct {
+	net.Conn
+}
+
+// clientControl tells whether control frames may be sent on conn.
+func clientControl(conn net.Conn) bool {
+
+	switch c := conn.(type) {
+	case *controlConn:
+		return true
+	case *splitConn:
+		return clientControl(c.out)
+	}
+	return false
+}
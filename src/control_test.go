@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRelayControlNotForwarded(t *testing.T) {
+
+	tests := []struct {
+		opts     relayOptions
+		command  string
+		response string
+	}{
+		{relayOptions{}, progressControl, "FAILrelay: control frames not negotiated in the handshake"},
+		{relayOptions{control: true}, progressControl, "FAIL" + relayControlOff},
+		{relayOptions{control: true}, verifyControlSha256 + "00", "FAIL" + relayControlOff},
+		{relayOptions{control: true}, rebootResumeControl, "FAIL" + relayControlOff},
+		{relayOptions{rebootResume: true}, rebootResumeControl, "FAILrelay: control frames not negotiated in the handshake"},
+		{relayOptions{control: true}, "relay:unknown", "FAILrelay: unknown control frame"},
+		{relayOptions{control: true, parse: true, progressInfo: true}, progressControl, "OKAY"},
+	}
+	for _, test := range tests {
+		dev := newFastbootMock()
+		client, done := relayTest(t, dev, test.opts)
+		if response := relayExchange(t, client, test.command); response != test.response {
+			t.Errorf("%q with %+v: got %q, %q expected", test.command, test.opts, response, test.response)
+		}
+		relayWait(t, client, done)
+		if written := dev.writes(); len(written) != 0 {
+			t.Errorf("%q with %+v: device got %q", test.command, test.opts, written)
+		}
+	}
+}
+
+func TestClientConnectControl(t *testing.T) {
+
+	address := clientTestServer(t, newFastbootMock())
+	conn, err := clientConnect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !clientControl(conn) {
+		t.Errorf("control frames not negotiated")
+	}
+	if progress, err := clientAskProgress(conn); err != nil || progress {
+		// the test server doesn't enable progress frames
+		t.Errorf("progress: got %v, %v", progress, err)
+	}
+}
+
+// a server refusing anything but FB01, as one without control frames does
+func TestClientConnectControlFallback(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	magics := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			var header []byte = make([]byte, 4)
+			io.ReadFull(conn, header)
+			magics <- string(header)
+			if string(header) == "FB01" {
+				conn.Write(header)
+				// the first command of the client
+				netRead(conn)
+			}
+			conn.Close()
+		}
+	}()
+	conn, err := clientConnect(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if clientControl(conn) {
+		t.Errorf("control frames negotiated with a server refusing them")
+	}
+	if first, second := <-magics, <-magics; first != "FB02" || second != "FB01" {
+		t.Errorf("handshakes: got %q, %q", first, second)
+	}
+	if verify, err := clientSendSha256(conn, nil); err != nil || verify {
+		t.Errorf("sha256 sent to a server without control frames: got %v, %v", verify, err)
+	}
+}
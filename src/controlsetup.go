@@ -0,0 +1,109 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// usbControlRequest is a control transfer issued by --control-setup after
+// claiming the interface, for devices needing a vendor request before bulk
+// transfers work.
+type usbControlRequest struct {
+	requestType byte
+	request     byte
+	value       uint16
+	index       uint16
+	// sent to the device, host to device requests only
+	data []byte
+	// bytes read, device to host requests only
+	length int
+}
+
+// requests of --control-setup, issued in order
+var usbControlSetup []usbControlRequest
+
+// usbControlParse parses "bmRequestType:bRequest:wValue:wIndex[:data]", all
+// hex. data is the payload of a host to device request and the byte count to
+// read of a device to host one, e.g. "40:01:0000:0000:01ff" or "c0:02:0:0:4".
+func usbControlParse(spec string) (usbControlRequest, error) {
+
+	var c usbControlRequest
+	fields := strings.Split(spec, ":")
+	if len(fields) < 4 || len(fields) > 5 {
+		return c, fmt.Errorf("bad control transfer %q, bmRequestType:bRequest:wValue:wIndex[:data] expected", spec)
+	}
+	var numbers [4]uint64
+	for i, bits := range []int{8, 8, 16, 16} {
+		n, err := strconv.ParseUint(fields[i], 16, bits)
+		if err != nil {
+			return c, fmt.Errorf("bad control transfer %q: field %v: %v", spec, i+1, err)
+		}
+		numbers[i] = n
+	}
+	c.requestType, c.request = byte(numbers[0]), byte(numbers[1])
+	c.value, c.index = uint16(numbers[2]), uint16(numbers[3])
+	if len(fields) == 5 {
+		if c.in() {
+			n, err := strconv.ParseUint(fields[4], 16, 16)
+			if err != nil {
+				return c, fmt.Errorf("bad control transfer %q: length: %v", spec, err)
+			}
+			c.length = int(n)
+		} else {
+			data, err := hex.DecodeString(fields[4])
+			if err != nil || len(data) > 0xffff {
+				return c, fmt.Errorf("bad control transfer %q: data: %v", spec, err)
+			}
+			c.data = data
+		}
+	}
+	if c.requestType&0x60 == 0x60 {
+		return c, fmt.Errorf("bad control transfer %q: reserved request type", spec)
+	}
+	return c, nil
+}
+
+// in tells whether the request is device to host.
+func (c usbControlRequest) in() bool {
+
+	return c.requestType&0x80 != 0
+}
+
+func (c usbControlRequest) String() string {
+
+	s := fmt.Sprintf("%02x:%02x:%04x:%04x", c.requestType, c.request, c.value, c.index)
+	if c.in() {
+		return fmt.Sprintf("%v read %v", s, c.length)
+	}
+	return fmt.Sprintf("%v data %x", s, c.data)
+}
+
+// usbControlSend issues the --control-setup requests to an opened device.
+func usbControlSend(dev *usbDevice) error {
+
+	for _, c := range usbControlSetup {
+		length := len(c.data)
+		// the wrapper takes the address of the first byte even with no data
+		var buffer []byte = make([]byte, length+1)
+		copy(buffer, c.data)
+		if c.in() {
+			length = c.length
+			buffer = make([]byte, length+1)
+		}
+		n, err := dev.handle.ControlTransfer(c.requestType, c.request, c.value, c.index, buffer, length, usbTimeout)
+		if err != nil {
+			return fmt.Errorf("control transfer %v failed: %v", c, err)
+		}
+		if c.in() {
+			dev.logger.Printf("control transfer %v: got %x", c, buffer[0:n])
+		} else {
+			dev.logger.Printf("control transfer %v: sent %v bytes", c, n)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// set in the environment of the re-executed daemon process
+const daemonEnv = "REMOTE_FASTBOOT_DAEMON"
+
+func pidfileWrite(path string) error {
+
+	return os.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+}
+
+// exitHooks are run when the server is stopped by a signal
+var exitHooksLock sync.Mutex
+var exitHooks []func()
+
+// atExit adds a hook to run before the server exits on SIGINT or SIGTERM.
+func atExit(hook func()) {
+
+	exitHooksLock.Lock()
+	defer exitHooksLock.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+// handleExitSignals runs exit hooks, newest first, and exits when the server
+// is stopped by SIGINT or SIGTERM.
+func handleExitSignals() {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-signals
+		log.Printf("%v received, exiting", s)
+		exitHooksLock.Lock()
+		for i := len(exitHooks) - 1; i >= 0; i-- {
+			exitHooks[i]()
+		}
+		os.Exit(0)
+	}()
+}
+
+// pidfileRemoveOnExit removes the pid file when the server is stopped.
+func pidfileRemoveOnExit(path string) {
+
+	atExit(func() {
+		if err := os.Remove(path); err != nil {
+			log.Printf("remove pid file failed: %v", err)
+		}
+	})
+}
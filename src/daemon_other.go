@@ -0,0 +1,13 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !unix
+
+package main
+
+import "fmt"
+
+func daemonize() error {
+
+	return fmt.Errorf("daemon mode is not supported on this platform, use a service manager instead")
+}
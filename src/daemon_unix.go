@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonize detaches the server from the terminal. Go runtime can't survive
+// a bare fork, so the binary re-executes itself in a new session with stdio
+// redirected to /dev/null, and the parent exits.
+func daemonize() error {
+
+	if os.Getenv(daemonEnv) == "1" {
+		return nil
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find executable failed: %v", err)
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer null.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = null
+	cmd.Stdout = null
+	cmd.Stderr = null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("start daemon failed: %v", err)
+	}
+	log.Printf("daemon started, pid %v", cmd.Process.Pid)
+	os.Exit(0)
+	return nil
+}
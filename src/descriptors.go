@@ -0,0 +1,212 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	libusb "github.com/gotmc/libusb/v2"
+)
+
+// descriptor dump, a scoped analogue of lsusb -v for bug reports
+
+type dumpEndpoint struct {
+	Address       uint8  `json:"address"`
+	Direction     string `json:"direction"`
+	Type          string `json:"type"`
+	MaxPacketSize uint16 `json:"max_packet_size"`
+	Interval      uint8  `json:"interval"`
+}
+
+type dumpInterface struct {
+	Number     int            `json:"number"`
+	AltSetting int            `json:"alt_setting"`
+	Class      uint8          `json:"class"`
+	SubClass   uint8          `json:"subclass"`
+	Protocol   uint8          `json:"protocol"`
+	Matches    bool           `json:"matches"`
+	Endpoints  []dumpEndpoint `json:"endpoints"`
+}
+
+type dumpConfig struct {
+	Value      uint8           `json:"value"`
+	Attributes uint8           `json:"attributes"`
+	MaxPower   uint            `json:"max_power_ma"`
+	Interfaces []dumpInterface `json:"interfaces"`
+}
+
+type dumpDevice struct {
+	Bus               int          `json:"bus"`
+	Address           int          `json:"address"`
+	Vendor            string       `json:"vendor"`
+	Product           string       `json:"product"`
+	Serial            string       `json:"serial"`
+	USBVersion        string       `json:"usb_version"`
+	Class             uint8        `json:"class"`
+	SubClass          uint8        `json:"subclass"`
+	Protocol          uint8        `json:"protocol"`
+	MaxPacketSize0    uint8        `json:"max_packet_size0"`
+	NumConfigurations uint8        `json:"num_configurations"`
+	Configs           []dumpConfig `json:"configs"`
+	Errors            []string     `json:"errors,omitempty"`
+}
+
+var usbTransferTypeNames = map[libusb.TransferType]string{
+	libusb.ControlTransfer:     "control",
+	libusb.IsochronousTransfer: "isochronous",
+	libusb.BulkTransfer:        "bulk",
+	libusb.InterruptTransfer:   "interrupt",
+}
+
+// matches reports whether any interface of the device matches the rules.
+func (d *dumpDevice) matches() bool {
+
+	for _, config := range d.Configs {
+		for _, iface := range config.Interfaces {
+			if iface.Matches {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func usbDumpDevice(device *libusb.Device) *dumpDevice {
+
+	d := &dumpDevice{}
+	d.Bus, _ = device.BusNumber()
+	d.Address, _ = device.DeviceAddress()
+	desc, err := device.DeviceDescriptor()
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Sprintf("device descriptor: %v", err))
+		return d
+	}
+	d.Vendor = fmt.Sprintf("%04x", desc.VendorID)
+	d.Product = fmt.Sprintf("%04x", desc.ProductID)
+	d.USBVersion = fmt.Sprintf("%x.%02x", uint16(desc.USBSpecification)>>8, uint16(desc.USBSpecification)&0xff)
+	d.Class = uint8(desc.DeviceClass)
+	d.SubClass = desc.DeviceSubClass
+	d.Protocol = desc.DeviceProtocol
+	d.MaxPacketSize0 = desc.MaxPacketSize0
+	d.NumConfigurations = desc.NumConfigurations
+	if d.Serial, err = usbReadSerial(device, desc); err != nil {
+		d.Errors = append(d.Errors, fmt.Sprintf("serial: %v", err))
+	}
+
+	for i := 0; i < int(desc.NumConfigurations); i++ {
+		configDescriptor, err := device.ConfigDescriptor(i)
+		if err != nil {
+			d.Errors = append(d.Errors, fmt.Sprintf("config %v descriptor: %v", i, err))
+			continue
+		}
+		config := dumpConfig{
+			Value:      configDescriptor.ConfigurationValue,
+			Attributes: configDescriptor.Attributes,
+			MaxPower:   configDescriptor.MaxPowerMilliAmperes,
+		}
+		for _, supported := range configDescriptor.SupportedInterfaces {
+			for _, ifaceDescriptor := range supported.InterfaceDescriptors {
+				iface := dumpInterface{
+					Number:     ifaceDescriptor.InterfaceNumber,
+					AltSetting: ifaceDescriptor.AlternateSetting,
+					Class:      ifaceDescriptor.InterfaceClass,
+					SubClass:   ifaceDescriptor.InterfaceSubClass,
+					Protocol:   ifaceDescriptor.InterfaceProtocol,
+					Matches:    usbMatchDevice(desc, ifaceDescriptor),
+					Endpoints:  []dumpEndpoint{},
+				}
+				for _, endpoint := range ifaceDescriptor.EndpointDescriptors {
+					direction := "out"
+					if endpoint.Direction() == 1 {
+						direction = "in"
+					}
+					iface.Endpoints = append(iface.Endpoints, dumpEndpoint{
+						Address:       uint8(endpoint.EndpointAddress),
+						Direction:     direction,
+						Type:          usbTransferTypeNames[endpoint.TransferType()],
+						MaxPacketSize: endpoint.MaxPacketSize,
+						Interval:      endpoint.Interval,
+					})
+				}
+				config.Interfaces = append(config.Interfaces, iface)
+			}
+		}
+		d.Configs = append(d.Configs, config)
+	}
+	return d
+}
+
+func (d *dumpDevice) print(w io.Writer) {
+
+	fmt.Fprintf(w, "Bus %03d Device %03d: ID %v:%v serial %v\n", d.Bus, d.Address, d.Vendor, d.Product, d.Serial)
+	fmt.Fprintf(w, "  Device Descriptor:\n")
+	fmt.Fprintf(w, "    bcdUSB             %v\n", d.USBVersion)
+	fmt.Fprintf(w, "    bDeviceClass       0x%02x\n", d.Class)
+	fmt.Fprintf(w, "    bDeviceSubClass    0x%02x\n", d.SubClass)
+	fmt.Fprintf(w, "    bDeviceProtocol    0x%02x\n", d.Protocol)
+	fmt.Fprintf(w, "    bMaxPacketSize0    %v\n", d.MaxPacketSize0)
+	fmt.Fprintf(w, "    bNumConfigurations %v\n", d.NumConfigurations)
+	for _, config := range d.Configs {
+		fmt.Fprintf(w, "    Configuration Descriptor:\n")
+		fmt.Fprintf(w, "      bConfigurationValue %v\n", config.Value)
+		fmt.Fprintf(w, "      bmAttributes        0x%02x\n", config.Attributes)
+		fmt.Fprintf(w, "      MaxPower            %vmA\n", config.MaxPower)
+		for _, iface := range config.Interfaces {
+			match := ""
+			if iface.Matches {
+				match = " (matches device rules)"
+			}
+			fmt.Fprintf(w, "      Interface Descriptor:%v\n", match)
+			fmt.Fprintf(w, "        bInterfaceNumber   %v\n", iface.Number)
+			fmt.Fprintf(w, "        bAlternateSetting  %v\n", iface.AltSetting)
+			fmt.Fprintf(w, "        bInterfaceClass    0x%02x\n", iface.Class)
+			fmt.Fprintf(w, "        bInterfaceSubClass 0x%02x\n", iface.SubClass)
+			fmt.Fprintf(w, "        bInterfaceProtocol 0x%02x\n", iface.Protocol)
+			for _, endpoint := range iface.Endpoints {
+				fmt.Fprintf(w, "        Endpoint Descriptor:\n")
+				fmt.Fprintf(w, "          bEndpointAddress 0x%02x %v\n", endpoint.Address, endpoint.Direction)
+				fmt.Fprintf(w, "          Transfer Type    %v\n", endpoint.Type)
+				fmt.Fprintf(w, "          wMaxPacketSize   %v\n", endpoint.MaxPacketSize)
+				fmt.Fprintf(w, "          bInterval        %v\n", endpoint.Interval)
+			}
+		}
+	}
+	if len(d.Errors) > 0 {
+		fmt.Fprintf(w, "  Errors: %v\n", strings.Join(d.Errors, "; "))
+	}
+}
+
+// usbDumpDescriptors writes descriptors of every usb device, or only of the
+// ones having an interface matching the device rules and the serial if given.
+func usbDumpDescriptors(w io.Writer, all bool, serial string, asJSON bool) error {
+
+	usbDiscoveryLock.Lock()
+	defer usbDiscoveryLock.Unlock()
+
+	devices, err := usbCtx.DeviceList()
+	if err != nil {
+		return err
+	}
+	dumps := []*dumpDevice{}
+	for _, device := range devices {
+		d := usbDumpDevice(device)
+		if !all && (!d.matches() || (serial != "" && d.Serial != serial)) {
+			continue
+		}
+		dumps = append(dumps, d)
+	}
+
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(dumps)
+	}
+	for _, d := range dumps {
+		d.print(w)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	libusb "github.com/gotmc/libusb/v2"
+)
+
+// usbMatchRule describes a device the server is allowed to relay to.
+// Zero vendorID/productID match any device.
+type usbMatchRule struct {
+	vendorID  uint16
+	productID uint16
+	class     uint8
+	subClass  uint8
+	protocol  uint8
+}
+
+// standard fastboot interface: vendor specific class, subclass 0x42, protocol 0x03
+var fastbootRule = usbMatchRule{class: 0xff, subClass: 0x42, protocol: 0x03}
+
+var usbMatchRules = []usbMatchRule{fastbootRule}
+
+func (rule usbMatchRule) match(desc *libusb.Descriptor, iface *libusb.InterfaceDescriptor) bool {
+
+	if rule.vendorID != 0 && rule.vendorID != desc.VendorID {
+		return false
+	}
+	if rule.productID != 0 && rule.productID != desc.ProductID {
+		return false
+	}
+	return iface.InterfaceClass == rule.class &&
+		iface.InterfaceSubClass == rule.subClass &&
+		iface.InterfaceProtocol == rule.protocol
+}
+
+func usbMatchDevice(desc *libusb.Descriptor, iface *libusb.InterfaceDescriptor) bool {
+
+	for _, rule := range usbMatchRules {
+		if rule.match(desc, iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHexID(s string, bits int) (uint64, error) {
+
+	if s == "*" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 16, bits)
+}
+
+// parseMatchRule parses a "vid:pid [class:subclass:protocol]" line, all values in hex.
+// "*" may be used as vid or pid to match any device.
+func parseMatchRule(line string) (usbMatchRule, error) {
+
+	rule := fastbootRule
+	fields := strings.Fields(line)
+	if len(fields) < 1 || len(fields) > 2 {
+		return rule, fmt.Errorf("expected \"vid:pid [class:subclass:protocol]\"")
+	}
+
+	ids := strings.Split(fields[0], ":")
+	if len(ids) != 2 {
+		return rule, fmt.Errorf("bad vid:pid %q", fields[0])
+	}
+	vid, err := parseHexID(ids[0], 16)
+	if err != nil {
+		return rule, fmt.Errorf("bad vid %q", ids[0])
+	}
+	pid, err := parseHexID(ids[1], 16)
+	if err != nil {
+		return rule, fmt.Errorf("bad pid %q", ids[1])
+	}
+	rule.vendorID = uint16(vid)
+	rule.productID = uint16(pid)
+
+	if len(fields) == 2 {
+		triple := strings.Split(fields[1], ":")
+		if len(triple) != 3 {
+			return rule, fmt.Errorf("bad interface class:subclass:protocol %q", fields[1])
+		}
+		var values [3]uint8
+		for i, s := range triple {
+			v, err := strconv.ParseUint(s, 16, 8)
+			if err != nil {
+				return rule, fmt.Errorf("bad interface class:subclass:protocol %q", fields[1])
+			}
+			values[i] = uint8(v)
+		}
+		rule.class, rule.subClass, rule.protocol = values[0], values[1], values[2]
+	}
+	return rule, nil
+}
+
+// loadDeviceList reads match rules from file, one per line.
+// Empty lines and lines starting with '#' are ignored.
+func loadDeviceList(path string) ([]usbMatchRule, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []usbMatchRule
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseMatchRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, lineNumber, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%v: no device rules", path)
+	}
+	return rules, nil
+}
@@ -0,0 +1,66 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// friendly device names by serial, set with --device-name serial=name. Only
+// what's shown changes: logs, audit files, events and the admin server,
+// devices are still matched by their real serial.
+var deviceNamesLock sync.Mutex
+var deviceNames = map[string]string{}
+
+// deviceNamesParse returns the names of "serial=name" items.
+func deviceNamesParse(items []string) (map[string]string, error) {
+
+	names := map[string]string{}
+	for _, item := range items {
+		serial, name, ok := strings.Cut(item, "=")
+		serial, name = strings.TrimSpace(serial), strings.TrimSpace(name)
+		if !ok || serial == "" || name == "" {
+			return nil, fmt.Errorf("bad device name %q, serial=name expected", item)
+		}
+		names[serial] = name
+	}
+	return names, nil
+}
+
+func deviceNamesSet(names map[string]string) {
+
+	deviceNamesLock.Lock()
+	defer deviceNamesLock.Unlock()
+	deviceNames = names
+}
+
+func deviceNamesGet() map[string]string {
+
+	deviceNamesLock.Lock()
+	defer deviceNamesLock.Unlock()
+	return deviceNames
+}
+
+// deviceNamesString returns the names as the "serial=name" list they're
+// given as, sorted by serial.
+func deviceNamesString(names map[string]string) string {
+
+	var items []string
+	for serial, name := range names {
+		items = append(items, serial+"="+name)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// deviceNameOf returns the friendly name of serial, empty if it has none.
+func deviceNameOf(serial string) string {
+
+	deviceNamesLock.Lock()
+	defer deviceNamesLock.Unlock()
+	return deviceNames[serial]
+}
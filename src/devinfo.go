@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const collectVarsTimeout = 10 * time.Second
+
+// device variables reported by "getvar:all", by device name
+var deviceVarsLock sync.Mutex
+var deviceVars = map[string]map[string]string{}
+
+// usbCollectVars runs "getvar:all" and returns the variables from its INFO
+// lines, e.g. "INFOversion-bootloader: 1.0" or "INFOpartition-size:boot_a: 0x4000000".
+func usbCollectVars(dev usbTransport) (map[string]string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectVarsTimeout)
+	defer cancel()
+
+	if err := dev.Write(ctx, []byte("getvar:all")); err != nil {
+		return nil, err
+	}
+	vars := map[string]string{}
+	var response []byte = make([]byte, usbResponseSize)
+	for {
+		n, err := dev.Read(ctx, response)
+		if err != nil {
+			usbDrainResponse(ctx, dev)
+			return nil, err
+		}
+		if n < 4 {
+			continue
+		}
+		switch string(response[0:4]) {
+		case "INFO":
+			line := string(response[4:n])
+			if i := strings.LastIndex(line, ": "); i > 0 {
+				vars[line[0:i]] = line[i+2:]
+			}
+		case "OKAY":
+			return vars, nil
+		case "FAIL":
+			return nil, fmt.Errorf("getvar:all failed: %v", string(response[4:n]))
+		}
+	}
+}
+
+// usbCommand runs a fastboot command and returns the message of its OKAY
+// response, INFO lines are skipped.
+func usbCommand(dev usbTransport, command string) (string, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectVarsTimeout)
+	defer cancel()
+
+	if err := dev.Write(ctx, []byte(command)); err != nil {
+		return "", err
+	}
+	var response []byte = make([]byte, usbResponseSize)
+	for {
+		n, err := dev.Read(ctx, response)
+		if err != nil {
+			usbDrainResponse(ctx, dev)
+			return "", err
+		}
+		if n < 4 {
+			continue
+		}
+		switch string(response[0:4]) {
+		case "OKAY":
+			return string(response[4:n]), nil
+		case "FAIL":
+			return "", fmt.Errorf("%v failed: %v", command, string(response[4:n]))
+		}
+	}
+}
+
+// usbDrainResponse reads the rest of the response to a command given up on
+// once its ctx expired, up to the final OKAY or FAIL: the device would
+// otherwise send it to the client of the session.
+func usbDrainResponse(ctx context.Context, dev usbTransport) {
+
+	if ctx.Err() == nil {
+		// the device is silent or failed, nothing is left to read
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), collectVarsTimeout)
+	defer cancel()
+	var response []byte = make([]byte, usbResponseSize)
+	for {
+		n, err := dev.Read(ctx, response)
+		if err != nil {
+			return
+		}
+		if n >= 4 && (string(response[0:4]) == "OKAY" || string(response[0:4]) == "FAIL") {
+			return
+		}
+	}
+}
+
+// usbGetVar queries a single variable with "getvar:<name>".
+func usbGetVar(dev usbTransport, name string) (string, error) {
+
+	return usbCommand(dev, "getvar:"+name)
+}
+
+// usbDeviceMode tells whether the device runs bootloader fastboot or the
+// userspace fastbootd from recovery. Both enumerate with the same fastboot
+// interface, only fastbootd reports "is-userspace" as "yes".
+func usbDeviceMode(dev usbTransport) string {
+
+	userspace, err := usbGetVar(dev, "is-userspace")
+	if err != nil || userspace != "yes" {
+		return "bootloader"
+	}
+	return "fastbootd"
+}
+
+// collectInfo stores the variables and unlock state of dev for the admin
+// server, see --collect-info.
+func collectInfo(dev *usbDevice) {
+
+	vars, err := usbCollectVars(dev)
+	if err != nil {
+		dev.logger.Printf("collect device info failed: %v", err)
+		return
+	}
+	state, ability, err := usbUnlockState(dev)
+	if err != nil {
+		dev.logger.Printf("collect unlock state failed: %v", err)
+	}
+	vars[unlockStateVar] = state
+	vars[unlockAbilityVar] = ability
+	deviceVarsStore(usbDeviceName(dev), vars)
+}
+
+func deviceVarsStore(name string, vars map[string]string) {
+
+	deviceVarsLock.Lock()
+	defer deviceVarsLock.Unlock()
+	deviceVars[name] = vars
+}
+
+// deviceVarsSnapshot returns a copy safe to use without the lock.
+func deviceVarsSnapshot() map[string]map[string]string {
+
+	deviceVarsLock.Lock()
+	defer deviceVarsLock.Unlock()
+	snapshot := make(map[string]map[string]string, len(deviceVars))
+	for name, vars := range deviceVars {
+		snapshot[name] = vars
+	}
+	return snapshot
+}
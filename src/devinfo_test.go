@@ -0,0 +1,57 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// newGetvarAllMock answers getvar:all with vars as INFO lines, other commands
+// with OKAY and the command.
+func newGetvarAllMock(vars ...string) *usbMock {
+
+	return newUsbMock(func(data []byte) []usbMockRead {
+		if string(data) != "getvar:all" {
+			return []usbMockRead{{data: append([]byte("OKAY"), data...)}}
+		}
+		var reads []usbMockRead
+		for _, v := range vars {
+			reads = append(reads, usbMockRead{data: []byte("INFO" + v)})
+		}
+		return append(reads, usbMockRead{data: []byte("OKAY")})
+	})
+}
+
+func TestUsbCollectVars(t *testing.T) {
+
+	dev := newGetvarAllMock("version-bootloader: 1.0", "partition-size:boot_a: 0x4000000")
+	vars, err := usbCollectVars(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["version-bootloader"] != "1.0" || vars["partition-size:boot_a"] != "0x4000000" || len(vars) != 2 {
+		t.Errorf("got %v", vars)
+	}
+}
+
+func TestUsbDrainResponse(t *testing.T) {
+
+	dev := newGetvarAllMock("version-bootloader: 1.0", "unlocked: no", "slot-count: 2")
+	if err := dev.Write(context.Background(), []byte("getvar:all")); err != nil {
+		t.Fatal(err)
+	}
+	// given up on after its first line
+	ctx, cancel := context.WithCancel(context.Background())
+	var response []byte = make([]byte, usbResponseSize)
+	if n, err := dev.Read(ctx, response); err != nil || string(response[0:n]) != "INFOversion-bootloader: 1.0" {
+		t.Fatalf("first line: got %q, %v", response[0:n], err)
+	}
+	cancel()
+	usbDrainResponse(ctx, dev)
+	// the rest of getvar:all must not reach the next command
+	if message, err := usbCommand(dev, "getvar:product"); err != nil || message != "getvar:product" {
+		t.Errorf("after the drain: got %q, %v", message, err)
+	}
+}
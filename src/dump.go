@@ -0,0 +1,131 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clientDump saves partition to the file at path with fastboot "fetch:", in
+// pieces of the device max-fetch-size if it reports one.
+func clientDump(address string, partition string, path string) error {
+
+	conn, err := clientConnect(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	partition = strings.TrimSpace(partition)
+	size, err := clientGetvarSize(conn, "partition-size:"+partition)
+	if err != nil {
+		return err
+	}
+	maxFetch, err := clientGetvarSize(conn, "max-fetch-size")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = clientFetchAll(conn, partition, size, maxFetch, file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("OKAY\n")
+	return nil
+}
+
+func clientFetchAll(conn net.Conn, partition string, size int64, maxFetch int64, file *os.File) error {
+
+	if maxFetch == 0 || size == 0 || size <= maxFetch {
+		fmt.Printf("Fetching '%v'\n", partition)
+		_, err := clientFetch(conn, "fetch:"+partition, file)
+		return err
+	}
+	for offset := int64(0); offset < size; {
+		n := maxFetch
+		if size-offset < n {
+			n = size - offset
+		}
+		fmt.Printf("Fetching '%v' %v/%v KB\n", partition, (offset+n)/1024, size/1024)
+		received, err := clientFetch(conn, fmt.Sprintf("fetch:%v:0x%08x:0x%08x", partition, offset, n), file)
+		if err != nil {
+			return err
+		}
+		if received != n {
+			return fmt.Errorf("fetch at %v: %v bytes received, %v expected", offset, received, n)
+		}
+		offset += n
+	}
+	return nil
+}
+
+// clientFetch runs a fetch command and appends the data sent by the device
+// to file, returns its size.
+func clientFetch(conn net.Conn, command string, file *os.File) (int64, error) {
+
+	token, message, err := clientCommand(conn, command)
+	if errors.Is(err, errClientRemote) {
+		return 0, fmt.Errorf("%v, does the device support fetch? (requires fastbootd or a recent bootloader)", err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if token != "DATA" {
+		return 0, fmt.Errorf("%v: DATA expected, got %v%v", command, token, message)
+	}
+	size, err := strconv.ParseUint(message, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%v: bad DATA size %q", command, message)
+	}
+	for received := uint64(0); received < size; {
+		data, err := netRead(conn)
+		if err != nil {
+			return 0, err
+		}
+		if received+uint64(len(data)) > size {
+			return 0, fmt.Errorf("%v: more than %v bytes received", command, size)
+		}
+		_, err = file.Write(data)
+		received += uint64(len(data))
+		netBufferRelease(data)
+		if err != nil {
+			return 0, err
+		}
+	}
+	token, message, err = clientResponse(conn, command)
+	if err == nil && token != "OKAY" {
+		err = fmt.Errorf("%v: OKAY expected, got %v%v", command, token, message)
+	}
+	return int64(size), err
+}
+
+// clientGetvarSize returns a size variable, 0 if the device doesn't know it.
+func clientGetvarSize(conn net.Conn, name string) (int64, error) {
+
+	_, value, err := clientCommand(conn, "getvar:"+name)
+	if errors.Is(err, errClientRemote) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(value), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %v %q", name, value)
+	}
+	return size, nil
+}
@@ -0,0 +1,116 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Echo test, enabled with --echo-test: a client sending one of these magics
+// instead of "FB01" gets every frame back as it is, no device is opened. It
+// tells network and framing problems apart from usb ones.
+const (
+	netHandshakeEcho         = "FBE1"
+	netHandshakeEchoCompress = "FBEZ"
+)
+
+var netEchoTest bool
+
+// an echo client sending nothing for that long is disconnected
+var echoIdleTimeout = 30 * time.Second
+
+// payload sizes sent by the echo check, up to a full download frame
+var echoCheckSizes = []int{0, 1, 4, 64, 511, 512, 4096, 65535, 65536, 65537, 1 << 20}
+
+// netEchoHandshake returns the echo magic to answer a client sending header
+// with, empty if it doesn't ask for the echo test or it's not enabled.
+func netEchoHandshake(header string, compress bool) string {
+
+	if !netEchoTest {
+		return ""
+	}
+	if header == netHandshakeEcho || (compress && header == netHandshakeEchoCompress) {
+		return header
+	}
+	return ""
+}
+
+// echoServe sends every frame of the client back until it disconnects or is
+// idle for echoIdleTimeout.
+func echoServe(conn net.Conn, magic string) error {
+
+	codec := &netCodec{compress: magic == netHandshakeEchoCompress}
+	start := time.Now()
+	frames, total := 0, 0
+	defer func() {
+		log.Printf("echo: %v frames, %v bytes in %v", frames, total, time.Since(start).Round(time.Millisecond))
+		codec.logStats(log.Default())
+	}()
+	for {
+		deadline := time.Now().Add(echoIdleTimeout)
+		conn.SetReadDeadline(deadline)
+		data, err := codec.read(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			// the framing error doesn't wrap the timeout
+			if !time.Now().Before(deadline) {
+				return fmt.Errorf("client idle for %v, closed", echoIdleTimeout)
+			}
+			return err
+		}
+		if err = codec.write(conn, data); err != nil {
+			return err
+		}
+		frames++
+		total += len(data)
+		netBufferRelease(data)
+	}
+}
+
+// clientEchoCheck sends frames of echoCheckSizes to a server started with
+// --echo-test and verifies they come back unchanged.
+func clientEchoCheck(address string, compress bool) error {
+
+	magic := netHandshakeEcho
+	if compress {
+		magic = netHandshakeEchoCompress
+	}
+	conn, err := clientConnectMagic(address, magic)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	codec := &netCodec{compress: compress}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for _, size := range echoCheckSizes {
+		var payload []byte = make([]byte, size)
+		// half random, half zeroes so compression has something to do
+		random.Read(payload[0 : size/2])
+		conn.SetDeadline(time.Now().Add(clientTimeout))
+		start := time.Now()
+		if err = codec.write(conn, payload); err != nil {
+			return err
+		}
+		echo, err := codec.read(conn)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(echo, payload) {
+			return fmt.Errorf("payload of %v bytes came back as %v different bytes", size, len(echo))
+		}
+		fmt.Printf("%8v bytes: ok, %v\n", size, time.Since(start).Round(time.Microsecond))
+	}
+	fmt.Printf("OKAY\n")
+	return nil
+}
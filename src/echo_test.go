@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEchoServe(t *testing.T) {
+
+	for _, magic := range []string{netHandshakeEcho, netHandshakeEchoCompress} {
+		client, server := net.Pipe()
+		done := make(chan error, 1)
+		go func() { done <- echoServe(server, magic) }()
+		codec := &netCodec{compress: magic == netHandshakeEchoCompress}
+		for _, size := range []int{0, 1, 512, 65537} {
+			var data []byte = bytes.Repeat([]byte{0x5a}, size)
+			if err := codec.write(client, data); err != nil {
+				t.Fatalf("%v: send %v bytes: %v", magic, size, err)
+			}
+			echoed, err := codec.read(client)
+			if err != nil || !bytes.Equal(echoed, data) {
+				t.Errorf("%v: %v bytes echoed as %v, %v", magic, size, len(echoed), err)
+			}
+		}
+		client.Close()
+		if err := <-done; err != nil {
+			t.Errorf("%v: disconnect: %v", magic, err)
+		}
+	}
+}
+
+func TestEchoIdle(t *testing.T) {
+
+	defer func(timeout time.Duration) { echoIdleTimeout = timeout }(echoIdleTimeout)
+	echoIdleTimeout = 50 * time.Millisecond
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- echoServe(server, netHandshakeEcho) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "idle") {
+			t.Errorf("idle client: got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle echo client not closed")
+	}
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pborman/getopt/v2"
+)
+
+// Every long option may be given as an environment variable named
+// FBRELAY_ followed by the option name in upper case, dashes replaced by
+// underscores, e.g. FBRELAY_SERIAL_HASH_KEY, so secrets stay out of the
+// process list. The command line takes precedence over the environment,
+// the environment over the config file.
+const envPrefix = "FBRELAY_"
+
+// options set from the environment, by long name
+var envSet = map[string]bool{}
+
+func envName(option string) string {
+
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(option, "-", "_"))
+}
+
+// optionLookup returns the long option name, nil if there is none: for an
+// unknown name getopt.Lookup returns a nil *option as a non-nil Option.
+func optionLookup(name string) getopt.Option {
+
+	var found getopt.Option
+	getopt.VisitAll(func(opt getopt.Option) {
+		if opt.LongName() == name {
+			found = opt
+		}
+	})
+	return found
+}
+
+// envApply sets the options of set not given on the command line from the
+// environment.
+func envApply(set *getopt.Set) error {
+
+	var err error
+	set.VisitAll(func(opt getopt.Option) {
+		name := opt.LongName()
+		if err != nil || name == "" || opt.Seen() {
+			return
+		}
+		value, ok := os.LookupEnv(envName(name))
+		if !ok {
+			return
+		}
+		if e := opt.Value().Set(value, opt); e != nil {
+			err = fmt.Errorf("%v: %v", envName(name), e)
+			return
+		}
+		envSet[name] = true
+	})
+	return err
+}
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pborman/getopt/v2"
+)
+
+func TestEnvApply(t *testing.T) {
+
+	defer func(set map[string]bool) { envSet = set }(envSet)
+	tests := []struct {
+		args []string
+		env  map[string]string
+		// values of the options afterwards and whether they came from the
+		// environment
+		verbose  int
+		listen   string
+		readonly bool
+		fromEnv  []string
+	}{
+		{nil, nil, 0, "", false, nil},
+		{nil, map[string]string{"FBRELAY_VERBOSE": "2", "FBRELAY_LISTEN": ":5554,:5555", "FBRELAY_READONLY": "true"},
+			2, ":5554 :5555", true, []string{"listen", "readonly", "verbose"}},
+		{[]string{"-v", "--listen", ":6000", "--readonly"},
+			map[string]string{"FBRELAY_VERBOSE": "3", "FBRELAY_LISTEN": ":5554", "FBRELAY_READONLY": "false"},
+			1, ":6000", true, nil},
+		{[]string{"--listen", ":6000"}, map[string]string{"FBRELAY_VERBOSE": "2", "FBRELAY_LISTEN": ":5554"},
+			2, ":6000", false, []string{"verbose"}},
+		{nil, map[string]string{"FBRELAY_READONLY": "false"}, 0, "", false, []string{"readonly"}},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			envSet = map[string]bool{}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			set := getopt.New()
+			verbose := set.CounterLong("verbose", 'v')
+			listen := set.ListLong("listen", 'l')
+			readonly := set.BoolLong("readonly", 0)
+			set.StringLong("serial", 's', "")
+			if err := set.Getopt(append([]string{"remote-fastboot"}, test.args...), nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := envApply(set); err != nil {
+				t.Fatal(err)
+			}
+			if *verbose != test.verbose || strings.Join(*listen, " ") != test.listen || *readonly != test.readonly {
+				t.Errorf("env %v: got verbose %v, listen %q, readonly %v", test.env, *verbose, *listen, *readonly)
+			}
+			var fromEnv []string
+			for _, name := range []string{"listen", "readonly", "serial", "verbose"} {
+				if envSet[name] {
+					fromEnv = append(fromEnv, name)
+				}
+			}
+			if strings.Join(fromEnv, " ") != strings.Join(test.fromEnv, " ") {
+				t.Errorf("env %v: set from the environment %v, %v expected", test.env, fromEnv, test.fromEnv)
+			}
+		})
+	}
+}
+
+func TestEnvApplyBadValue(t *testing.T) {
+
+	defer func(set map[string]bool) { envSet = set }(envSet)
+	for name, value := range map[string]string{"FBRELAY_VERBOSE": "lots", "FBRELAY_READONLY": "maybe"} {
+		t.Run(name, func(t *testing.T) {
+			envSet = map[string]bool{}
+			t.Setenv(name, value)
+			set := getopt.New()
+			set.CounterLong("verbose", 'v')
+			set.BoolLong("readonly", 0)
+			if err := envApply(set); err == nil || !strings.HasPrefix(err.Error(), name+": ") {
+				t.Errorf("%v=%v: got %v", name, value, err)
+			}
+		})
+	}
+}
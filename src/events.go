@@ -0,0 +1,122 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// device state transitions published as events
+const (
+	eventConnected      = "connected"
+	eventSessionStarted = "session-started"
+	eventSessionEnded   = "session-ended"
+	eventError          = "error"
+	eventRebooted       = "rebooted"
+)
+
+// events a subscriber may lag behind before it's dropped
+const eventBacklog = 64
+
+// interval of comments keeping idle event streams alive
+const eventKeepalive = 30 * time.Second
+
+type event struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"event"`
+	Device  string    `json:"device,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+var eventLock sync.Mutex
+var eventSubscribers = map[chan event]bool{}
+
+// eventPublish sends an event to the subscribers without waiting for them, a
+// subscriber whose backlog is full is dropped, it may subscribe again.
+func eventPublish(kind string, device string, client string, message string) {
+
+	e := event{Time: time.Now(), Kind: kind, Device: device, Client: client, Message: message}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	for ch := range eventSubscribers {
+		select {
+		case ch <- e:
+		default:
+			log.Printf("events: subscriber too slow, dropped")
+			delete(eventSubscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+func eventSubscribe() chan event {
+
+	ch := make(chan event, eventBacklog)
+	eventLock.Lock()
+	eventSubscribers[ch] = true
+	eventLock.Unlock()
+	return ch
+}
+
+func eventUnsubscribe(ch chan event) {
+
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if eventSubscribers[ch] {
+		delete(eventSubscribers, ch)
+		close(ch)
+	}
+}
+
+// adminEvents streams the events as server-sent events until the client goes
+// away or is dropped for not keeping up.
+func adminEvents(w http.ResponseWriter, r *http.Request) {
+
+	ch := eventSubscribe()
+	defer eventUnsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	// a client not reading its stream doesn't hold the handler forever
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		log.Printf("events: %v", err)
+		return
+	}
+	ticker := time.NewTicker(eventKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("events: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", e.Kind, data); err != nil {
+				return
+			}
+		}
+		rc.SetWriteDeadline(time.Now().Add(eventKeepalive))
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	libusb "github.com/gotmc/libusb/v2"
+)
+
+// usbSkip is a device usbDeviceFind passed over and why. A near device has a
+// fastboot interface, so it's likely the one the operator expected.
+type usbSkip struct {
+	bus     int
+	address int
+	vendor  uint16
+	product uint16
+	reason  string
+	near    bool
+}
+
+// devices skipped by the last usbDeviceFind, guarded by usbDiscoveryLock
+var usbSkipped []usbSkip
+
+// log every skipped device after each discovery, not only on failure
+var usbExplain bool
+
+func usbSkipDevice(device *libusb.Device, desc *libusb.Descriptor, near bool, format string, v ...any) {
+
+	skip := usbSkip{reason: fmt.Sprintf(format, v...), near: near}
+	skip.bus, _ = device.BusNumber()
+	skip.address, _ = device.DeviceAddress()
+	if desc != nil {
+		skip.vendor, skip.product = desc.VendorID, desc.ProductID
+	}
+	usbSkipped = append(usbSkipped, skip)
+}
+
+// usbLogSkipped logs the devices skipped by the last discovery, only the
+// near ones unless all is set. Must be called with usbDiscoveryLock held.
+func usbLogSkipped(all bool) {
+
+	for _, skip := range usbSkipped {
+		if all || skip.near {
+			log.Printf("skipped device %v:%v %04x:%04x: %v", skip.bus, skip.address, skip.vendor, skip.product, skip.reason)
+		}
+	}
+}
+
+// mismatch returns why dev doesn't match sel, empty if it does.
+func (sel usbSelector) mismatch(dev *usbDevice) string {
+
+	if sel.serial != "" && sel.serial != dev.serial {
+		return fmt.Sprintf("serial %q, %q expected", dev.serial, sel.serial)
+	}
+	if len(sel.serialHashes) > 0 && !serialHashListed(sel.serialHashKey, sel.serialHashes, dev.serial) {
+		return fmt.Sprintf("serial %q not among --serial-hash", dev.serial)
+	}
+	if sel.bus != 0 && (sel.bus != dev.bus || sel.address != dev.address) {
+		return fmt.Sprintf("location, %v:%v expected", sel.bus, sel.address)
+	}
+	if sel.portPath != "" && sel.portPath != dev.portPath {
+		return fmt.Sprintf("port path %q, %q expected", dev.portPath, sel.portPath)
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// the longest command a fastboot client sends, relay control frames included
+const fastbootCommandMax = 4096
+
+// fastbootParse splits a command into verb and argument:
+// "flash:boot" -> "flash", "boot"; "oem unlock" -> "oem", "unlock".
+func fastbootParse(command string) (string, string) {
+
+	if i := strings.IndexAny(command, ": "); i >= 0 {
+		return command[0:i], command[i+1:]
+	}
+	return command, ""
+}
+
+// commands allowed in read-only mode, matched as whole words: the command
+// alone or followed by arguments after a space or ":", an entry ending with
+// ":" is followed by its argument. Anything else (flash, erase, format,
+// download, boot, set_active, reboot, continue, other oem and flashing
+// commands, logical partition management) may change the device state.
+var fastbootReadOnlyCommands = []string{
+	"getvar:",
+	"upload",
+	"fetch:",
+	"oem get",
+	"oem read",
+	"oem device-info",
+	"flashing get_unlock_ability",
+}
+
+func fastbootIsReadOnly(command string) bool {
+
+	for _, word := range fastbootReadOnlyCommands {
+		rest, ok := strings.CutPrefix(command, word)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(word, ":") || rest == "" || rest[0] == ' ' || rest[0] == ':' {
+			return true
+		}
+	}
+	return false
+}
+
+// partitionPolicy restricts which partitions may be flashed or erased.
+// An empty allow list allows everything not denied.
+type partitionPolicy struct {
+	allow []string
+	deny  []string
+}
+
+func partitionListed(list []string, partition string) bool {
+
+	// "boot" also covers slots "boot_a" and "boot_b"
+	base := strings.TrimSuffix(strings.TrimSuffix(partition, "_a"), "_b")
+	for _, name := range list {
+		if name == partition || name == base {
+			return true
+		}
+	}
+	return false
+}
+
+func (p partitionPolicy) allowed(partition string) bool {
+
+	if partitionListed(p.deny, partition) {
+		return false
+	}
+	// a slotless partition is written to the current slot, which may be a
+	// denied one
+	if !strings.HasSuffix(partition, "_a") && !strings.HasSuffix(partition, "_b") {
+		for _, name := range p.deny {
+			if name == partition+"_a" || name == partition+"_b" {
+				return false
+			}
+		}
+	}
+	return len(p.allow) == 0 || partitionListed(p.allow, partition)
+}
+
+// check returns the reason command must not be forwarded, empty if it may be.
+func (p partitionPolicy) check(command string) string {
+
+	verb, partition := fastbootParse(command)
+	if verb != "flash" && verb != "erase" {
+		return ""
+	}
+	if !p.allowed(partition) {
+		return "partition " + partition + " is not allowed by relay policy"
+	}
+	return ""
+}
+
+// fastbootMessage returns the text after the token of a FAIL, INFO or TEXT
+// response for logging: invalid UTF-8 replaced, cut to max characters and
+// quoted so non-printables are escaped. ok is false for other responses.
+func fastbootMessage(response []byte, max int) (string, bool) {
+
+	if len(response) < 4 {
+		return "", false
+	}
+	switch string(response[0:4]) {
+	case "FAIL", "INFO", "TEXT":
+	default:
+		return "", false
+	}
+	message := []rune(strings.ToValidUTF8(string(response[4:]), "\uFFFD"))
+	if len(message) > max {
+		return strconv.Quote(string(message[0:max])) + "...", true
+	}
+	return strconv.Quote(string(message)), true
+}
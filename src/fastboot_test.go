@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"testing"
+)
+
+func TestPartitionPolicy(t *testing.T) {
+
+	tests := []struct {
+		policy  partitionPolicy
+		command string
+		allowed bool
+	}{
+		{partitionPolicy{}, "flash:boot", true},
+		{partitionPolicy{deny: []string{"boot"}}, "flash:boot", false},
+		{partitionPolicy{deny: []string{"boot"}}, "flash:boot_a", false},
+		{partitionPolicy{deny: []string{"boot"}}, "erase:boot_b", false},
+		{partitionPolicy{deny: []string{"boot"}}, "flash:system", true},
+		{partitionPolicy{deny: []string{"boot_a"}}, "flash:boot_a", false},
+		{partitionPolicy{deny: []string{"boot_a"}}, "flash:boot", false},
+		{partitionPolicy{deny: []string{"boot_a"}}, "erase:boot", false},
+		{partitionPolicy{deny: []string{"boot_a"}}, "flash:boot_b", true},
+		{partitionPolicy{deny: []string{"boot_b"}}, "flash:boot", false},
+		{partitionPolicy{deny: []string{"boot_a"}}, "getvar:partition-size:boot", true},
+		{partitionPolicy{allow: []string{"boot"}}, "flash:boot", true},
+		{partitionPolicy{allow: []string{"boot"}}, "flash:boot_b", true},
+		{partitionPolicy{allow: []string{"boot"}}, "flash:system", false},
+		{partitionPolicy{allow: []string{"boot_a"}}, "flash:boot_a", true},
+		{partitionPolicy{allow: []string{"boot_a"}}, "flash:boot_b", false},
+		{partitionPolicy{allow: []string{"boot_a"}}, "flash:boot", false},
+		{partitionPolicy{allow: []string{"boot"}, deny: []string{"boot_b"}}, "flash:boot_a", true},
+		{partitionPolicy{allow: []string{"boot"}, deny: []string{"boot_b"}}, "flash:boot", false},
+		{partitionPolicy{allow: []string{"boot"}}, "reboot", true},
+	}
+	for _, test := range tests {
+		if reason := test.policy.check(test.command); (reason == "") != test.allowed {
+			t.Errorf("%q with %+v: got %q", test.command, test.policy, reason)
+		}
+	}
+}
+
+func TestReadOnlyCommands(t *testing.T) {
+
+	opts := relayOptions{parse: true, readonly: true}
+	tests := []struct {
+		command string
+		allowed bool
+	}{
+		{"getvar:product", true},
+		{"getvar:all", true},
+		{"upload", true},
+		{"fetch:boot_a", true},
+		{"oem get", true},
+		{"oem get version", true},
+		{"oem get:version", true},
+		{"oem read partition", true},
+		{"oem device-info", true},
+		{"flashing get_unlock_ability", true},
+		{"getvar", false},
+		{"uploadx", false},
+		{"oem getout", false},
+		{"oem readback-and-erase", false},
+		{"oem device-infox", false},
+		{"flashing unlock", false},
+		{"flash:boot", false},
+		{"erase:userdata", false},
+		{"download:00001000", false},
+		{"set_active:b", false},
+		{"reboot", false},
+		{"oem unlock", false},
+	}
+	for _, test := range tests {
+		if reason := opts.reject(test.command); (reason == "") != test.allowed {
+			t.Errorf("%q: got %q", test.command, reason)
+		}
+	}
+}
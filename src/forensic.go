@@ -0,0 +1,222 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Forensic buffer file layout, all numbers little endian:
+//
+//	header, 64 bytes: magic "RFFORENS", version u32, state u32, ring size u64,
+//	    head u64 (ring offset of the next record), tail u64 (of the oldest one),
+//	    used u64 (bytes of records in the ring)
+//	ring of records, a record may wrap over the end of the ring:
+//	    kind u8, direction u8, 2 reserved bytes, captured size u32,
+//	    original size u32, time u64 (unix ns), captured data
+const forensicMagic = "RFFORENS"
+const forensicHeaderSize = 64
+const forensicRecordHeaderSize = 20
+
+const (
+	forensicStateRecording = 0
+	forensicStateAbnormal  = 1
+)
+
+const (
+	forensicKindPacket = 'P'
+	forensicKindMarker = 'M'
+)
+
+// record directions
+const (
+	forensicToDevice = '>'
+	forensicToClient = '<'
+)
+
+// forensicBuffer keeps the last packets of a session in a circular file,
+// overwriting the oldest ones. The file is removed when the session ends
+// normally and kept, finalized with a marker, otherwise. A server killed
+// mid-session leaves the file in recording state. A nil forensicBuffer
+// records nothing.
+type forensicBuffer struct {
+	lock     sync.Mutex
+	file     *os.File
+	path     string
+	size     int64
+	head     int64
+	tail     int64
+	used     int64
+	abnormal string
+	err      error
+}
+
+// forensicOpen creates the buffer file of a session in dir with a ring of
+// size bytes, named like the audit file.
+func forensicOpen(dir string, size int64, client string, device string) (*forensicBuffer, error) {
+
+	if size < 4*forensicRecordHeaderSize {
+		return nil, fmt.Errorf("bad forensic buffer size %v", size)
+	}
+	name := fmt.Sprintf("%v_%v_%v.ring", time.Now().Format("20060102-150405.000"), client, device)
+	name = strings.Map(func(r rune) rune {
+		if r == ':' || r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("create forensic buffer failed: %v", err)
+	}
+	f := &forensicBuffer{file: file, path: path, size: size}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.writeHeader(forensicStateRecording)
+	f.record(forensicKindMarker, 0, []byte(fmt.Sprintf("session start, client: %v, device: %v", client, device)))
+	if f.err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("write forensic buffer failed: %v", f.err)
+	}
+	return f, nil
+}
+
+func (f *forensicBuffer) writeHeader(state uint32) {
+
+	var b []byte = make([]byte, forensicHeaderSize)
+	copy(b[0:8], forensicMagic)
+	binary.LittleEndian.PutUint32(b[8:12], 1)
+	binary.LittleEndian.PutUint32(b[12:16], state)
+	binary.LittleEndian.PutUint64(b[16:24], uint64(f.size))
+	binary.LittleEndian.PutUint64(b[24:32], uint64(f.head))
+	binary.LittleEndian.PutUint64(b[32:40], uint64(f.tail))
+	binary.LittleEndian.PutUint64(b[40:48], uint64(f.used))
+	if _, err := f.file.WriteAt(b, 0); err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+// ringAt reads or writes b at ring offset off, wrapping over the end.
+func (f *forensicBuffer) ringAt(b []byte, off int64, write bool) {
+
+	for len(b) > 0 && f.err == nil {
+		n := int64(len(b))
+		if n > f.size-off {
+			n = f.size - off
+		}
+		var err error
+		if write {
+			_, err = f.file.WriteAt(b[:n], forensicHeaderSize+off)
+		} else {
+			_, err = f.file.ReadAt(b[:n], forensicHeaderSize+off)
+		}
+		if err != nil {
+			f.err = err
+		}
+		b = b[n:]
+		off = 0
+	}
+}
+
+// record appends a record dropping the oldest ones to make room, data is cut
+// to a quarter of the ring so a single big transfer can't wipe out the rest.
+func (f *forensicBuffer) record(kind byte, direction byte, data []byte) {
+
+	if f.err != nil {
+		return
+	}
+	captured := data
+	if max := f.size/4 - forensicRecordHeaderSize; int64(len(captured)) > max {
+		captured = captured[:max]
+	}
+	var rec []byte = make([]byte, forensicRecordHeaderSize+len(captured))
+	rec[0] = kind
+	rec[1] = direction
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(len(captured)))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint64(rec[12:20], uint64(time.Now().UnixNano()))
+	copy(rec[forensicRecordHeaderSize:], captured)
+
+	n := int64(len(rec))
+	var header []byte = make([]byte, forensicRecordHeaderSize)
+	for f.used+n > f.size && f.err == nil {
+		f.ringAt(header, f.tail, false)
+		oldest := forensicRecordHeaderSize + int64(binary.LittleEndian.Uint32(header[4:8]))
+		f.tail = (f.tail + oldest) % f.size
+		f.used -= oldest
+	}
+	f.ringAt(rec, f.head, true)
+	f.head = (f.head + n) % f.size
+	f.used += n
+	f.writeHeader(forensicStateRecording)
+	if f.err != nil {
+		log.Printf("forensic: %v, recording stopped", f.err)
+	}
+}
+
+// packet records data sent in direction.
+func (f *forensicBuffer) packet(direction byte, data []byte) {
+
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.record(forensicKindPacket, direction, data)
+}
+
+// fail marks the session as ended abnormally, the first reason is kept.
+func (f *forensicBuffer) fail(reason string) {
+
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.abnormal == "" {
+		f.abnormal = reason
+	}
+}
+
+// Close removes the buffer of a normally ended session. Otherwise, or if
+// reason is not empty, the buffer is finalized with an end marker and kept.
+func (f *forensicBuffer) Close(reason string) {
+
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.abnormal != "" {
+		reason = f.abnormal
+	}
+	if reason == "" {
+		f.file.Close()
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("forensic: %v", err)
+		}
+		return
+	}
+	f.record(forensicKindMarker, 0, []byte("abnormal end: "+reason))
+	f.writeHeader(forensicStateAbnormal)
+	if f.err == nil {
+		f.err = f.file.Sync()
+	}
+	if err := f.file.Close(); err != nil && f.err == nil {
+		f.err = err
+	}
+	if f.err != nil {
+		log.Printf("forensic: %v", f.err)
+	}
+	log.Printf("forensic: session ended abnormally (%v), last packets kept in %v", reason, f.path)
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func isTerminal(file *os.File) bool {
+
+	stat, err := file.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// usbDeviceChoose asks the operator to pick a device when several match sel,
+// or even a single one if always is set, the result selects the chosen device
+// by its bus/address.
+func usbDeviceChoose(sel usbSelector, always bool) (usbSelector, error) {
+
+	devices := usbDeviceList(sel)
+	if len(devices) == 0 || (len(devices) == 1 && !always) {
+		return sel, nil
+	}
+	for i, dev := range devices {
+		fmt.Printf("%v: %v\n", i+1, usbDeviceDescription(dev))
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("choose device [1-%v]: ", len(devices))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return sel, fmt.Errorf("no device chosen: %v", err)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(line))
+		if err != nil || index < 1 || index > len(devices) {
+			continue
+		}
+		dev := devices[index-1]
+		sel.bus = dev.bus
+		sel.address = dev.address
+		return sel, nil
+	}
+}
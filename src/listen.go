@@ -0,0 +1,98 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener merges connections of several listeners, so one accept loop
+// (and one connection limit) serves all of them.
+type multiListener struct {
+	listeners []net.Listener
+	accepted  chan acceptResult
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMultiListener(listeners []net.Listener) *multiListener {
+
+	ml := &multiListener{
+		listeners: listeners,
+		accepted:  make(chan acceptResult),
+		closed:    make(chan struct{}),
+	}
+	for _, ln := range listeners {
+		go ml.serve(ln)
+	}
+	return ml
+}
+
+func (ml *multiListener) serve(ln net.Listener) {
+
+	for {
+		conn, err := ln.Accept()
+		select {
+		case ml.accepted <- acceptResult{conn, err}:
+		case <-ml.closed:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (ml *multiListener) Accept() (net.Conn, error) {
+
+	select {
+	case result := <-ml.accepted:
+		return result.conn, result.err
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// acceptTimeout is Accept giving up after timeout.
+func (ml *multiListener) acceptTimeout(timeout time.Duration) (net.Conn, error) {
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case result := <-ml.accepted:
+		return result.conn, result.err
+	case <-ml.closed:
+		return nil, net.ErrClosed
+	case <-timer.C:
+		return nil, errAcceptTimeout
+	}
+}
+
+func (ml *multiListener) Close() error {
+
+	ml.closeOnce.Do(func() {
+		close(ml.closed)
+		for _, ln := range ml.listeners {
+			ln.Close()
+		}
+	})
+	return nil
+}
+
+// Addr returns the address of the first listener.
+func (ml *multiListener) Addr() net.Addr {
+
+	return ml.listeners[0].Addr()
+}
@@ -0,0 +1,77 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// --log-time-format values besides a Go time layout
+const (
+	logTimeDefault       = "default"
+	logTimeRFC3339       = "rfc3339"
+	logTimeMonotonic     = "monotonic"
+	logTimeRFC3339Offset = "rfc3339+monotonic"
+)
+
+// RFC3339 with nanoseconds, unlike time.RFC3339Nano the width is fixed
+const logTimeLayoutRFC3339 = "2006-01-02T15:04:05.000000000Z07:00"
+
+// logTimeWriter prefixes every line written by the loggers with its time,
+// written with the log flags cleared. Monotonic offsets count from the start
+// of the server, unaffected by clock adjustments, to line up with device
+// logs whose clock is not the host's.
+type logTimeWriter struct {
+	out    io.Writer
+	layout string
+	utc    bool
+	offset bool
+	start  time.Time
+}
+
+// newLogTimeWriter returns out prefixed with the time in format, nil for the
+// default format of the log package.
+func newLogTimeWriter(out io.Writer, format string) *logTimeWriter {
+
+	w := &logTimeWriter{out: out, start: time.Now()}
+	switch format {
+	case logTimeDefault, "":
+		return nil
+	case logTimeRFC3339:
+		w.layout, w.utc = logTimeLayoutRFC3339, true
+	case logTimeMonotonic:
+		w.offset = true
+	case logTimeRFC3339Offset:
+		w.layout, w.utc, w.offset = logTimeLayoutRFC3339, true, true
+	default:
+		// local time, as the default format
+		w.layout = format
+	}
+	return w
+}
+
+func (w *logTimeWriter) Write(line []byte) (int, error) {
+
+	now := time.Now()
+	var prefix strings.Builder
+	if w.layout != "" {
+		if w.utc {
+			prefix.WriteString(now.UTC().Format(w.layout))
+		} else {
+			prefix.WriteString(now.Format(w.layout))
+		}
+		prefix.WriteByte(' ')
+	}
+	if w.offset {
+		fmt.Fprintf(&prefix, "[%12.6f] ", now.Sub(w.start).Seconds())
+	}
+	// a single write keeps lines of concurrent loggers whole
+	if _, err := w.out.Write(append([]byte(prefix.String()), line...)); err != nil {
+		return 0, err
+	}
+	return len(line), nil
+}
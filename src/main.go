@@ -4,13 +4,17 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	libusb "github.com/gotmc/libusb/v2"
@@ -20,52 +24,450 @@ import (
 
 const usbTimeout = 5000
 
+// high speed bulk packet size, used if a descriptor reports none
+const usbFallbackPacketSize = 512
+
+// how often cancellable transfers check their context, ms
+const usbPollTimeout = 500
+
+// read buffer of a command response: fastboot messages take at most
+// usbResponseMax bytes but a read must hold a whole packet, whatever the
+// device puts in it
+const usbResponseSize = 4096
+
+const usbResponseMax = 256
+
+// libusb error codes, not exported by the wrapper
+const usbErrorIO = libusb.ErrorCode(-1)
+const usbErrorAccess = libusb.ErrorCode(-3)
+const usbErrorNoDevice = libusb.ErrorCode(-4)
+const usbErrorNotFound = libusb.ErrorCode(-5)
+const usbErrorBusy = libusb.ErrorCode(-6)
+const usbErrorTimeout = libusb.ErrorCode(-7)
+const usbErrorOverflow = libusb.ErrorCode(-8)
+const usbErrorPipe = libusb.ErrorCode(-9)
+const usbErrorNoMem = libusb.ErrorCode(-11)
+const usbErrorNotSupported = libusb.ErrorCode(-12)
+
+var errUsbTimeout = errors.New("timeout")
+
+// the device sent more than the read buffer held, the transfer is lost but the
+// next reads use a buffer large enough for any packet
+var errUsbOverflow = errors.New("device sent more than the read buffer holds, transfer lost")
+
+// libusb speeds, not exported by the wrapper
+const usbSpeedLow = libusb.SpeedType(1)
+const usbSpeedFull = libusb.SpeedType(2)
+const usbSpeedHigh = libusb.SpeedType(3)
+const usbSpeedSuper = libusb.SpeedType(4)
+const usbSpeedSuperPlus = libusb.SpeedType(5)
+
+var usbSpeedNames = map[libusb.SpeedType]string{
+	usbSpeedLow:       "low",
+	usbSpeedFull:      "full",
+	usbSpeedHigh:      "high",
+	usbSpeedSuper:     "super",
+	usbSpeedSuperPlus: "super+",
+}
+
+// fastboot sizes are 32-bit, with room for the compressed framing flag byte
+const netMaxFrame = 1 << 32
+
+// frames up to this size, i.e. commands and responses, are read and written
+// thru pooled buffers
+const netPoolSize = 64 * 1024
+
+type netFrameBuffer [netPoolSize]byte
+
+var netBufferPool = sync.Pool{New: func() any { return new(netFrameBuffer) }}
+
+// how many times a write clears a stalled OUT endpoint before giving up
+const usbStallRetries = 3
+
+const usbAccessHint = "no permission to access usb devices: " +
+	"add a udev rule for the device (e.g. SUBSYSTEM==\"usb\", ATTR{idVendor}==\"18d1\", MODE=\"0666\") " +
+	"or run the server as a user allowed to access /dev/bus/usb"
+
+// usbContextHint explains the likely cause of a libusb initialization failure.
+// The wrapper reports it as "...; received error <code>".
+func usbContextHint(err error) string {
+
+	var code int
+	fields := strings.Fields(err.Error())
+	if len(fields) == 0 {
+		return ""
+	}
+	if _, scanErr := fmt.Sscanf(fields[len(fields)-1], "%d", &code); scanErr != nil {
+		return ""
+	}
+	switch libusb.ErrorCode(code) {
+	case usbErrorAccess:
+		return usbAccessHint
+	case usbErrorIO, usbErrorNotSupported:
+		return "usb devices are not available: check that usbfs is mounted (/dev/bus/usb), " +
+			"in a container pass the usb bus through, e.g. docker run --device /dev/bus/usb"
+	case usbErrorNoMem:
+		return "out of memory"
+	}
+	return "check that libusb-1.0 is installed and usb devices are accessible"
+}
+
+// usbCtx is shared by every goroutine. libusb allows the context, device
+// lists and descriptor queries to be used from several threads at once, but a
+// device handle must not be used concurrently, and enumerating then opening
+// devices from several goroutines can race for the same device. Hence:
+//   - discovery (DeviceList, descriptor reads, Open) runs under usbDiscoveryLock;
+//   - a usbDevice belongs to the session that opened it. Transfers on distinct
+//     endpoints may run concurrently, so the session has one goroutine per
+//     direction: reads run under usbDevice.readLock, writes under writeLock.
+//     Claim/release, reset and close take both.
 var usbCtx *libusb.Context
+var usbDiscoveryLock sync.Mutex
+
+// log verbosity, each -v increases it
+var verbose atomic.Int32
+
+// don't log every usb write, it costs throughput on large downloads
+var quietTransfers atomic.Bool
+
+func debugf(logger *log.Logger, format string, v ...any) {
+
+	if verbose.Load() > 0 {
+		logger.Printf(format, v...)
+	}
+}
 
 type usbDevice struct {
 	endpointIn  *libusb.EndpointDescriptor
 	endpointOut *libusb.EndpointDescriptor
 	device      *libusb.Device
-	handle      *libusb.DeviceHandle
+	handle      usbHandle
+	iface       int // number of the fastboot interface, claimed on open
+	// configuration value set on open and the one restored on close, 0 to
+	// keep the active configuration
+	config        int
+	restoreConfig int
+	readLock      sync.Mutex
+	writeLock     sync.Mutex
+	bus           int
+	address       int
+	serial        string
+	// physical port path like "1-2.3.1", stable across replugs
+	portPath string
+	// prefixes log lines of the session using the device
+	logger *log.Logger
+	// a read overflowed, guarded by readLock
+	overflowed bool
+}
+
+// usbHandle is what an opened device provides, implemented by libusbHandle
+// and by mocks in tests.
+type usbHandle interface {
+	BulkTransfer(endpoint *libusb.EndpointDescriptor, data []byte, length int, timeout int) (int, error)
+	ControlTransfer(requestType byte, request byte, value uint16, index uint16, data []byte, length int, timeout int) (int, error)
+	SetConfiguration(configuration int) error
+	ClaimInterface(iface int) error
+	ReleaseInterface(iface int) error
+	SetInterfaceAltSetting(iface int, altSetting int) error
+	StringDescriptorASCII(index uint8) (string, error)
+	ResetDevice() error
+	Close() error
+}
+
+// libusbHandle is a usbHandle on top of libusb. Bulk transfers take the
+// endpoint descriptor, the address type of the wrapper isn't exported.
+type libusbHandle struct {
+	*libusb.DeviceHandle
 }
 
-func showDeviceInfo(dev usbDevice) {
+func (h libusbHandle) BulkTransfer(endpoint *libusb.EndpointDescriptor, data []byte, length int, timeout int) (int, error) {
+
+	return h.DeviceHandle.BulkTransfer(endpoint.EndpointAddress, data, length, timeout)
+}
+
+// usbTransport is the device side of a relay session, implemented by
+// usbDevice on top of libusb.
+type usbTransport interface {
+	// Write sends data to the device.
+	Write(ctx context.Context, data []byte) error
+	// Read waits for device data up to usbTimeout or until ctx is done.
+	Read(ctx context.Context, data []byte) (int, error)
+	// ReadTimeout does a single read bounded by timeout (ms).
+	ReadTimeout(data []byte, timeout int) (int, error)
+	// Close releases the device.
+	Close()
+}
+
+func (dev *usbDevice) Write(ctx context.Context, data []byte) error {
+
+	return usbWrite(ctx, dev, data)
+}
+
+func (dev *usbDevice) Read(ctx context.Context, data []byte) (int, error) {
+
+	return usbRead(ctx, dev, data)
+}
+
+func (dev *usbDevice) ReadTimeout(data []byte, timeout int) (int, error) {
+
+	return usbReadTimeout(dev, data, timeout)
+}
+
+func (dev *usbDevice) Close() {
+
+	usbDeviceClose(dev)
+}
+
+// usbSelector narrows discovery down to a single device,
+// zero values match any device.
+type usbSelector struct {
+	serial  string
+	bus     int
+	address int
+	// port path given with --port-path
+	portPath string
+	// among several matching devices prefer the one at the location used last
+	sticky bool
+	// allowed serials given as serialHash values, any if empty
+	serialHashes  []string
+	serialHashKey []byte
+}
+
+// needsSerial tells whether devices must be opened to read their serials
+// before they can be matched.
+func (sel usbSelector) needsSerial() bool {
+
+	return sel.serial != "" || len(sel.serialHashes) > 0
+}
+
+// explicit tells whether sel names the device instead of taking whichever
+// single one matches the device rules.
+func (sel usbSelector) explicit() bool {
+
+	return sel.needsSerial() || sel.bus != 0 || sel.portPath != ""
+}
+
+// alternate setting of the fastboot interface to use
+var usbAltSetting int
+
+// configuration value set before claiming the interface, 0 to use the active
+// one, for bootloaders enumerating unconfigured
+var usbSetConfig int
+
+// look for the fastboot interface in every configuration, not just the
+// active one, and switch to the configuration offering it
+var usbAnyConfig bool
+
+// location of the last opened device, guarded by usbDiscoveryLock
+var usbLastBus, usbLastAddress int
+
+// number of devices currently open, guarded by usbDiscoveryLock
+var usbOpenDevices int
+
+func (sel usbSelector) match(dev *usbDevice) bool {
+
+	return sel.mismatch(dev) == ""
+}
+
+// usbDeviceInfo is a device description published by the server.
+type usbDeviceInfo struct {
+	Bus      int    `json:"bus"`
+	Address  int    `json:"address"`
+	PortPath string `json:"port_path,omitempty"`
+	Vendor   string `json:"vendor"`
+	Product  string `json:"product"`
+	Serial   string `json:"serial"`
+	Speed    string `json:"speed"`
+}
+
+func usbDeviceSpeed(device *libusb.Device) string {
+
+	speed, err := device.Speed()
+	if name, ok := usbSpeedNames[speed]; ok && err == nil {
+		return name
+	}
+	return "unknown"
+}
+
+func usbDeviceInfoOf(dev *usbDevice) usbDeviceInfo {
 
-	deviceAddress, _ := dev.device.DeviceAddress()
-	busNumber, _ := dev.device.BusNumber()
 	usbDeviceDescriptor, _ := dev.device.DeviceDescriptor()
+	return usbDeviceInfo{
+		Bus:      dev.bus,
+		Address:  dev.address,
+		PortPath: dev.portPath,
+		Vendor:   fmt.Sprintf("%04x", usbDeviceDescriptor.VendorID),
+		Product:  fmt.Sprintf("%04x", usbDeviceDescriptor.ProductID),
+		Serial:   dev.serial,
+		Speed:    usbDeviceSpeed(dev.device),
+	}
+}
+
+func usbDeviceDescription(dev *usbDevice) string {
+
+	info := usbDeviceInfoOf(dev)
+	port := info.PortPath
+	if port == "" {
+		port = "unknown"
+	}
+	return fmt.Sprintf("%v:%v, port: %v, vendor: %v, product: %v, serial: %v, speed: %v",
+		info.Bus,
+		info.Address,
+		port,
+		info.Vendor,
+		info.Product,
+		info.Serial,
+		info.Speed)
+}
+
+// usbDeviceName is a short device identification for logs, its --device-name
+// if it has one.
+func usbDeviceName(dev *usbDevice) string {
+
+	if dev.serial != "" {
+		if name := deviceNameOf(dev.serial); name != "" {
+			return name
+		}
+		return dev.serial
+	}
+	return fmt.Sprintf("%v:%v", dev.bus, dev.address)
+}
+
+func showDeviceInfo(dev *usbDevice) {
+
+	log.Printf("found device %v\n", usbDeviceDescription(dev))
+}
+
+func usbReadSerial(device *libusb.Device, desc *libusb.Descriptor) (string, error) {
 
-	log.Printf("found device %v:%v, vendor: %04x, product: %04x\n",
-		busNumber,
-		deviceAddress,
-		usbDeviceDescriptor.VendorID,
-		usbDeviceDescriptor.ProductID)
+	key := usbSerialKeyOf(device, desc)
+	if serial, ok := usbSerialCacheGet(key); ok {
+		return serial, nil
+	}
+	handle, err := device.Open()
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	serial, err := handle.StringDescriptorASCII(desc.SerialNumberIndex)
+	if err == nil {
+		usbSerialCachePut(key, serial)
+	}
+	return serial, err
 }
 
-func usbDeviceOpen(serial string) (usbDevice, error) {
+// usbFastbootConfig returns the first configuration of the device offering
+// a single fastboot interface, nil if there is none.
+func usbFastbootConfig(device *libusb.Device, desc *libusb.Descriptor) *libusb.ConfigDescriptor {
 
-	var dev usbDevice
+	for i := 0; i < int(desc.NumConfigurations); i++ {
+		config, err := device.ConfigDescriptor(i)
+		if err != nil || config.NumInterfaces != 1 || len(config.SupportedInterfaces[0].InterfaceDescriptors) == 0 {
+			continue
+		}
+		if usbMatchDevice(desc, config.SupportedInterfaces[0].InterfaceDescriptors[0]) {
+			return config
+		}
+	}
+	return nil
+}
+
+// usbConfigHasFastboot tells whether config passes the interface checks of
+// usbDeviceFind.
+func usbConfigHasFastboot(desc *libusb.Descriptor, config *libusb.ConfigDescriptor) bool {
+
+	return config.NumInterfaces == 1 && len(config.SupportedInterfaces[0].InterfaceDescriptors) > 0 &&
+		usbMatchDevice(desc, config.SupportedInterfaces[0].InterfaceDescriptors[0])
+}
+
+// usbUnconfiguredFastboot returns the value of the first configuration of an
+// unconfigured device if it offers a fastboot interface, 0 otherwise.
+func usbUnconfiguredFastboot(device *libusb.Device, desc *libusb.Descriptor) int {
+
+	config, err := device.ConfigDescriptor(0)
+	if err != nil {
+		return 0
+	}
+	for _, supported := range config.SupportedInterfaces {
+		if len(supported.InterfaceDescriptors) > 0 && usbMatchDevice(desc, supported.InterfaceDescriptors[0]) {
+			return int(config.ConfigurationValue)
+		}
+	}
+	return 0
+}
+
+// usbDeviceFind returns fastboot devices matching the selector, not opened yet.
+// Reading serial numbers requires briefly opening every candidate, so it's
+// done only if the selector needs them or readSerial is set.
+// Skipped devices are recorded in usbSkipped with the reason.
+// Must be called with usbDiscoveryLock held.
+func usbDeviceFind(sel usbSelector, readSerial bool) []*usbDevice {
+
+	var found []*usbDevice
+	usbSkipped = nil
+	if usbExplain {
+		defer usbLogSkipped(true)
+	}
 	devices, _ := usbCtx.DeviceList()
-	deviceCount := 0
 	for _, device := range devices {
-		usbDeviceDescriptor, _ := device.DeviceDescriptor()
+		usbDeviceDescriptor, err := device.DeviceDescriptor()
+		if err != nil {
+			usbSkipDevice(device, nil, false, "no device descriptor: %v", err)
+			continue
+		}
 
-		configDescriptor, err := device.ActiveConfigDescriptor()
+		var configDescriptor *libusb.ConfigDescriptor
+		setConfig, restoreConfig := usbSetConfig, 0
+		if usbSetConfig != 0 {
+			configDescriptor, err = device.ConfigDescriptorByValue(usbSetConfig)
+		} else {
+			configDescriptor, err = device.ActiveConfigDescriptor()
+		}
+		if usbAnyConfig && usbSetConfig == 0 && (err == usbErrorNotFound || (err == nil && !usbConfigHasFastboot(usbDeviceDescriptor, configDescriptor))) {
+			if config := usbFastbootConfig(device, usbDeviceDescriptor); config != nil {
+				if err == nil {
+					restoreConfig = int(configDescriptor.ConfigurationValue)
+				}
+				setConfig = int(config.ConfigurationValue)
+				configDescriptor, err = config, nil
+			}
+		}
+		if err == usbErrorNotFound && usbSetConfig == 0 {
+			if value := usbUnconfiguredFastboot(device, usbDeviceDescriptor); value != 0 {
+				usbSkipDevice(device, usbDeviceDescriptor, true, "not configured, try --set-config %v", value)
+			} else {
+				usbSkipDevice(device, usbDeviceDescriptor, false, "not configured")
+			}
+			continue
+		}
 		if err != nil {
-			//log.Printf("Failed getting the active config: %v", err)
+			usbSkipDevice(device, usbDeviceDescriptor, false, "no config %v: %v", usbSetConfig, err)
 			continue
 		}
+		// fastbootd (userspace fastboot in recovery) exposes the same single
+		// fastboot interface as the bootloader, see usbDeviceMode
 		if configDescriptor.NumInterfaces > 1 {
-			//log.Printf("Too much interfaces: %v", configDescriptor.NumInterfaces)
+			near := false
+			for _, supported := range configDescriptor.SupportedInterfaces {
+				near = near || usbMatchDevice(usbDeviceDescriptor, supported.InterfaceDescriptors[0])
+			}
+			usbSkipDevice(device, usbDeviceDescriptor, near, "%v interfaces, a single one expected",
+				configDescriptor.NumInterfaces)
 			continue
 		}
 
-		ifaceDescriptor := configDescriptor.SupportedInterfaces[0].InterfaceDescriptors[0]
-		if ifaceDescriptor.InterfaceClass != 0xff ||
-			ifaceDescriptor.InterfaceSubClass != 0x42 ||
-			ifaceDescriptor.InterfaceProtocol != 0x03 {
+		altSettings := configDescriptor.SupportedInterfaces[0].InterfaceDescriptors
+		ifaceDescriptor := altSettings[0]
+		if !usbMatchDevice(usbDeviceDescriptor, ifaceDescriptor) {
+			usbSkipDevice(device, usbDeviceDescriptor, false, "interface %02x:%02x:%02x doesn't match the device rules",
+				ifaceDescriptor.InterfaceClass, ifaceDescriptor.InterfaceSubClass, ifaceDescriptor.InterfaceProtocol)
 			continue
 		}
+		if usbAltSetting >= len(altSettings) {
+			usbSkipDevice(device, usbDeviceDescriptor, true, "no alternate setting %v", usbAltSetting)
+			continue
+		}
+		ifaceDescriptor = altSettings[usbAltSetting]
 
 		in := -1
 		out := -1
@@ -82,215 +484,1384 @@ func usbDeviceOpen(serial string) (usbDevice, error) {
 		}
 
 		if in < 0 || out < 0 {
+			usbSkipDevice(device, usbDeviceDescriptor, true, "no bulk in and out endpoints")
 			continue
 		}
 
-		if serial != "" {
-			handle, err := device.Open()
-			if err != nil {
-				//log.Printf("Error opening device: %v", err)
-				continue
-			}
-			defer handle.Close()
-			serialNumber, _ := handle.StringDescriptorASCII(usbDeviceDescriptor.SerialNumberIndex)
-			if serialNumber != serial {
+		dev := &usbDevice{
+			endpointIn:    ifaceDescriptor.EndpointDescriptors[in],
+			endpointOut:   ifaceDescriptor.EndpointDescriptors[out],
+			device:        device,
+			iface:         ifaceDescriptor.InterfaceNumber,
+			config:        setConfig,
+			restoreConfig: restoreConfig,
+		}
+		dev.bus, _ = device.BusNumber()
+		dev.address, _ = device.DeviceAddress()
+		dev.portPath = usbPortPath(dev.bus, dev.address)
+		if sel.needsSerial() || readSerial {
+			dev.serial, err = usbReadSerial(device, usbDeviceDescriptor)
+			if err != nil && sel.needsSerial() {
+				usbSkipDevice(device, usbDeviceDescriptor, true, "read serial failed: %v", err)
 				continue
 			}
 		}
-		dev.endpointIn = ifaceDescriptor.EndpointDescriptors[in]
-		dev.endpointOut = ifaceDescriptor.EndpointDescriptors[out]
-		dev.device = device
+		if reason := sel.mismatch(dev); reason != "" {
+			usbSkipDevice(device, usbDeviceDescriptor, true, "%v", reason)
+			continue
+		}
+		found = append(found, dev)
+	}
+	return found
+}
+
+// usbDeviceList returns every matching device, not opened.
+func usbDeviceList(sel usbSelector) []*usbDevice {
+
+	usbDiscoveryLock.Lock()
+	defer usbDiscoveryLock.Unlock()
+	return usbDeviceFind(sel, true)
+}
+
+func usbDeviceOpen(sel usbSelector) (*usbDevice, error) {
+
+	usbDiscoveryLock.Lock()
+	defer usbDiscoveryLock.Unlock()
+
+	devices := usbDeviceFind(sel, false)
+	for _, dev := range devices {
 		showDeviceInfo(dev)
-		deviceCount++
 	}
-	if deviceCount == 0 {
-		return dev, fmt.Errorf("no apropriate usb device found")
+	if sel.sticky && len(devices) > 1 {
+		for _, dev := range devices {
+			if dev.bus == usbLastBus && dev.address == usbLastAddress {
+				log.Printf("using device at last used location %v:%v", dev.bus, dev.address)
+				devices = []*usbDevice{dev}
+				break
+			}
+		}
+	}
+	if len(devices) == 0 {
+		if !usbExplain {
+			usbLogSkipped(false)
+		}
+		return nil, errUsbAbsent
 	}
-	if deviceCount > 1 {
-		return dev, fmt.Errorf("found multiple devices")
+	if len(devices) > 1 {
+		return nil, errUsbMultiple
 	}
+	dev := devices[0]
 
-	var err error
-	dev.handle, err = dev.device.Open()
-	if err != nil {
-		return dev, fmt.Errorf("open device failed: %v", err)
+	if err := usbCheckEndpoints(dev); err != nil {
+		return nil, err
 	}
 
-	err = dev.handle.ClaimInterface(0)
+	handle, err := dev.device.Open()
+	if err == usbErrorAccess {
+		return nil, fmt.Errorf("open device failed: %v, %v", err, usbAccessHint)
+	}
 	if err != nil {
-		dev.handle.Close()
-		return dev, fmt.Errorf("claime interface failed: %v", err)
+		return nil, fmt.Errorf("open device failed: %v", err)
+	}
+	dev.handle = libusbHandle{handle}
+	if dev.serial == "" {
+		usbDeviceDescriptor, _ := dev.device.DeviceDescriptor()
+		dev.serial, _ = dev.handle.StringDescriptorASCII(usbDeviceDescriptor.SerialNumberIndex)
 	}
+	dev.logger = log.New(log.Writer(), "["+usbDeviceName(dev)+"] ", log.Flags()|log.Lmsgprefix)
+	if err = usbDeviceClaim(dev); err != nil {
+		return nil, err
+	}
+	usbCheckSpeed(dev)
+	usbCheckInterval(dev)
+	usbLastBus, usbLastAddress = dev.bus, dev.address
+	usbOpenDevices++
 	return dev, nil
 }
 
-func usbDeviceClose(dev usbDevice) {
+// usbDeviceClaim selects the fastboot configuration of the opened dev, claims
+// its interface dev.iface and sends the --control-setup requests. On failure
+// the device is switched back to the configuration it was found in and the
+// handle is closed.
+func usbDeviceClaim(dev *usbDevice) error {
+
+	if dev.config != 0 {
+		if dev.restoreConfig != 0 {
+			log.Printf("fastboot on configuration %v, switching from %v", dev.config, dev.restoreConfig)
+		}
+		if err := dev.handle.SetConfiguration(dev.config); err != nil {
+			dev.handle.Close()
+			return fmt.Errorf("set configuration %v failed: %v", dev.config, err)
+		}
+	}
+
+	if err := dev.handle.ClaimInterface(dev.iface); err != nil {
+		usbDeviceUnclaim(dev, false)
+		return fmt.Errorf("claime interface failed: %w", err)
+	}
+
+	if usbAltSetting != 0 {
+		if err := dev.handle.SetInterfaceAltSetting(dev.iface, usbAltSetting); err != nil {
+			usbDeviceUnclaim(dev, true)
+			return fmt.Errorf("set alternate setting %v failed: %v", usbAltSetting, err)
+		}
+	}
+	if err := usbControlSend(dev); err != nil {
+		usbDeviceUnclaim(dev, true)
+		return err
+	}
+	return nil
+}
+
+// usbDeviceUnclaim undoes usbDeviceClaim: releases the interface if claimed,
+// switches back to the configuration the device was found in and closes the
+// handle.
+func usbDeviceUnclaim(dev *usbDevice, claimed bool) {
 
-	dev.handle.ReleaseInterface(0)
+	if claimed {
+		dev.handle.ReleaseInterface(dev.iface)
+	}
+	if dev.restoreConfig != 0 {
+		// fails if the device left meanwhile, e.g. rebooted
+		if err := dev.handle.SetConfiguration(dev.restoreConfig); err != nil {
+			debugf(log.Default(), "restore configuration %v failed: %v", dev.restoreConfig, err)
+		}
+	}
 	dev.handle.Close()
 }
 
+// usbCheckEndpoints rejects endpoints a buggy descriptor made unusable.
+func usbCheckEndpoints(dev *usbDevice) error {
+
+	for _, endpoint := range []*libusb.EndpointDescriptor{dev.endpointIn, dev.endpointOut} {
+		if endpoint.MaxPacketSize == 0 {
+			return fmt.Errorf("bad device descriptor: endpoint %02x reports zero max packet size",
+				endpoint.EndpointAddress)
+		}
+	}
+	return nil
+}
+
+// usbDeviceProbe checks that a device matching sel can be opened and claimed.
+// A device already opened is busy but healthy and is not touched, so a health
+// check never disturbs a running session.
+func usbDeviceProbe(sel usbSelector) (busy bool, err error) {
+
+	usbDiscoveryLock.Lock()
+	defer usbDiscoveryLock.Unlock()
+
+	if usbOpenDevices > 0 {
+		return true, nil
+	}
+	devices := usbDeviceFind(sel, false)
+	if len(devices) == 0 {
+		return false, errUsbAbsent
+	}
+	dev := devices[0]
+	handle, err := dev.device.Open()
+	if err != nil {
+		return false, fmt.Errorf("open device failed: %v", err)
+	}
+	defer handle.Close()
+	if dev.config != 0 {
+		if err = handle.SetConfiguration(dev.config); err != nil {
+			return false, fmt.Errorf("set configuration %v failed: %v", dev.config, err)
+		}
+		if dev.restoreConfig != 0 {
+			defer handle.SetConfiguration(dev.restoreConfig)
+		}
+	}
+	if err = handle.ClaimInterface(dev.iface); err != nil {
+		return false, fmt.Errorf("claime interface failed: %v", err)
+	}
+	handle.ReleaseInterface(dev.iface)
+	return false, nil
+}
+
+var errUsbBusy = errors.New("device is in a session")
+
+var errUsbAbsent = errors.New("no apropriate usb device found")
+var errUsbMultiple = errors.New("found multiple devices")
+
+// classes of usbDeviceOpen errors, retried by their own policies
+const (
+	usbOpenAbsent   = "absent"
+	usbOpenBusy     = "busy"
+	usbOpenMultiple = "multiple"
+	usbOpenOther    = "other"
+)
+
+// usbOpenClass classifies an error of usbDeviceOpen: no device, the device
+// claimed by another program (e.g. adb or a local fastboot), several devices
+// matching, which no retry fixes, or anything else.
+func usbOpenClass(err error) string {
+
+	switch {
+	case errors.Is(err, errUsbAbsent):
+		return usbOpenAbsent
+	case errors.Is(err, usbErrorBusy):
+		return usbOpenBusy
+	case errors.Is(err, errUsbMultiple):
+		return usbOpenMultiple
+	}
+	return usbOpenOther
+}
+
+// usbDeviceResetIdle resets the device matching sel unless a session is
+// running, the usb analogue of replugging it.
+func usbDeviceResetIdle(sel usbSelector) error {
+
+	usbDiscoveryLock.Lock()
+	defer usbDiscoveryLock.Unlock()
+
+	if usbOpenDevices > 0 {
+		return errUsbBusy
+	}
+	devices := usbDeviceFind(sel, false)
+	if len(devices) == 0 {
+		return errUsbAbsent
+	}
+	if len(devices) > 1 {
+		return errUsbMultiple
+	}
+	handle, err := devices[0].device.Open()
+	if err != nil {
+		return fmt.Errorf("open device failed: %v", err)
+	}
+	defer handle.Close()
+	if err = handle.ResetDevice(); err != nil {
+		return fmt.Errorf("reset failed: %v", err)
+	}
+	return nil
+}
+
+// usbCheckSpeed warns about a usb 3 device connected at high speed, usually
+// a usb 2 cable or hub in between, which makes flashing several times slower.
+func usbCheckSpeed(dev *usbDevice) {
+
+	usbDeviceDescriptor, err := dev.device.DeviceDescriptor()
+	if err != nil {
+		return
+	}
+	speed, err := dev.device.Speed()
+	if err == nil && speed == usbSpeedHigh && uint16(usbDeviceDescriptor.USBSpecification) >= 0x0300 {
+		dev.logger.Printf("warning: usb 3 device runs at high speed, check the cable and hubs")
+	}
+}
+
+// usbCheckInterval warns about bulk endpoints reporting a non-zero bInterval.
+// It's out of spec for full speed and only a NAK rate hint at high speed,
+// libusb doesn't apply it to bulk transfers, but some host controllers choke
+// on such devices, so transfer errors that follow are easier to explain.
+func usbCheckInterval(dev *usbDevice) {
+
+	for _, endpoint := range []*libusb.EndpointDescriptor{dev.endpointIn, dev.endpointOut} {
+		if endpoint.Interval != 0 {
+			dev.logger.Printf("warning: bulk endpoint %02x reports bInterval %v, transfers may fail on some host controllers",
+				endpoint.EndpointAddress, endpoint.Interval)
+		}
+	}
+}
+
+func usbDeviceReset(dev *usbDevice) {
+
+	dev.writeLock.Lock()
+	defer dev.writeLock.Unlock()
+	dev.readLock.Lock()
+	defer dev.readLock.Unlock()
+	if err := dev.handle.ResetDevice(); err != nil {
+		log.Printf("usb: reset failed: %v", err)
+	}
+}
+
+func usbDeviceClose(dev *usbDevice) {
+
+	dev.writeLock.Lock()
+	defer dev.writeLock.Unlock()
+	dev.readLock.Lock()
+	defer dev.readLock.Unlock()
+	usbDeviceUnclaim(dev, true)
+
+	usbDiscoveryLock.Lock()
+	usbOpenDevices--
+	usbDiscoveryLock.Unlock()
+}
+
 func main() {
 
 	// TODO: add vid pid options
-	argPort := getopt.StringLong("listen", 'l', ":5554", "<host>:port tcp host and port to listen to")
+	argListen := getopt.ListLong("listen", 'l', "<host>:port tcp host and port to listen to, repeatable, default :5554")
 	argSerial := getopt.StringLong("serial", 's', "", "device serial number")
+	argPortPath := getopt.StringLong("port-path", 0, "", "device physical port path, like 1-2.3.1, see --list (linux only)")
+	argSerialHash := getopt.ListLong("serial-hash", 0, "allowed device given as hex HMAC-SHA256 of its serial, repeatable")
+	argDeviceName := getopt.ListLong("device-name", 0, "serial=name friendly name shown instead of the device serial, repeatable")
+	argSerialHashKey := getopt.StringLong("serial-hash-key", 0, "", "HMAC key of --serial-hash")
 	argCheckDevice := getopt.BoolLong("check", 'c', "search fastboot device at start")
+	argCheckRetries := getopt.IntLong("check-retries", 0, 0, "with --check retry this many times until the device appears")
+	argCheckInterval := getopt.DurationLong("check-interval", 0, time.Second, "first delay between --check retries, doubled up to --retry-max-interval")
+	argRetryMaxInterval := getopt.DurationLong("retry-max-interval", 0, 30*time.Second, "longest delay between device discovery retries")
+	argMaxOpenRetries := getopt.IntLong("max-open-retries", 0, 0, "retry opening an absent device this many times before dropping the client")
+	argBusyOpenRetries := getopt.IntLong("busy-open-retries", 0, 0, "retry opening a device claimed by another program this many times before rejecting the client")
+	argBreakerFailures := getopt.IntLong("breaker-failures", 0, 0, "consecutive failed sessions making the device temporarily unavailable, 0 never")
+	argBreakerCooldown := getopt.DurationLong("breaker-cooldown", 0, time.Minute, "how long --breaker-failures keeps the device unavailable")
+	argSerialCache := getopt.BoolLong("serial-cache", 0, "remember device serials until a hotplug event instead of opening every candidate to match -s")
+	argStrict := getopt.BoolLong("strict", 0, "refuse to serve a device not selected explicitly by serial or bus/address")
+	argStickyPort := getopt.BoolLong("sticky-port", 0, "if several devices match, prefer the one at bus/address used last")
+	argExplain := getopt.BoolLong("explain", 0, "log every usb device skipped by each discovery with the reason")
+	argSetConfig := getopt.IntLong("set-config", 0, 0, "configuration value to set before claiming the interface, 0 to keep the active one")
+	argAnyConfig := getopt.BoolLong("any-config", 0, "look for the fastboot interface in every configuration, switching to it while in use")
+	argAltSetting := getopt.IntLong("alt-setting", 0, 0, "alternate setting of the fastboot interface to use")
+	argQuirk := getopt.StringLong("quirk", 0, "", "device family profile of --quirk-file setting the options known to work for it, there are no built-in ones: no values are verified for any family")
+	argQuirkFile := getopt.StringLong("quirk-file", 0, "", "file with the --quirk profiles")
+	argControlSetup := getopt.ListLong("control-setup", 0, "bmRequestType:bRequest:wValue:wIndex[:data] hex control transfer sent after claiming the interface, repeatable")
+	argList := getopt.BoolLong("list", 0, "list matching fastboot devices and exit")
+	argRebootAll := getopt.BoolLong("reboot-all", 0, "send reboot to every matching device and exit")
+	argDumpDescriptors := getopt.EnumLong("dump-descriptors", 0, []string{"matching", "all"}, "", "print usb descriptors of matching or all devices and exit")
+	argJSON := getopt.BoolLong("json", 0, "print --dump-descriptors output as json")
+	argInteractive := getopt.BoolLong("interactive", 'i', "choose device at start if several match, requires a terminal")
+	argDeviceList := getopt.StringLong("device-list", 0, "", "file with vid:pid [class:subclass:protocol] device match rules")
+	argDrainTimeout := getopt.DurationLong("drain-timeout", 0, 200*time.Millisecond, "time to keep forwarding device output after client disconnects")
+	argMinCommandInterval := getopt.DurationLong("min-command-interval", 0, 0, "minimum delay between commands forwarded to device")
+	argParse := getopt.BoolLong("parse", 'p', "parse fastboot commands, log them and apply command policies")
+	argResponseLogMax := getopt.IntLong("response-log-max", 0, 200, "characters of FAIL/INFO/TEXT messages to log with -p, 0 to disable")
+	argAllowPartition := getopt.ListLong("allow-partition", 0, "partition that may be flashed or erased, requires --parse")
+	argDenyPartition := getopt.ListLong("deny-partition", 0, "partition that must never be flashed or erased, requires --parse")
+	argCacheGetvar := getopt.BoolLong("cache-getvar", 0, "answer repeated getvar of constant variables (product, serialno, version...) from memory")
+	argStep := getopt.BoolLong("step", 0, "debugging: hold every command until acknowledged by admin POST /step or Enter, implies -p")
+	argReadonly := getopt.BoolLong("readonly", 0, "refuse every command that may change the device, implies --parse")
+	argCompress := getopt.BoolLong("compress", 'z', "allow clients to negotiate gzip compressed framing")
+	argCoalesce := getopt.IntLong("coalesce", 0, 0, "send upload data to the client in frames of this size, 0 to forward usb reads as they are")
+	argKeepalive := getopt.DurationLong("keepalive", 0, 0, "keep idle connections alive for NAT and firewalls, interval e.g. 60s, 0 to disable")
+	argMaxSessionBytes := getopt.Uint64Long("max-session-bytes", 0, 0, "end sessions sending more bytes to the device, 0 for no limit")
+	argMinDownloadRate := getopt.Uint64Long("min-download-rate", 0, 0, "abort a download slower than this many bytes/s over --stall-window, requires -p, 0 for no limit")
+	argStallWindow := getopt.DurationLong("stall-window", 0, 30*time.Second, "interval the --min-download-rate is measured over")
+	argMaxSessionDuration := getopt.DurationLong("max-session-duration", 0, 0, "terminate sessions lasting longer, 0 for no limit")
+	argKeepSession := getopt.BoolLong("keep-session", 0, "answer FAIL to a command failed by a usb error and keep the session, unless the device is gone")
+	argQueueTimeout := getopt.DurationLong("queue-timeout", 0, 0, "keep clients arriving during a session waiting for their turn this long, 0 to leave them in the tcp backlog")
+	argSplitConnections := getopt.BoolLong("split-connections", 0, "accept clients sending and receiving on separate connections; client mode: use them")
+	argEchoTest := getopt.BoolLong("echo-test", 0, "for diagnostics only: send the frames of clients asking for the echo test back, no device involved")
+	argAcceptMagic := getopt.ListLong("accept-magic", 0, "handshake magic to accept, answered with FB01, repeatable or comma separated, default FB01")
+	argHandshakeTimeout := getopt.DurationLong("handshake-timeout", 0, 10*time.Second, "close connections not sending the handshake in time, 0 to wait forever")
+	argHandshakeRateLimit := getopt.IntLong("handshake-rate-limit", 0, 0, "connections accepted from a source ip per --handshake-rate-interval, 0 for no limit")
+	argHandshakeRateInterval := getopt.DurationLong("handshake-rate-interval", 0, time.Minute, "interval of --handshake-rate-limit")
+	argPreSessionCommand := getopt.StringLong("pre-session-command", 0, "", "shell command to run before opening the device for every session, the session is refused if it fails")
+	argPreSessionTimeout := getopt.DurationLong("pre-session-timeout", 0, 30*time.Second, "time limit of --pre-session-command")
+	argAuditDir := getopt.StringLong("audit-dir", 0, "", "directory to write a command log of every session to")
+	argForensicBuffer := getopt.StringLong("forensic-buffer", 0, "", "directory to keep the last packets of abnormally ended sessions in")
+	argForensicBufferSize := getopt.Int64Long("forensic-buffer-size", 0, 4<<20, "size of the --forensic-buffer ring")
+	argCollectInfo := getopt.BoolLong("collect-info", 0, "run getvar:all at session start and publish the result with the unlock state on admin server /info")
+	argRegisterURL := getopt.StringLong("register-url", 0, "", "registry url to announce server address and devices to")
+	argRegisterInterval := getopt.DurationLong("register-interval", 0, 30*time.Second, "registry heartbeat interval")
+	argRegisterAddress := getopt.StringLong("register-address", 0, "", "host to announce to the registry for listeners on all addresses, default the one the registry is reached from")
+	argAdmin := getopt.StringLong("admin", 0, "", "<host>:port http admin server to listen to, disabled by default")
+	argDaemon := getopt.BoolLong("daemon", 'd', "detach from terminal and run in background")
+	argForeground := getopt.BoolLong("foreground", 0, "stay attached to terminal even if --daemon is given")
+	argPidfile := getopt.StringLong("pidfile", 0, "", "file to write server pid to")
+	argConfig := getopt.StringLong("config", 0, "", "file with settings which may be changed at runtime, reloaded on SIGHUP")
+	argSyslog := getopt.BoolLong("syslog", 0, "mirror the log to the local syslog daemon (unix only)")
+	argSyslogOnly := getopt.BoolLong("syslog-only", 0, "log to syslog instead of stderr")
+	argSyslogFacility := getopt.StringLong("syslog-facility", 0, "daemon", "syslog facility: daemon, user, local0..local7...")
+	argSyslogTag := getopt.StringLong("syslog-tag", 0, "remote-fastboot", "syslog tag")
+	argLogTimeFormat := getopt.StringLong("log-time-format", 0, logTimeDefault, "log timestamps: default, rfc3339, monotonic, rfc3339+monotonic or a Go time layout")
+	argQuietTransfers := getopt.BoolLong("quiet-transfers", 0, "don't log every usb write")
+	argVerbose := getopt.CounterLong("verbose", 'v', "increase log verbosity")
+	argConnect := getopt.StringLong("connect", 0, "", "<host>:port client mode: server to run the command below against")
+	argSSH := getopt.StringLong("ssh", 0, "", "[user@]host client mode: reach --connect through ssh -W on that host, with the keys and known_hosts of ssh")
+	argRebootResume := getopt.BoolLong("reboot-resume", 0, "let clients reboot the device into the bootloader and go on in the same session")
+	argRebootResumeTimeout := getopt.DurationLong("reboot-resume-timeout", 0, 90*time.Second, "how long --reboot-resume waits for the device to come back")
+	argProgressInfo := getopt.BoolLong("progress-info", 0, "send download progress as INFO to clients asking for it, requires --parse; client mode: ask for it and show it")
+	argVerifyDownload := getopt.BoolLong("verify-download", 0, "check downloads against the sha256 sent by clients, requires --parse; client mode: send it")
+	argFlash := getopt.StringLong("flash", 0, "", "client mode: flash file given as the argument to partition, e.g. --flash boot boot.img")
+	argDumpPartition := getopt.StringLong("dump-partition", 0, "", "client mode: save partition to the file given as the argument, e.g. --dump-partition boot boot.img")
+	argScript := getopt.StringLong("script", 0, "", "client mode: run the commands of the file, see README")
+	argEchoCheck := getopt.BoolLong("echo-check", 0, "client mode: check frames of a server started with --echo-test come back unchanged, compressed with -z")
+	argUnlockState := getopt.BoolLong("unlock-state", 0, "client mode: print whether the device is unlocked and may be unlocked")
+	argBenchmark := getopt.BoolLong("benchmark", 0, "client mode: measure command round trip and download throughput")
+	argBenchmarkCount := getopt.IntLong("benchmark-count", 0, 100, "client mode: commands timed by --benchmark")
+	argBenchmarkDownload := getopt.Int64Long("benchmark-download", 0, 0, "client mode: size of --benchmark dummy downloads, 0 to skip them")
+	argVersion := getopt.BoolLong("version", 0, "print version and exit")
 	argHelp := getopt.BoolLong("help", 'h', "print help")
 
 	getopt.Parse()
+	if err := envApply(getopt.CommandLine); err != nil {
+		log.Fatalf("bad environment: %v", err)
+	}
+	if *argQuirkFile != "" {
+		if err := quirkLoad(*argQuirkFile); err != nil {
+			log.Fatalf("bad quirk file: %v", err)
+		}
+	}
+	if *argQuirk != "" {
+		if err := quirkApply(*argQuirk); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
 	if *argHelp {
 		getopt.PrintUsage(os.Stdout)
 		os.Exit(0)
 	}
+	if *argVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	verbose.Store(int32(*argVerbose))
+	quietTransfers.Store(*argQuietTransfers)
+	if *argSyslog || *argSyslogOnly {
+		writer, err := syslogOpen(*argSyslogFacility, *argSyslogTag)
+		if err != nil {
+			// stderr still works, better a server logging there than none
+			log.Printf("syslog: %v, logging to stderr only", err)
+		} else if *argSyslogOnly {
+			log.SetOutput(writer)
+		} else {
+			log.SetOutput(io.MultiWriter(os.Stderr, writer))
+		}
+	}
+	if writer := newLogTimeWriter(log.Writer(), *argLogTimeFormat); writer != nil {
+		log.SetFlags(0)
+		log.SetOutput(writer)
+	}
+
+	clientSSH = *argSSH
+	clientSplit = *argSplitConnections
+	if *argScript != "" {
+		if *argConnect == "" {
+			log.Fatalf("usage: --connect <host>:port --script <file>")
+		}
+		if err := clientScript(*argConnect, *argScript); err != nil {
+			log.Fatalf("script failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *argEchoCheck {
+		if *argConnect == "" {
+			log.Fatalf("usage: --connect <host>:port --echo-check [-z]")
+		}
+		if err := clientEchoCheck(*argConnect, *argCompress); err != nil {
+			log.Fatalf("echo check failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *argUnlockState {
+		if *argConnect == "" {
+			log.Fatalf("usage: --connect <host>:port --unlock-state")
+		}
+		if err := clientUnlockState(*argConnect); err != nil {
+			log.Fatalf("unlock state failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *argBenchmark {
+		if *argConnect == "" {
+			log.Fatalf("usage: --connect <host>:port --benchmark")
+		}
+		if err := clientBenchmark(*argConnect, *argBenchmarkCount, *argBenchmarkDownload); err != nil {
+			log.Fatalf("benchmark failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *argDumpPartition != "" {
+		if *argConnect == "" || getopt.NArgs() != 1 {
+			log.Fatalf("usage: --connect <host>:port --dump-partition <partition> <file>")
+		}
+		if err := clientDump(*argConnect, *argDumpPartition, getopt.Arg(0)); err != nil {
+			log.Fatalf("dump failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *argFlash != "" {
+		if *argConnect == "" || getopt.NArgs() != 1 {
+			log.Fatalf("usage: --connect <host>:port --flash <partition> <file>")
+		}
+		if err := clientFlash(*argConnect, *argFlash, getopt.Arg(0), *argVerifyDownload, *argProgressInfo); err != nil {
+			log.Fatalf("flash failed: %v", err)
+		}
+		os.Exit(0)
+	}
 
 	var err error
+	opts := relayOptions{
+		minCommandInterval: *argMinCommandInterval,
+		drainTimeout:       *argDrainTimeout,
+		parse:              *argParse || *argReadonly || *argStep,
+		keepOnError:        *argKeepSession,
+		responseLogMax:     *argResponseLogMax,
+		keepalive:          *argKeepalive,
+		coalesce:           *argCoalesce,
+		maxSessionBytes:    *argMaxSessionBytes,
+		minDownloadRate:    *argMinDownloadRate,
+		stallWindow:        *argStallWindow,
+		readonly:           *argReadonly,
+		step:               *argStep,
+		cacheGetvar:        *argCacheGetvar,
+		verifyDownload:     *argVerifyDownload,
+		progressInfo:       *argProgressInfo,
+		rebootResume:       *argRebootResume,
+		policy: partitionPolicy{
+			allow: *argAllowPartition,
+			deny:  *argDenyPartition,
+		},
+	}
+	names, err := deviceNamesParse(*argDeviceName)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	deviceNamesSet(names)
+	if *argConfig != "" {
+		var changes []string
+		configBaselineSet(opts)
+		if opts, changes, err = applyConfig(*argConfig, opts); err != nil {
+			log.Fatalf("config: %v", err)
+		}
+		for _, change := range changes {
+			log.Printf("config: %v", change)
+		}
+	} else if err = opts.validate(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	relayConfigSet(opts)
+
+	if *argAltSetting < 0 {
+		log.Fatalf("bad alternate setting %v", *argAltSetting)
+	}
+	usbAltSetting = *argAltSetting
+	for _, spec := range *argControlSetup {
+		request, err := usbControlParse(spec)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		usbControlSetup = append(usbControlSetup, request)
+	}
+	if *argSetConfig < 0 || *argSetConfig > 255 {
+		log.Fatalf("bad configuration value %v", *argSetConfig)
+	}
+	usbSetConfig = *argSetConfig
+	if *argAnyConfig && usbSetConfig != 0 {
+		log.Fatalf("--any-config and --set-config are exclusive")
+	}
+	usbAnyConfig = *argAnyConfig
+	usbExplain = *argExplain
+	netEchoTest = *argEchoTest
+	netSplitConnections = *argSplitConnections
+	if *argSplitConnections && *argQueueTimeout > 0 {
+		// the response connection would be queued as a client
+		log.Fatalf("--split-connections doesn't work with --queue-timeout")
+	}
+	if *argHandshakeRateInterval <= 0 {
+		log.Fatalf("bad --handshake-rate-interval %v, more than 0 expected", *argHandshakeRateInterval)
+	}
+	if len(*argAcceptMagic) > 0 {
+		netAcceptMagics = nil
+		for _, magic := range *argAcceptMagic {
+			if len(magic) != 4 {
+				log.Fatalf("bad handshake magic %q, 4 characters expected", magic)
+			}
+			if magic == netHandshakeCompress {
+				log.Fatalf("%v handshake is accepted with -z", magic)
+			}
+			netAcceptMagics = append(netAcceptMagics, magic)
+		}
+	}
+	if *argDeviceList != "" {
+		usbMatchRules, err = loadDeviceList(*argDeviceList)
+		if err != nil {
+			log.Fatalf("load device list failed: %v", err)
+		}
+		log.Printf("loaded %v device rules", len(usbMatchRules))
+	}
+
 	usbCtx, err = libusb.NewContext()
 	if err != nil {
-		log.Fatalf("create USB context failed: %v", err)
+		log.Fatalf("create USB context failed: %v\n%v", err, usbContextHint(err))
 	}
 	defer usbCtx.Close()
+	if *argSerialCache {
+		usbSerialCacheStart()
+	}
+
+	selector := usbSelector{serial: *argSerial, portPath: *argPortPath, sticky: *argStickyPort}
+	if selector.portPath != "" && !usbPortPathSupported {
+		log.Fatalf("--port-path is not supported on this system")
+	}
+	if selector.serialHashes, err = parseSerialHashes(*argSerialHash); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(selector.serialHashes) > 0 {
+		if *argSerialHashKey == "" {
+			log.Fatalf("--serial-hash requires --serial-hash-key")
+		}
+		selector.serialHashKey = []byte(*argSerialHashKey)
+	}
+
+	if *argDumpDescriptors != "" {
+		if err := usbDumpDescriptors(os.Stdout, *argDumpDescriptors == "all", *argSerial, *argJSON); err != nil {
+			log.Fatalf("dump descriptors failed: %v", err)
+		}
+		os.Exit(0)
+	}
+
+	if *argRebootAll {
+		if usbRebootAll(selector) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *argList {
+		for i, dev := range usbDeviceList(selector) {
+			mode := "busy"
+			if opened, err := usbDeviceOpen(usbSelector{bus: dev.bus, address: dev.address}); err == nil {
+				mode = usbDeviceMode(opened)
+				usbDeviceClose(opened)
+			}
+			fmt.Printf("%v: %v, mode: %v\n", i+1, usbDeviceDescription(dev), mode)
+		}
+		os.Exit(0)
+	}
+
+	if *argInteractive {
+		if !isTerminal(os.Stdin) {
+			log.Printf("stdin is not a terminal, --interactive ignored")
+		} else if selector, err = usbDeviceChoose(selector, *argStrict); err != nil {
+			log.Fatalf("error: %v", err)
+		}
+	}
+
+	if *argStrict {
+		if !selector.explicit() {
+			log.Fatalf("--strict: no device selected explicitly, give -s, --port-path or --serial-hash, or choose one with -i")
+		}
+		if selector.bus != 0 {
+			log.Printf("strict: serving only the device at %v:%v", selector.bus, selector.address)
+		} else if selector.portPath != "" {
+			log.Printf("strict: serving only the device at port %v", selector.portPath)
+		} else {
+			log.Printf("strict: serving only devices with the given serial")
+		}
+	}
 
 	if *argCheckDevice {
-		dev, err := usbDeviceOpen(*argSerial)
+		retry := newBackoff(*argCheckInterval, *argRetryMaxInterval)
+		for attempt := 1; ; attempt++ {
+			dev, err := usbDeviceOpen(selector)
+			if err == nil {
+				usbDeviceClose(dev)
+				break
+			}
+			if attempt > *argCheckRetries {
+				log.Fatalf("error: %v", err)
+			}
+			wait := retry.next()
+			log.Printf("check failed: %v, retry %v/%v in %v", err, attempt, *argCheckRetries, wait.Round(time.Millisecond))
+			time.Sleep(wait)
+		}
+	}
+
+	// after the device check so its failure is still reported to the terminal
+	if *argDaemon && !*argForeground {
+		if err := daemonize(); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	handleExitSignals()
+	if *argConfig != "" {
+		configReloadOnHangup(*argConfig)
+	}
+	if *argPidfile != "" {
+		if err := pidfileWrite(*argPidfile); err != nil {
+			log.Fatalf("write pid file failed: %v", err)
+		}
+		pidfileRemoveOnExit(*argPidfile)
+	}
+
+	if *argAdmin != "" {
+		adminServe(*argAdmin, selector)
+	}
+	if *argStep {
+		if *argAdmin == "" && !isTerminal(os.Stdin) {
+			log.Fatalf("--step requires --admin or a terminal to acknowledge commands")
+		}
+		if isTerminal(os.Stdin) && (!*argDaemon || *argForeground) {
+			stepTerminal()
+		}
+	}
+
+	addresses := *argListen
+	if len(addresses) == 0 {
+		addresses = []string{":5554"}
+	}
+	log.Printf("%v launching server at %v", versionString(), strings.Join(addresses, ", "))
+	var listeners []net.Listener
+	for _, address := range addresses {
+		ln, err := net.Listen("tcp", address)
 		if err != nil {
-			log.Fatalf("error: %v", err)
+			log.Fatalf("open tcp server failed: %v", err)
 		}
-		usbDeviceClose(dev)
+		log.Printf("listening at %v", ln.Addr())
+		listeners = append(listeners, ln)
+	}
+	if *argRegisterURL != "" {
+		registered, err := registerAddresses(listeners, *argRegisterURL, *argRegisterAddress)
+		if err != nil {
+			log.Fatalf("registry: %v", err)
+		}
+		registerServe(*argRegisterURL, registered, selector, *argRegisterInterval)
 	}
 
-	log.Printf("launching server at %v", *argPort)
-	ln, err := net.Listen("tcp", *argPort)
-	if err != nil {
-		log.Fatalf("open tcp server failed: %v", err)
+	// a single session at a time whichever address the client comes from
+	multi := newMultiListener(listeners)
+	var ln net.Listener
+	if *argQueueTimeout > 0 {
+		ln = newQueueListener(multi, *argQueueTimeout, *argHandshakeTimeout, *argCompress)
+	} else {
+		ln = netutil.LimitListener(multi, 1)
+	}
+
+	// repeated sessions failing to find the device are spaced out, clients
+	// arriving before the next attempt is due are rejected at once
+	retry := newBackoff(time.Second, *argRetryMaxInterval)
+
+	var breaker *circuitBreaker
+	if *argBreakerFailures > 0 {
+		breaker = newCircuitBreaker(*argBreakerFailures, *argBreakerCooldown)
 	}
 
-	ln = netutil.LimitListener(ln, 1)
+	var limiter *rateLimiter
+	if *argHandshakeRateLimit > 0 {
+		limiter = newRateLimiter(*argHandshakeRateLimit, *argHandshakeRateInterval)
+	}
 
 	for {
-		var dev usbDevice
+		var dev *usbDevice
 		var err error
-		conn, _ := ln.Accept()
-		log.Printf("connected from: %v", ln.Addr().String())
-		if err = netReadHandshake(conn); err != nil {
-			log.Printf("tcp: %v", err)
+		conn, err := ln.Accept()
+		if err != nil {
+			// e.g. out of file descriptors, don't spin
+			log.Printf("tcp: accept failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		log.Printf("connected from: %v to %v", conn.RemoteAddr(), conn.LocalAddr())
+		if limiter != nil && !limiter.allow(conn.RemoteAddr()) {
+			log.Printf("tcp: too many handshakes from %v, closed", conn.RemoteAddr())
+			conn.Close()
 			continue
 		}
-		dev, err = usbDeviceOpen(*argSerial)
+		if *argHandshakeTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(*argHandshakeTimeout))
+		}
+		magic, err := netReadHandshake(conn, *argCompress)
+		var splitID string
+		if err == nil && netBaseMagic(magic) == netHandshakeSplit {
+			splitID, err = splitReadID(conn)
+		}
+		conn.SetReadDeadline(time.Time{})
 		if err != nil {
-			log.Printf("device error: %v", err)
-			time.Sleep(time.Second)
+			log.Printf("tcp: %v", err)
 			conn.Close()
 			continue
 		}
-
-		netWriteHandshake(conn)
-
-		log.Printf("protocol version 1")
-		var response []byte = make([]byte, 256)
-		for {
-			data, err := netRead(conn)
+		if magic == netHandshakeEcho || magic == netHandshakeEchoCompress {
+			log.Printf("echo test from %v", conn.RemoteAddr())
+			// no device involved, other clients are accepted meanwhile
+			go func(conn net.Conn, magic string) {
+				if netWriteHandshake(conn, magic) == nil {
+					if err := echoServe(conn, magic); err != nil {
+						log.Printf("echo: %v", err)
+					}
+				}
+				conn.Close()
+			}(conn, magic)
+			continue
+		}
+		sessionSelector := usbTargetSelect(selector)
+		deviceKey := breakerKey(sessionSelector)
+		probe := func() error {
+			_, err := usbDeviceProbe(sessionSelector)
+			return err
+		}
+		if ok, left := breaker.allow(deviceKey, probe); !ok {
+			log.Printf("%v temporarily unavailable, %v left", breakerDevice(deviceKey), left.Round(time.Second))
+			netReject(conn, magic, fmt.Sprintf("relay: device temporarily unavailable after repeated failures, retry in %v",
+				left.Round(time.Second)))
+			conn.Close()
+			continue
+		}
+		if wait := retry.left(); wait > 0 {
+			log.Printf("device absent, next attempt in %v", wait.Round(time.Millisecond))
+			netReject(conn, magic, fmt.Sprintf("relay: no device found, retry in %v", wait.Round(time.Second)))
+			conn.Close()
+			continue
+		}
+		if *argPreSessionCommand != "" {
+			err = preSessionRun(*argPreSessionCommand, *argPreSessionTimeout, conn.RemoteAddr().String(), sessionSelector.serial)
 			if err != nil {
-				log.Printf("tcp: %v", err)
-				break
+				log.Printf("pre-session command failed: %v", err)
+				netReject(conn, magic, "relay: pre-session command failed")
+				conn.Close()
+				continue
+			}
+		}
+		dev, err = usbDeviceOpen(sessionSelector)
+		// the client waits for these, not for the spacing of the sessions
+		openRetry := newBackoff(time.Second, *argRetryMaxInterval)
+		for attempt := 1; err != nil; attempt++ {
+			retries := 0
+			switch usbOpenClass(err) {
+			case usbOpenAbsent:
+				retries = *argMaxOpenRetries
+			case usbOpenBusy:
+				retries = *argBusyOpenRetries
 			}
-			log.Printf("command, size: %v", len(data))
-			if err = usbWrite(dev, data); err != nil {
-				log.Printf("usb: %v", err)
+			if attempt > retries {
 				break
 			}
-			n, err := usbRead(dev, response)
+			wait := openRetry.next()
+			log.Printf("device error: %v, retry %v/%v in %v", err, attempt, retries, wait.Round(time.Millisecond))
+			time.Sleep(wait)
+			dev, err = usbDeviceOpen(sessionSelector)
+		}
+		if err != nil {
+			log.Printf("device error: %v", err)
+			eventPublish(eventError, sessionSelector.serial, conn.RemoteAddr().String(), err.Error())
+			switch usbOpenClass(err) {
+			case usbOpenBusy:
+				// retrying later won't help while the other program runs
+				netReject(conn, magic, "relay: device busy, claimed by another program")
+				conn.Close()
+			case usbOpenMultiple:
+				netReject(conn, magic, "relay: several devices match, the server must select one")
+				conn.Close()
+			default:
+				breaker.failure(deviceKey)
+				netReject(conn, magic, "relay: no device found")
+				conn.Close()
+				retry.postpone()
+			}
+			continue
+		}
+		retry.reset()
+		ctx, session := sessionStart(conn, dev, *argMaxSessionDuration)
+
+		sessionOpts := relayConfigGet()
+		if *argAuditDir != "" {
+			sessionOpts.audit, err = auditOpen(*argAuditDir, conn.RemoteAddr().String(), usbDeviceName(dev))
 			if err != nil {
-				log.Printf("usb: %v", err)
-				break
+				// no session without its audit trail
+				log.Printf("audit: %v", err)
+				sessionEnd(session)
+				usbDeviceClose(dev)
+				conn.Close()
+				continue
 			}
-			if err = netWrite(conn, response[0:n]); err != nil {
+		}
+		if *argForensicBuffer != "" {
+			sessionOpts.forensic, err = forensicOpen(*argForensicBuffer, *argForensicBufferSize, conn.RemoteAddr().String(), usbDeviceName(dev))
+			if err != nil {
+				log.Printf("forensic: %v", err)
+			}
+		}
+
+		netWriteHandshake(conn, magic)
+		if netBaseMagic(magic) == netHandshakeSplit {
+			if conn, err = splitAccept(multi, conn, splitID); err != nil {
 				log.Printf("tcp: %v", err)
-				break
+				sessionOpts.audit.Close()
+				sessionOpts.forensic.Close(err.Error())
+				sessionEnd(session)
+				usbDeviceClose(dev)
+				continue
 			}
+			sessionSetConn(session, conn)
 		}
+		if *argCollectInfo {
+			// once the client got its handshake reply, its first command
+			// waits unread meanwhile
+			collectInfo(dev)
+		}
+
+		client := conn.RemoteAddr().String()
+		sessionOpts.device = usbDeviceName(dev)
+		eventPublish(eventConnected, sessionOpts.device, client, usbDeviceDescription(dev))
+		sessionOpts.stats = session.stats
+		sessionOpts.control = netControl(magic)
+		eventPublish(eventSessionStarted, sessionOpts.device, client, "")
+		compress := netBaseMagic(magic) == netHandshakeCompress
+		relayErr := relay(ctx, conn, compress, dev, dev.logger, sessionOpts)
+		for errors.Is(relayErr, errRebootResume) {
+			usbDeviceClose(dev)
+			resumeSelector := rebootResumeSelector(sessionSelector, dev)
+			if dev, relayErr = rebootResumeWait(ctx, conn, compress, resumeSelector, *argRebootResumeTimeout); relayErr == nil {
+				relayErr = relay(ctx, conn, compress, dev, dev.logger, sessionOpts)
+			}
+		}
+		sessionOpts.audit.Close()
+		end := ctx.Err()
+		sessionEnd(session)
 		conn.Close()
+		if summary := session.stats.commandSummary(); summary != "" {
+			log.Printf("session commands: %v", summary)
+		}
+		reason := ""
+		if relayErr != nil {
+			reason = relayErr.Error()
+			eventPublish(eventError, sessionOpts.device, client, reason)
+			breaker.failure(deviceKey)
+		} else {
+			breaker.success(deviceKey)
+		}
+		if end != nil && relayErr == nil {
+			reason = end.Error()
+		}
+		sessionOpts.forensic.Close(reason)
+		eventPublish(eventSessionEnded, sessionOpts.device, client, reason)
+		if dev == nil {
+			// didn't come back from a reboot
+			log.Printf("session ended: %v", relayErr)
+			continue
+		}
+		if end == context.DeadlineExceeded {
+			dev.logger.Printf("session terminated: exceeded max duration %v", *argMaxSessionDuration)
+		} else if end != nil || relayErr != nil {
+			dev.logger.Printf("session aborted, resetting device")
+			usbDeviceReset(dev)
+		}
 		usbDeviceClose(dev)
 	}
 }
 
-func netReadHandshake(conn net.Conn) error {
+// handshake magics accepted, e.g. also the one of a fork during a migration
+var netAcceptMagics []string = []string{"FB01"}
+
+// netReadHandshake returns the handshake magic to answer the client with,
+// netHandshakeCompress is accepted only if compress is set. Magics of
+// netAcceptMagics are all answered with the canonical FB01. A client asking
+// for control frames is answered with version 2 of the magic, see control.go.
+func netReadHandshake(conn net.Conn, compress bool) (string, error) {
 
 	var header []byte = make([]byte, 4)
-	reader := bufio.NewReader(conn)
-	n, err := io.ReadFull(reader, header)
-	if n != 4 || string(header) != "FB01" {
-		return fmt.Errorf("read handshake header failed: %v", err)
+	n, err := io.ReadFull(conn, header)
+	return netHandshakeAnswer(header[0:n], compress, err)
+}
+
+// netHandshakeAnswer is netReadHandshake for the header read, err is the read
+// error.
+func netHandshakeAnswer(header []byte, compress bool, err error) (string, error) {
+
+	if len(header) == 4 && netControl(string(header)) {
+		base := []byte(netBaseMagic(string(header)))
+		if magic, err := netMatchHandshake(base, compress, nil); err == nil && netControlMagic(magic) != "" {
+			return netControlMagic(magic), nil
+		}
 	}
-	return nil
+	return netMatchHandshake(header, compress, err)
+}
+
+// netMatchHandshake is netHandshakeAnswer for version 1 magics.
+func netMatchHandshake(header []byte, compress bool, err error) (string, error) {
+
+	n := len(header)
+	for _, magic := range netAcceptMagics {
+		if n == 4 && string(header) == magic {
+			return "FB01", nil
+		}
+	}
+	if n == 4 && compress && string(header) == netHandshakeCompress {
+		return netHandshakeCompress, nil
+	}
+	if n == 4 && netSplitConnections && string(header) == netHandshakeSplit {
+		return netHandshakeSplit, nil
+	}
+	if magic := netEchoHandshake(string(header), compress); magic != "" {
+		return magic, nil
+	}
+	if hint := netHandshakeHint(header); hint != "" {
+		return "", fmt.Errorf("read handshake header failed: %q, %v", header, hint)
+	}
+	return "", fmt.Errorf("read handshake header failed: %q %v", header, err)
+}
+
+var netHTTPMethods = []string{"GET ", "HEAD", "POST", "PUT ", "DELE", "OPTI", "PATC", "CONN", "TRAC"}
+
+// netHandshakeHint explains a wrong handshake sent by a common non fastboot
+// client, empty if it's not recognized.
+func netHandshakeHint(header []byte) string {
+
+	const wrongPort = "expected FB01 handshake, are you hitting the wrong port?"
+	if len(header) >= 2 && header[0] == 0x16 && header[1] == 0x03 {
+		return "client started TLS, " + wrongPort
+	}
+	if len(header) < 4 {
+		return ""
+	}
+	for _, method := range netHTTPMethods {
+		if string(header) == method {
+			return "client sent HTTP, " + wrongPort
+		}
+	}
+	if string(header) == "SSH-" {
+		return "client started SSH, " + wrongPort
+	}
+	if string(header) == netHandshakeCompress {
+		return "client asks for compressed framing, start the server with -z"
+	}
+	if string(header) == netHandshakeEcho || string(header) == netHandshakeEchoCompress {
+		return "client asks for the echo test, start the server with --echo-test (and -z for compressed framing)"
+	}
+	if string(header) == netHandshakeSplit {
+		return "client asks for split connections, start the server with --split-connections"
+	}
+	if string(header) == netHandshakeResponse {
+		return "response connection of no session waiting for it"
+	}
+	if string(header[0:2]) == "FB" {
+		return "unsupported fastboot protocol version"
+	}
+	return ""
 }
 
-func netWriteHandshake(conn net.Conn) error {
+func netWriteHandshake(conn net.Conn, magic string) error {
 
-	_, err := conn.Write([]byte("FB01"))
+	_, err := conn.Write([]byte(magic))
 	if err != nil {
 		log.Printf("write handshake header failed: %v", err)
 	}
 	return err
 }
 
+// netReject completes the handshake and answers the first command of the
+// client with FAIL, so the reason is shown by the client instead of a
+// connection error.
+func netReject(conn net.Conn, magic string, reason string) {
+
+	if netWriteHandshake(conn, magic) != nil {
+		return
+	}
+	codec := &netCodec{compress: netBaseMagic(magic) == netHandshakeCompress}
+	if err := codec.write(conn, []byte("FAIL"+reason)); err != nil {
+		log.Printf("tcp: %v", err)
+		return
+	}
+	netDrain(conn)
+}
+
+// how long netDrain waits for the client to close its side
+const netCloseLinger = time.Second
+
+// netDrain drops what the client still sends until it closes the connection
+// or for up to netCloseLinger. Closing a socket with unread data resets the
+// connection, the client may then lose the final response it has not read
+// yet. The write side is shut down first: a client reading until the end of
+// the connection sees it right away and closes its side.
+func netDrain(conn net.Conn) {
+
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+	}
+	conn.SetDeadline(time.Now().Add(netCloseLinger))
+	io.Copy(io.Discard, conn)
+}
+
+// netRead reads a frame. The connection is read unbuffered: a bufio.Reader
+// per call would swallow the beginning of the next frame, sent by the client
+// in the same segment, and drop it with the reader.
 func netRead(conn net.Conn) ([]byte, error) {
 
-	reader := bufio.NewReader(conn)
-	var header []byte = make([]byte, 8)
-	if n, err := io.ReadFull(reader, header); n != 8 {
+	return netReadLimit(conn, nil)
+}
+
+// netReadLimit reads a frame of at most limit() bytes, netMaxFrame if limit is
+// nil. limit is called once the header is read: what the peer may send next
+// depends on the responses it got before sending it.
+func netReadLimit(conn net.Conn, limit func() uint64) ([]byte, error) {
+
+	buffer := netBufferPool.Get().(*netFrameBuffer)
+	if n, err := io.ReadFull(conn, buffer[0:8]); n != 8 {
+		netBufferPool.Put(buffer)
+		if n == 0 && err == io.EOF {
+			return nil, err
+		}
 		return nil, fmt.Errorf("read header failed: %v", err)
 	}
 
-	size := binary.BigEndian.Uint64(header)
+	size := binary.BigEndian.Uint64(buffer[0:8])
+	max := uint64(netMaxFrame)
+	if limit != nil {
+		max = limit()
+	}
+	if size > max {
+		netBufferPool.Put(buffer)
+		return nil, fmt.Errorf("read header failed: frame size %v exceeds %v", size, max)
+	}
+	if size <= netPoolSize {
+		if _, err := io.ReadFull(conn, buffer[0:size]); err != nil {
+			netBufferPool.Put(buffer)
+			return nil, fmt.Errorf("read packet failed: %v", err)
+		}
+		return buffer[0:size:netPoolSize], nil
+	}
+	netBufferPool.Put(buffer)
 
-	var data []byte = make([]byte, size)
-	if _, err := io.ReadFull(reader, data); err != nil {
-		return nil, fmt.Errorf("read packet failed: %v", err)
+	// the buffer grows with the data actually received, a header alone must
+	// not make us allocate up to netMaxFrame
+	var data []byte = make([]byte, 0, netReadStep(size, 0))
+	for uint64(len(data)) < size {
+		start := len(data)
+		if start == cap(data) {
+			grown := make([]byte, start, start+netReadStep(size, start))
+			copy(grown, data)
+			data = grown
+		}
+		data = data[0:cap(data)]
+		n, err := io.ReadFull(conn, data[start:])
+		data = data[0 : start+n]
+		if err != nil {
+			return nil, fmt.Errorf("read packet failed: %v", err)
+		}
 	}
 
 	return data, nil
 }
 
+// netBufferRelease gives a frame returned by netRead back to the pool, data
+// must not be used after that. Frames not from the pool are left to the gc.
+func netBufferRelease(data []byte) {
+
+	if cap(data) == netPoolSize {
+		netBufferPool.Put((*netFrameBuffer)(data[0:netPoolSize]))
+	}
+}
+
+// netReadStep returns how much the buffer of a frame of size bytes with
+// received bytes read so far grows by: doubling, starting at 64KB.
+func netReadStep(size uint64, received int) int {
+
+	step := uint64(received)
+	if step < 64*1024 {
+		step = 64 * 1024
+	}
+	if remaining := size - uint64(received); step > remaining {
+		step = remaining
+	}
+	return int(step)
+}
+
 func netWrite(conn net.Conn, data []byte) error {
 
+	if len(data) <= netPoolSize-8 {
+		// header and payload in a single write
+		buffer := netBufferPool.Get().(*netFrameBuffer)
+		defer netBufferPool.Put(buffer)
+		binary.BigEndian.PutUint64(buffer[0:8], uint64(len(data)))
+		n := copy(buffer[8:], data)
+		if err := netWriteFull(conn, buffer[0:8+n]); err != nil {
+			return fmt.Errorf("write packet failed: %v", err)
+		}
+		return nil
+	}
 	var header []byte = make([]byte, 8)
 	binary.BigEndian.PutUint64(header, uint64(len(data)))
-	if _, err := conn.Write(header); err != nil {
+	if err := netWriteFull(conn, header); err != nil {
 		return fmt.Errorf("write header failed: %v", err)
 	}
-	if n, err := conn.Write(data); err != nil || n != len(data) {
-		return fmt.Errorf("write packet failed: %v %v", n, err)
+	if err := netWriteFull(conn, data); err != nil {
+		return fmt.Errorf("write packet failed: %v", err)
+	}
+	return nil
+}
+
+// netWriteFull writes all of data, resuming after short writes: a part of a
+// frame left unwritten breaks the framing of the whole connection. Writers
+// wrapping the connection may return short counts without an error.
+func netWriteFull(conn io.Writer, data []byte) error {
+
+	for len(data) > 0 {
+		n, err := conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("%v bytes left: %v", len(data)-n, err)
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		data = data[n:]
 	}
 	return nil
 }
 
-func usbWrite(dev usbDevice, data []byte) error {
+// usbTransferTimeout returns libusb timeout (ms) for the next transfer made on
+// behalf of ctx. A context that can't be cancelled gets the plain usbTimeout,
+// otherwise transfers are sliced into usbPollTimeout pieces, so cancellation
+// is noticed promptly, and never outlive the context deadline.
+func usbTransferTimeout(ctx context.Context, deadline time.Time) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ctx.Done() == nil {
+		return usbTimeout, nil
+	}
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	left := time.Until(deadline).Milliseconds()
+	if left <= 0 {
+		return 0, errUsbTimeout
+	}
+	if left > usbPollTimeout {
+		left = usbPollTimeout
+	}
+	return int(left), nil
+}
+
+func usbWrite(ctx context.Context, dev *usbDevice, data []byte) error {
+
+	dev.writeLock.Lock()
+	defer dev.writeLock.Unlock()
 
 	endpoint := dev.endpointOut
-	count := (len(data) + int(endpoint.MaxPacketSize) - 1) / int(endpoint.MaxPacketSize)
-	log.Printf("usb sending: %v, %v %v\n", len(data), count, endpoint.MaxPacketSize)
+	packetSize := int(endpoint.MaxPacketSize)
+	if packetSize <= 0 {
+		packetSize = usbFallbackPacketSize
+	}
+	count := (len(data) + packetSize - 1) / packetSize
+	if !quietTransfers.Load() {
+		dev.logger.Printf("usb sending: %v, %v %v\n", len(data), count, packetSize)
+	}
 
+	stalls := 0
 	offset := 0
 	for i := 0; i < count; i++ {
 		size := (len(data) - offset)
-		if size > int(endpoint.MaxPacketSize) {
-			size = int(endpoint.MaxPacketSize)
+		if size > packetSize {
+			size = packetSize
 		}
-		_, err := dev.handle.BulkTransfer(endpoint.EndpointAddress, data[offset:offset+size], size, usbTimeout)
-		if err != nil {
-			return fmt.Errorf("write failed: %v", err)
+		deadline := time.Now().Add(usbTimeout * time.Millisecond)
+		for {
+			timeout, err := usbTransferTimeout(ctx, deadline)
+			if err != nil {
+				return fmt.Errorf("write failed: %w", err)
+			}
+			// a packet is sent entirely or not at all, so it's safe to retry
+			_, err = dev.handle.BulkTransfer(endpoint, data[offset:offset+size], size, timeout)
+			if err == usbErrorTimeout && timeout != usbTimeout {
+				continue
+			}
+			if err == usbErrorPipe && stalls < usbStallRetries {
+				stalls++
+				dev.logger.Printf("usb: out endpoint stalled at offset %v, clearing halt (%v/%v)", offset, stalls, usbStallRetries)
+				if err = usbClearHalt(dev, endpoint); err != nil {
+					return fmt.Errorf("write failed: clear halt: %w", err)
+				}
+				dev.logger.Printf("usb: out endpoint recovered, resending from offset %v", offset)
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("write failed: %w", err)
+			}
+			break
 		}
 		offset = offset + size
 	}
 	return nil
 }
 
-func usbRead(dev usbDevice, data []byte) (int, error) {
+// usbClearHalt sends CLEAR_FEATURE(ENDPOINT_HALT) to a stalled endpoint, the
+// wrapper has no libusb_clear_halt. The kernel resets the host side data
+// toggle of the endpoint when it sees the request succeed.
+func usbClearHalt(dev *usbDevice, endpoint *libusb.EndpointDescriptor) error {
+
+	const requestTypeEndpoint = 0x02
+	const requestClearFeature = 0x01
+	const featureEndpointHalt = 0
+	// the wrapper takes the address of the first byte even with no data
+	var buffer []byte = make([]byte, 1)
+	_, err := dev.handle.ControlTransfer(requestTypeEndpoint, requestClearFeature, featureEndpointHalt,
+		uint16(endpoint.EndpointAddress), buffer, 0, usbTimeout)
+	return err
+}
+
+// usbRead waits for a device response up to usbTimeout or until ctx is done.
+// The wait is sliced into usbPollTimeout transfers and the wrapper reports no
+// bytes for a transfer ending with an error, so a slice timing out while a
+// response spanning several packets is received would lose its beginning. A
+// slice asks for a single packet if one holds any response: a packet arrives
+// whole or not at all. Packets smaller than that (full speed) leave a
+// response crossing a slice boundary exposed. Bulk data must be read with
+// usbReadTimeout instead.
+func usbRead(ctx context.Context, dev *usbDevice, data []byte) (int, error) {
 
-	n, err := dev.handle.BulkTransfer(dev.endpointIn.EndpointAddress, data, len(data), usbTimeout)
+	if size := int(dev.endpointIn.MaxPacketSize); size >= usbResponseMax && size < len(data) {
+		data = data[0:size]
+	}
+	deadline := time.Now().Add(usbTimeout * time.Millisecond)
+	for {
+		timeout, err := usbTransferTimeout(ctx, deadline)
+		if err != nil {
+			return 0, err
+		}
+		n, err := usbReadTimeout(dev, data, timeout)
+		if err == errUsbTimeout && n == 0 && timeout != usbTimeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+// usbReadTimeout does a single read. The wrapper returns 0 with the error,
+// bytes received before a timeout are lost: errUsbTimeout means the data may
+// be truncated, not that nothing came. Big transfers should use a timeout
+// long enough to complete.
+func usbReadTimeout(dev *usbDevice, data []byte, timeout int) (int, error) {
+
+	dev.readLock.Lock()
+	defer dev.readLock.Unlock()
+
+	var n int
+	var err error
+	if dev.overflowed {
+		n, err = usbReadOverflowed(dev, data, timeout)
+	} else {
+		n, err = dev.handle.BulkTransfer(dev.endpointIn, data, len(data), timeout)
+	}
+	if err == usbErrorOverflow {
+		dev.logger.Printf("usb: device sent more than the %v byte read buffer, data lost, reading into %v bytes from now on",
+			len(data), usbReadOverflowSize(data))
+		dev.overflowed = true
+		return 0, fmt.Errorf("read failed: %w", errUsbOverflow)
+	}
+	if err == usbErrorTimeout {
+		return n, errUsbTimeout
+	}
 	if err != nil {
-		return n, fmt.Errorf("read failed: %v", err)
+		return n, fmt.Errorf("read failed: %w", err)
 	}
+	debugf(dev.logger, "usb recv: %v\n", n)
 	return n, nil
 }
+
+// usbReadOverflowSize returns the size of the buffer reads into data use once
+// a read overflowed.
+func usbReadOverflowSize(data []byte) int {
+
+	return (len(data)/usbReadChunk + 1) * usbReadChunk
+}
+
+// usbReadOverflowed reads, after the device once sent more than a read
+// buffer held, into a buffer large enough for any packet. Called with
+// dev.readLock held.
+func usbReadOverflowed(dev *usbDevice, data []byte, timeout int) (int, error) {
+
+	size := usbReadOverflowSize(data)
+	var buffer []byte = make([]byte, size)
+	n, err := dev.handle.BulkTransfer(dev.endpointIn, buffer, size, timeout)
+	copied := copy(data, buffer[0:n])
+	if err == nil && n > copied {
+		err = usbErrorOverflow
+	}
+	return copied, err
+}
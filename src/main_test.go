@@ -0,0 +1,777 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	libusb "github.com/gotmc/libusb/v2"
+)
+
+// usbHandleMock is a usbHandle standing in for an opened device: bulk OUT
+// transfers are answered with the packets respond returns for them, read by
+// bulk IN transfers. The test fails if a direction is used concurrently or
+// the handle is claimed, reset or closed during a transfer, which libusb
+// doesn't allow.
+type usbHandleMock struct {
+	t       testing.TB
+	respond func(data []byte) [][]byte
+	in      chan []byte
+
+	lock sync.Mutex
+	// the calls other than bulk transfers, e.g. "claim 2" or "reset"
+	calls []string
+	// sizes of the bulk transfers
+	inSizes  []int
+	outSizes []int
+
+	busyIn   atomic.Int32
+	busyOut  atomic.Int32
+	busyAll  atomic.Int32
+	overflow atomic.Int32
+	// bulk OUT transfers left to stall, until the halt is cleared
+	stalls atomic.Int32
+	// error of control transfers other than clearing a halt
+	controlErr error
+}
+
+func newUsbHandleMock(t testing.TB, respond func(data []byte) [][]byte) *usbHandleMock {
+
+	return &usbHandleMock{t: t, respond: respond, in: make(chan []byte, 1024)}
+}
+
+// newUsbDeviceMock returns a usbDevice on top of handle with bulk endpoints
+// of packetSize bytes.
+func newUsbDeviceMock(handle usbHandle, packetSize uint16) *usbDevice {
+
+	return &usbDevice{
+		endpointIn:  &libusb.EndpointDescriptor{EndpointAddress: 0x81, Attributes: 0x02, MaxPacketSize: packetSize},
+		endpointOut: &libusb.EndpointDescriptor{EndpointAddress: 0x01, Attributes: 0x02, MaxPacketSize: packetSize},
+		handle:      handle,
+		serial:      "mock",
+		logger:      log.New(io.Discard, "", 0),
+	}
+}
+
+// exclusive marks the start of a call which must not overlap any other, the
+// returned function its end.
+func (m *usbHandleMock) exclusive(call string) func() {
+
+	if m.busyAll.Add(1) > 1 || m.busyIn.Load() > 0 || m.busyOut.Load() > 0 {
+		m.t.Errorf("usb: %v while the handle is in use", call)
+	}
+	m.lock.Lock()
+	m.calls = append(m.calls, call)
+	m.lock.Unlock()
+	return func() { m.busyAll.Add(-1) }
+}
+
+func (m *usbHandleMock) BulkTransfer(endpoint *libusb.EndpointDescriptor, data []byte, length int, timeout int) (int, error) {
+
+	if endpoint.Direction() == 1 {
+		if m.busyIn.Add(1) > 1 || m.busyAll.Load() > 0 {
+			m.t.Errorf("usb: concurrent bulk IN transfers")
+		}
+		defer m.busyIn.Add(-1)
+		m.lock.Lock()
+		m.inSizes = append(m.inSizes, length)
+		m.lock.Unlock()
+		select {
+		case packet := <-m.in:
+			if len(packet) > length {
+				// the wrapper drops the count of the bytes received
+				m.overflow.Add(1)
+				return 0, usbErrorOverflow
+			}
+			return copy(data[0:length], packet), nil
+		case <-time.After(time.Duration(timeout) * time.Millisecond):
+			return 0, usbErrorTimeout
+		}
+	}
+	if m.busyOut.Add(1) > 1 || m.busyAll.Load() > 0 {
+		m.t.Errorf("usb: concurrent bulk OUT transfers")
+	}
+	defer m.busyOut.Add(-1)
+	m.lock.Lock()
+	m.outSizes = append(m.outSizes, length)
+	m.lock.Unlock()
+	if m.stalls.Load() > 0 {
+		return 0, usbErrorPipe
+	}
+	if m.respond != nil {
+		for _, packet := range m.respond(data[0:length]) {
+			m.in <- packet
+		}
+	}
+	return length, nil
+}
+
+func (m *usbHandleMock) ControlTransfer(requestType byte, request byte, value uint16, index uint16, data []byte, length int, timeout int) (int, error) {
+
+	defer m.exclusive(fmt.Sprintf("control %02x:%02x:%04x:%04x", requestType, request, value, index))()
+	if len(data) == 0 {
+		// the wrapper takes the address of the first byte, even with no data
+		m.t.Errorf("usb: control transfer without a buffer")
+		return 0, usbErrorIO
+	}
+	if requestType == 0x02 && request == 0x01 && value == 0 {
+		// CLEAR_FEATURE(ENDPOINT_HALT)
+		m.stalls.Add(-1)
+	} else if m.controlErr != nil {
+		return 0, m.controlErr
+	}
+	return length, nil
+}
+
+func (m *usbHandleMock) SetConfiguration(configuration int) error {
+
+	defer m.exclusive(fmt.Sprintf("config %v", configuration))()
+	return nil
+}
+
+func (m *usbHandleMock) ClaimInterface(iface int) error {
+
+	defer m.exclusive(fmt.Sprintf("claim %v", iface))()
+	return nil
+}
+
+func (m *usbHandleMock) ReleaseInterface(iface int) error {
+
+	defer m.exclusive(fmt.Sprintf("release %v", iface))()
+	return nil
+}
+
+func (m *usbHandleMock) SetInterfaceAltSetting(iface int, altSetting int) error {
+
+	defer m.exclusive(fmt.Sprintf("alt %v %v", iface, altSetting))()
+	return nil
+}
+
+func (m *usbHandleMock) StringDescriptorASCII(index uint8) (string, error) {
+
+	return "mock", nil
+}
+
+func (m *usbHandleMock) ResetDevice() error {
+
+	defer m.exclusive("reset")()
+	return nil
+}
+
+func (m *usbHandleMock) Close() error {
+
+	defer m.exclusive("close")()
+	return nil
+}
+
+func (m *usbHandleMock) callList() []string {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string(nil), m.calls...)
+}
+
+// pipeSend writes data to one end of a pipe in background and returns the
+// other end, the writing end is closed once written.
+func pipeSend(t *testing.T, data []byte) net.Conn {
+
+	t.Helper()
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func TestNetReadHandshake(t *testing.T) {
+
+	tests := []struct {
+		header   string
+		compress bool
+		magic    string
+		err      string
+	}{
+		{"FB01", false, "FB01", ""},
+		{"FB01", true, "FB01", ""},
+		{"FBZ1", true, "FBZ1", ""},
+		{"FBZ1", false, "", "start the server with -z"},
+		{"FB02", false, "FB02", ""},
+		{"FBZ2", true, "FBZ2", ""},
+		{"FBZ2", false, "", "unsupported fastboot protocol version"},
+		{"FB03", false, "", "unsupported fastboot protocol version"},
+		{"GET ", false, "", "client sent HTTP"},
+		{"\x16\x03\x01\x02", false, "", "client started TLS"},
+		{"FB", false, "", "read handshake header failed"},
+		{"", false, "", "read handshake header failed"},
+	}
+	for _, test := range tests {
+		magic, err := netReadHandshake(pipeSend(t, []byte(test.header)), test.compress)
+		if test.err == "" && (err != nil || magic != test.magic) {
+			t.Errorf("%q: got %q, %v, %q expected", test.header, magic, err, test.magic)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%q: got %q, %v, error with %q expected", test.header, magic, err, test.err)
+		}
+	}
+}
+
+func TestNetReadHandshakeAcceptMagics(t *testing.T) {
+
+	defer func(magics []string) { netAcceptMagics = magics }(netAcceptMagics)
+	netAcceptMagics = []string{"FB01", "XF01"}
+	if magic, err := netReadHandshake(pipeSend(t, []byte("XF01")), false); err != nil || magic != "FB01" {
+		t.Errorf("got %q, %v, answered with FB01 expected", magic, err)
+	}
+}
+
+// the sizes frames are split at, around the pooled buffer size
+var netTestSizes = []int{0, 1, 4, 64, 256, netPoolSize - 9, netPoolSize - 8, netPoolSize - 7, netPoolSize, netPoolSize + 1, 300000}
+
+func TestNetFraming(t *testing.T) {
+
+	for _, compress := range []bool{false, true} {
+		client, server := net.Pipe()
+		codec := &netCodec{compress: compress}
+		go func() {
+			for _, size := range netTestSizes {
+				if err := codec.write(client, bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+					t.Errorf("write %v: %v", size, err)
+				}
+			}
+			client.Close()
+		}()
+		for _, size := range netTestSizes {
+			data, err := codec.read(server)
+			if err != nil {
+				t.Fatalf("compress %v: read %v: %v", compress, size, err)
+			}
+			if !bytes.Equal(data, bytes.Repeat([]byte{byte(size)}, size)) {
+				t.Errorf("compress %v: frame of %v bytes: got %v bytes", compress, size, len(data))
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestNetReadBackToBack(t *testing.T) {
+
+	// two frames in a single write, the second one must not be lost
+	var stream bytes.Buffer
+	for _, frame := range []string{"getvar:product", "getvar:serialno"} {
+		stream.Write([]byte{0, 0, 0, 0, 0, 0, 0, byte(len(frame))})
+		stream.WriteString(frame)
+	}
+	conn := pipeSend(t, stream.Bytes())
+	for _, frame := range []string{"getvar:product", "getvar:serialno"} {
+		if data, err := netRead(conn); err != nil || string(data) != frame {
+			t.Errorf("got %q, %v, %q expected", data, err, frame)
+		}
+	}
+}
+
+// netTestHeader returns the frame header of size.
+func netTestHeader(size uint64) []byte {
+
+	var header []byte = make([]byte, 8)
+	binary.BigEndian.PutUint64(header, size)
+	return header
+}
+
+func TestNetReadMalformed(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		stream []byte
+		limit  uint64
+		err    string
+	}{
+		{"short header", []byte{0, 0, 0}, 0, "read header failed"},
+		{"short payload", append(netTestHeader(16), "getvar"...), 0, "read packet failed"},
+		{"short large payload", append(netTestHeader(netPoolSize+1), make([]byte, 100)...), 0, "read packet failed"},
+		{"oversized", netTestHeader(netMaxFrame + 1), 0, "exceeds"},
+		{"over the limit", append(netTestHeader(fastbootCommandMax+1), make([]byte, fastbootCommandMax+1)...), fastbootCommandMax, "exceeds"},
+	}
+	for _, test := range tests {
+		var limit func() uint64
+		if test.limit != 0 {
+			limit = func() uint64 { return test.limit }
+		}
+		data, err := netReadLimit(pipeSend(t, test.stream), limit)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: got %v bytes, error %v, %q expected", test.name, len(data), err, test.err)
+		}
+	}
+}
+
+func TestNetReadEmpty(t *testing.T) {
+
+	// zero length frames are valid and don't consume the next one
+	stream := append(netTestHeader(0), netTestHeader(0)...)
+	stream = append(stream, netTestHeader(4)...)
+	stream = append(stream, "OKAY"...)
+	conn := pipeSend(t, stream)
+	for _, frame := range []string{"", "", "OKAY"} {
+		if data, err := netRead(conn); err != nil || string(data) != frame {
+			t.Errorf("got %q, %v, %q expected", data, err, frame)
+		}
+	}
+	if _, err := netRead(conn); err != io.EOF {
+		t.Errorf("got %v after the last frame, EOF expected", err)
+	}
+}
+
+func TestNetReadCompressedEmpty(t *testing.T) {
+
+	// a compressed frame carries at least its flag byte
+	codec := &netCodec{compress: true}
+	if _, err := codec.read(pipeSend(t, netTestHeader(0))); err == nil {
+		t.Errorf("empty compressed frame accepted")
+	}
+}
+
+func TestNetReadDecompressedLimit(t *testing.T) {
+
+	limit := func() uint64 { return fastbootCommandMax }
+	for _, size := range []int{fastbootCommandMax, fastbootCommandMax + 1, 1 << 20} {
+		client, server := net.Pipe()
+		go func() {
+			// compresses well, so is sent gzipped below the limit
+			(&netCodec{compress: true}).write(client, make([]byte, size))
+			client.Close()
+		}()
+		data, err := (&netCodec{compress: true, limit: limit}).read(server)
+		if size <= fastbootCommandMax && (err != nil || len(data) != size) {
+			t.Errorf("frame of %v bytes: got %v bytes, %v", size, len(data), err)
+		}
+		if size > fastbootCommandMax && err == nil {
+			t.Errorf("frame of %v bytes accepted, limit %v", size, fastbootCommandMax)
+		}
+		server.Close()
+	}
+}
+
+// shortConn writes at most max bytes per call, as a kernel under memory
+// pressure may.
+type shortConn struct {
+	net.Conn
+	max int
+}
+
+func (c shortConn) Write(data []byte) (int, error) {
+
+	if len(data) > c.max {
+		data = data[0:c.max]
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	return c.Conn.Write(data)
+}
+
+func TestNetWriteShort(t *testing.T) {
+
+	for _, size := range netTestSizes {
+		client, server := net.Pipe()
+		go func() {
+			if err := netWrite(shortConn{client, 3}, bytes.Repeat([]byte{byte(size)}, size)); err != nil {
+				t.Errorf("write %v: %v", size, err)
+			}
+			client.Close()
+		}()
+		data, err := netRead(server)
+		if err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(size)}, size)) {
+			t.Errorf("frame of %v bytes: got %v bytes, %v", size, len(data), err)
+		}
+		server.Close()
+	}
+	// no progress at all must fail rather than spin
+	client, server := net.Pipe()
+	defer server.Close()
+	if err := netWrite(shortConn{client, 0}, []byte("OKAY")); err == nil {
+		t.Errorf("write thru a stuck writer succeeded")
+	}
+}
+
+// FuzzNetRead feeds arbitrary client bytes to the framing parser: a frame is
+// returned only if the input holds all of it, anything else is an error.
+func FuzzNetRead(f *testing.F) {
+
+	f.Add(append(netTestHeader(4), "OKAY"...), false)
+	f.Add(netTestHeader(netMaxFrame), false)
+	f.Add(append(netTestHeader(2), netFrameRaw, 'x'), true)
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 1, netFrameKeepalive}, true)
+	f.Fuzz(func(t *testing.T, stream []byte, compress bool) {
+		limit := func() uint64 { return 1 << 20 }
+		data, err := (&netCodec{compress: compress, limit: limit}).read(pipeSend(t, stream))
+		if err != nil {
+			return
+		}
+		if uint64(len(data)) > limit() {
+			t.Errorf("frame of %v bytes read, limit %v", len(data), limit())
+		}
+		if !compress && (len(stream) < 8 || binary.BigEndian.Uint64(stream) != uint64(len(data))) {
+			t.Errorf("frame of %v bytes read from %v input bytes", len(data), len(stream))
+		}
+	})
+}
+
+// FuzzNetReadHandshake checks only the known magics are accepted.
+func FuzzNetReadHandshake(f *testing.F) {
+
+	for _, seed := range []string{"FB01", netHandshakeCompress, "FB0", "GET / HTTP/1.1", "\x16\x03\x01"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		magic, err := netReadHandshake(pipeSend(t, stream), true)
+		if err != nil {
+			return
+		}
+		if len(stream) < 4 || (magic != "FB01" && magic != netHandshakeCompress) {
+			t.Errorf("handshake %q accepted as %q", stream, magic)
+		}
+	})
+}
+
+// TestUsbConcurrentAccess stresses discovery, health checks and resets while
+// a session uses the device, meant to be run with -race.
+func TestUsbConcurrentAccess(t *testing.T) {
+
+	if usbCtx == nil {
+		ctx, err := libusb.NewContext()
+		if err != nil {
+			t.Skipf("libusb: %v", err)
+		}
+		usbCtx = ctx
+	}
+	handle := newUsbHandleMock(t, func(data []byte) [][]byte {
+		return [][]byte{append([]byte("OKAY"), data...)}
+	})
+	dev := newUsbDeviceMock(handle, 512)
+	usbDiscoveryLock.Lock()
+	usbOpenDevices++
+	usbDiscoveryLock.Unlock()
+
+	client, server := net.Pipe()
+	ctx, session := sessionStart(server, dev, 0)
+	done := make(chan error, 1)
+	go func() {
+		done <- relay(ctx, server, false, dev, dev.logger, relayOptions{drainTimeout: time.Millisecond, stats: session.stats})
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	background := func(f func()) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				f()
+			}
+		}()
+	}
+	background(func() {
+		usbDiscoveryLock.Lock()
+		usbDeviceFind(usbSelector{}, false)
+		usbDiscoveryLock.Unlock()
+	})
+	background(func() {
+		if busy, err := usbDeviceProbe(usbSelector{}); !busy || err != nil {
+			t.Errorf("probe during a session: busy %v, %v", busy, err)
+		}
+	})
+	background(func() { sessionsSnapshot() })
+	background(func() {
+		// waits for a read in progress, up to usbPollTimeout
+		usbDeviceReset(dev)
+		time.Sleep(50 * time.Millisecond)
+	})
+
+	for i := 0; i < 100; i++ {
+		command := fmt.Sprintf("getvar:var%v", i)
+		if err := netWrite(client, []byte(command)); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if response, err := netRead(client); err != nil || string(response) != "OKAY"+command {
+			t.Fatalf("%q: got %q, %v", command, response, err)
+		}
+	}
+	client.Close()
+	<-done
+	sessionEnd(session)
+	close(stop)
+	wg.Wait()
+	usbDeviceClose(dev)
+	if calls := handle.callList(); calls[len(calls)-2] != "release 0" || calls[len(calls)-1] != "close" {
+		t.Errorf("calls: %v", calls)
+	}
+}
+
+func TestUsbTransferCancel(t *testing.T) {
+
+	// a silent device, the read must notice the cancel within usbPollTimeout
+	dev := newUsbDeviceMock(newUsbHandleMock(t, nil), 512)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	var buffer []byte = make([]byte, usbResponseSize)
+	if _, err := usbRead(ctx, dev, buffer); err != context.Canceled {
+		t.Errorf("got %v, %v expected", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > usbPollTimeout*time.Millisecond+time.Second {
+		t.Errorf("read took %v", elapsed)
+	}
+}
+
+func TestUsbReadSinglePacket(t *testing.T) {
+
+	for _, test := range []struct {
+		packetSize uint16
+		length     int
+	}{
+		{512, 512},
+		{1024, 1024},
+		// a response may span several packets
+		{64, usbResponseSize},
+	} {
+		handle := newUsbHandleMock(t, nil)
+		handle.in <- []byte("OKAY")
+		dev := newUsbDeviceMock(handle, test.packetSize)
+		var buffer []byte = make([]byte, usbResponseSize)
+		n, err := usbRead(context.Background(), dev, buffer)
+		if err != nil || string(buffer[0:n]) != "OKAY" {
+			t.Errorf("packet size %v: got %q, %v", test.packetSize, buffer[0:n], err)
+		}
+		if handle.inSizes[0] != test.length {
+			t.Errorf("packet size %v: read %v bytes, %v expected", test.packetSize, handle.inSizes[0], test.length)
+		}
+	}
+}
+
+func TestUsbZeroPacketSize(t *testing.T) {
+
+	handle := newUsbHandleMock(t, func(data []byte) [][]byte { return nil })
+	dev := newUsbDeviceMock(handle, 0)
+	if err := usbCheckEndpoints(dev); err == nil || !strings.Contains(err.Error(), "zero max packet size") {
+		t.Errorf("endpoints of zero max packet size: got %v", err)
+	}
+	dev.endpointIn.MaxPacketSize = 512
+	if err := usbCheckEndpoints(dev); err == nil || !strings.Contains(err.Error(), "endpoint 01") {
+		t.Errorf("out endpoint of zero max packet size: got %v", err)
+	}
+	// a device opened anyway is written in packets of the fallback size
+	if err := usbWrite(context.Background(), dev, make([]byte, 2*usbFallbackPacketSize+1)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if sizes := handle.outSizes; len(sizes) != 3 || sizes[0] != usbFallbackPacketSize || sizes[2] != 1 {
+		t.Errorf("written in packets of %v bytes", sizes)
+	}
+}
+
+func TestUsbClaimInterface(t *testing.T) {
+
+	// fastboot as the third interface of a composite configuration
+	handle := newUsbHandleMock(t, nil)
+	dev := newUsbDeviceMock(handle, 512)
+	dev.iface = 2
+	dev.config = 2
+	dev.restoreConfig = 1
+	defer func(alt int) { usbAltSetting = alt }(usbAltSetting)
+	usbAltSetting = 1
+	if err := usbDeviceClaim(dev); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	usbDiscoveryLock.Lock()
+	usbOpenDevices++
+	usbDiscoveryLock.Unlock()
+	usbDeviceClose(dev)
+	expected := []string{"config 2", "claim 2", "alt 2 1", "release 2", "config 1", "close"}
+	if calls := handle.callList(); strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("got calls %q, %q expected", calls, expected)
+	}
+}
+
+func TestUsbClaimControlFailed(t *testing.T) {
+
+	handle := newUsbHandleMock(t, nil)
+	handle.controlErr = usbErrorPipe
+	dev := newUsbDeviceMock(handle, 512)
+	dev.iface = 2
+	dev.config = 2
+	dev.restoreConfig = 1
+	defer func(setup []usbControlRequest) { usbControlSetup = setup }(usbControlSetup)
+	usbControlSetup = []usbControlRequest{{requestType: 0x40, request: 0x01, data: []byte{0xff}}}
+	if err := usbDeviceClaim(dev); err == nil || !strings.Contains(err.Error(), "control transfer") {
+		t.Fatalf("claim: got %v, control transfer error expected", err)
+	}
+	// released like a closed device, on the configuration it was found in
+	expected := []string{"config 2", "claim 2", "control 40:01:0000:0000", "release 2", "config 1", "close"}
+	if calls := handle.callList(); strings.Join(calls, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("got calls %q, %q expected", calls, expected)
+	}
+}
+
+func TestUsbWriteStall(t *testing.T) {
+
+	handle := newUsbHandleMock(t, nil)
+	dev := newUsbDeviceMock(handle, 512)
+	handle.stalls.Store(2)
+	if err := usbWrite(context.Background(), dev, []byte("flash:boot")); err != nil {
+		t.Fatalf("write after 2 stalls: %v", err)
+	}
+	clear := "control 02:01:0000:0001"
+	if calls := handle.callList(); len(calls) != 2 || calls[0] != clear || calls[1] != clear {
+		t.Errorf("got calls %q, 2 halts cleared expected", calls)
+	}
+	if sizes := handle.outSizes; len(sizes) != 3 {
+		t.Errorf("packet sent %v times, 3 expected", len(sizes))
+	}
+
+	handle.stalls.Store(usbStallRetries + 1)
+	if err := usbWrite(context.Background(), dev, []byte("flash:boot")); !errors.Is(err, usbErrorPipe) {
+		t.Errorf("write stalling for good: got %v", err)
+	}
+}
+
+func TestUsbReadOverflow(t *testing.T) {
+
+	handle := newUsbHandleMock(t, nil)
+	dev := newUsbDeviceMock(handle, 512)
+	var buffer []byte = make([]byte, usbResponseSize)
+	// more than the packet sized read asks for
+	handle.in <- bytes.Repeat([]byte("INFO"), 200)
+	if n, err := usbRead(context.Background(), dev, buffer); !errors.Is(err, errUsbOverflow) {
+		t.Errorf("overflow: got %v bytes, %v", n, err)
+	}
+	handle.in <- []byte("OKAY")
+	if n, err := usbRead(context.Background(), dev, buffer); err != nil || string(buffer[0:n]) != "OKAY" {
+		t.Errorf("after the overflow: got %q, %v", buffer[0:n], err)
+	}
+	if sizes := handle.inSizes; len(sizes) != 2 || sizes[1] != usbReadChunk {
+		t.Errorf("read sizes %v, %v expected after the overflow", sizes, usbReadChunk)
+	}
+}
+
+// frameConn is a connection reading frame over and over, writes are dropped.
+type frameConn struct {
+	net.Conn
+	frame  []byte
+	offset int
+}
+
+func (c *frameConn) Read(data []byte) (int, error) {
+
+	n := copy(data, c.frame[c.offset:])
+	c.offset = (c.offset + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *frameConn) Write(data []byte) (int, error) {
+
+	return len(data), nil
+}
+
+// BenchmarkNetCommand reads a command and writes its response, as the relay
+// does for every getvar of a probing loop.
+func BenchmarkNetCommand(b *testing.B) {
+
+	conn := &frameConn{frame: append(netTestHeader(14), "getvar:version"...)}
+	response := []byte("OKAY0.4")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := netRead(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = netWrite(conn, response); err != nil {
+			b.Fatal(err)
+		}
+		netBufferRelease(data)
+	}
+}
+
+// BenchmarkUsbWrite writes download frames to the device with and without
+// the per-write log.
+func BenchmarkUsbWrite(b *testing.B) {
+
+	defer quietTransfers.Store(quietTransfers.Load())
+	var data []byte = make([]byte, netPoolSize)
+	for _, quiet := range []bool{false, true} {
+		b.Run(fmt.Sprintf("quiet=%v", quiet), func(b *testing.B) {
+			dev := newUsbDeviceMock(newUsbHandleMock(b, nil), 512)
+			dev.logger = log.New(io.Discard, "[mock] ", log.LstdFlags|log.Lmicroseconds)
+			quietTransfers.Store(quiet)
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if err := usbWrite(context.Background(), dev, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestNetReject(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		netReadHandshake(conn, false)
+		netReject(conn, "FB01", "relay: pre-session command failed")
+		conn.Close()
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the command sent along with the handshake is never read by the server
+	client.Write(append([]byte("FB01"), append(netTestHeader(11), "flash:super"...)...))
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header []byte = make([]byte, 4)
+	if _, err := io.ReadFull(client, header); err != nil || string(header) != "FB01" {
+		t.Fatalf("handshake: got %q, %v", header, err)
+	}
+	if response, err := netRead(client); err != nil || string(response) != "FAILrelay: pre-session command failed" {
+		t.Errorf("rejection: got %q, %v", response, err)
+	}
+	// the server shut its side down, the client needn't wait for the linger
+	start := time.Now()
+	if _, err := netRead(client); err != io.EOF {
+		t.Errorf("after the rejection: got %v, EOF expected", err)
+	}
+	if elapsed := time.Since(start); elapsed >= netCloseLinger {
+		t.Errorf("end of the connection seen after %v", elapsed)
+	}
+	client.Close()
+	<-done
+}
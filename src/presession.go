@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// preSessionRun runs command with sh -c and waits for it to succeed, e.g. to
+// switch a usb mux or assert a boot pin before the device is opened. The
+// client address and the requested serial are passed in the environment.
+func preSessionRun(command string, timeout time.Duration, client string, serial string) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"REMOTE_FASTBOOT_CLIENT="+client,
+		"REMOTE_FASTBOOT_SERIAL="+serial)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		if text := strings.TrimSpace(output.String()); text != "" {
+			return fmt.Errorf("%v: %v", err, text)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"log"
+)
+
+// flashProgress reports download progress in parse mode. A large image is
+// sent as sparse chunks, each one a download followed by flash of the same
+// partition, so the bytes of consecutive chunks are added up.
+type flashProgress struct {
+	// partition of the last flash, empty after any other command
+	partition string
+	chunks    int
+	// bytes of the partition chunks flashed so far
+	flashed uint64
+	// the download in progress
+	size       uint64
+	downloaded uint64
+	// last reported quarter of the download
+	step uint64
+}
+
+// command is called for every command sent by the client.
+func (p *flashProgress) command(command string, logger *log.Logger) {
+
+	verb, partition := fastbootParse(command)
+	switch verb {
+	case "download":
+	case "flash":
+		if partition != p.partition {
+			p.partition = partition
+			p.chunks = 0
+			p.flashed = 0
+		}
+		p.chunks++
+		p.flashed += p.size
+		p.size = 0
+		if p.chunks > 1 {
+			logger.Printf("flash %v: sparse chunk %v, %v bytes in total", partition, p.chunks, p.flashed)
+		}
+	default:
+		p.partition = ""
+	}
+}
+
+// start is called when the device accepts a download of size bytes.
+func (p *flashProgress) start(size uint64) {
+
+	p.size = size
+	p.downloaded = 0
+	p.step = 0
+}
+
+// data is called for every download frame.
+func (p *flashProgress) data(n int, logger *log.Logger) {
+
+	if p.size == 0 {
+		return
+	}
+	p.downloaded += uint64(n)
+	step := p.downloaded * 4 / p.size
+	if step <= p.step {
+		return
+	}
+	p.step = step
+	if p.partition != "" {
+		// most likely the next chunk of the same partition
+		logger.Printf("download %v%% of %v bytes, %v chunk %v, %v bytes flashed so far",
+			step*25, p.size, p.partition, p.chunks+1, p.flashed)
+	} else {
+		logger.Printf("download %v%% of %v bytes", step*25, p.size)
+	}
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Download progress for simple clients, enabled with --progress-info: a
+// client sending the control frame "relay:progress", answered OKAY by the
+// relay itself, gets "INFOrelay-progress: <sent> <total>" frames while it
+// streams a download, sent by the relay, never by the device. A relay
+// without the feature fails the frame, see control.go.
+const progressControl = "relay:progress"
+const progressInfoPrefix = "relay-progress: "
+
+// least time between two progress frames, the last one is always sent
+const progressInfoInterval = 250 * time.Millisecond
+
+// progressInfoState is the progress frames state of a session.
+type progressInfoState struct {
+	// the client asked for progress frames
+	enabled bool
+	last    time.Time
+}
+
+// progressInfo returns the progress frame to send after a download frame,
+// nil if it's not time for one. Called with r.lock held.
+func (r *relaySession) progressInfo() []byte {
+
+	if !r.progressInfoState.enabled || r.progress.size == 0 {
+		return nil
+	}
+	if r.downloadRemaining > 0 && time.Since(r.progressInfoState.last) < progressInfoInterval {
+		return nil
+	}
+	r.progressInfoState.last = time.Now()
+	total := r.progress.size
+	return []byte(fmt.Sprintf("INFO%v%v %v", progressInfoPrefix, total-r.downloadRemaining, total))
+}
+
+// clientAskProgress asks the server for progress frames, returns false if it
+// doesn't send them.
+func clientAskProgress(conn net.Conn) (bool, error) {
+
+	// the handshake already told control frames aren't known
+	err := errClientRemote
+	if clientControl(conn) {
+		_, _, err = clientCommand(conn, progressControl)
+	}
+	if errors.Is(err, errClientRemote) {
+		fmt.Printf("Server doesn't report progress\n")
+		return false, nil
+	}
+	return err == nil, err
+}
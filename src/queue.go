@@ -0,0 +1,349 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// clients waiting for the device at most, further ones are closed at once
+const queueMax = 32
+
+// time to tell a client its queue timeout expired
+const queueFailGrace = time.Second
+
+// queueListener hands connections out one at a time like a listener limited
+// to a single connection, but clients arriving while a session is served are
+// kept in a waiting queue: their handshake is answered and their first
+// command gets INFO "queued, position N" until their turn. The session then
+// starts as if the client had just connected, the command is replayed to it.
+type queueListener struct {
+	ln      net.Listener
+	timeout time.Duration
+	// time to send the handshake, 0 for no limit
+	handshakeTimeout time.Duration
+	compress         bool
+	lock             sync.Mutex
+	// set while Accept waits for a connection
+	idle    bool
+	ready   chan acceptResult
+	waiting []*queueEntry
+}
+
+type queueEntry struct {
+	conn net.Conn
+	// closed when the entry is taken off the queue by Accept
+	turn chan struct{}
+	// the connection to serve, nil if the client is gone
+	served chan net.Conn
+	// signalled when the queue position changes
+	moved chan struct{}
+}
+
+func newQueueListener(ln net.Listener, timeout time.Duration, handshakeTimeout time.Duration, compress bool) *queueListener {
+
+	q := &queueListener{
+		ln:               ln,
+		timeout:          timeout,
+		handshakeTimeout: handshakeTimeout,
+		compress:         compress,
+		ready:            make(chan acceptResult),
+	}
+	go q.serve()
+	return q
+}
+
+func (q *queueListener) serve() {
+
+	for {
+		conn, err := q.ln.Accept()
+		q.lock.Lock()
+		if q.idle && len(q.waiting) == 0 {
+			q.idle = false
+			q.lock.Unlock()
+			q.ready <- acceptResult{conn, err}
+		} else if err != nil {
+			q.lock.Unlock()
+			log.Printf("tcp: %v", err)
+		} else if len(q.waiting) >= queueMax {
+			q.lock.Unlock()
+			log.Printf("tcp: %v: queue is full, closed", conn.RemoteAddr())
+			conn.Close()
+		} else {
+			entry := &queueEntry{
+				conn:   conn,
+				turn:   make(chan struct{}),
+				served: make(chan net.Conn, 1),
+				moved:  make(chan struct{}, 1),
+			}
+			q.waiting = append(q.waiting, entry)
+			log.Printf("tcp: %v queued, position %v", conn.RemoteAddr(), len(q.waiting))
+			q.lock.Unlock()
+			go q.wait(entry)
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+// Accept returns the first client of the queue, or the next one to connect
+// if nobody waits.
+func (q *queueListener) Accept() (net.Conn, error) {
+
+	for {
+		q.lock.Lock()
+		if len(q.waiting) == 0 {
+			q.idle = true
+			q.lock.Unlock()
+			result := <-q.ready
+			return result.conn, result.err
+		}
+		entry := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.notifyMoved()
+		q.lock.Unlock()
+
+		close(entry.turn)
+		if conn := <-entry.served; conn != nil {
+			return conn, nil
+		}
+	}
+}
+
+func (q *queueListener) Close() error {
+
+	return q.ln.Close()
+}
+
+func (q *queueListener) Addr() net.Addr {
+
+	return q.ln.Addr()
+}
+
+// notifyMoved tells the waiting clients their positions changed, called
+// with q.lock held.
+func (q *queueListener) notifyMoved() {
+
+	for _, entry := range q.waiting {
+		select {
+		case entry.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// leave takes entry off the queue, returns false if Accept already took it.
+func (q *queueListener) leave(entry *queueEntry) bool {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, waiting := range q.waiting {
+		if waiting == entry {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			q.notifyMoved()
+			return true
+		}
+	}
+	return false
+}
+
+func (q *queueListener) position(entry *queueEntry) int {
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, waiting := range q.waiting {
+		if waiting == entry {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// wait answers the handshake of a queued client and keeps it informed of its
+// position until its turn or the queue timeout.
+func (q *queueListener) wait(entry *queueEntry) {
+
+	conn := entry.conn
+	deadline := time.Now().Add(q.timeout)
+	if q.handshakeTimeout > 0 && q.timeout > q.handshakeTimeout {
+		conn.SetDeadline(time.Now().Add(q.handshakeTimeout))
+	} else {
+		conn.SetDeadline(deadline)
+	}
+	// the header is replayed as sent, the session reads and answers it again
+	var header []byte = make([]byte, 4)
+	n, err := io.ReadFull(conn, header)
+	magic, err := netHandshakeAnswer(header[0:n], q.compress, err)
+	if err == nil {
+		err = netWriteHandshake(conn, magic)
+	}
+	if err != nil {
+		log.Printf("tcp: %v: %v", conn.RemoteAddr(), err)
+		q.drop(entry)
+		return
+	}
+	// the connection outlives the timer below, which answers the client as
+	// the queue timeout expires
+	conn.SetDeadline(deadline.Add(queueFailGrace))
+	codec := &netCodec{compress: netBaseMagic(magic) == netHandshakeCompress}
+
+	// whatever the client sends meanwhile (its first command) is kept
+	// to be replayed to the session
+	chunks := make(chan []byte)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			var buffer []byte = make([]byte, 4096)
+			n, err := conn.Read(buffer)
+			if n > 0 {
+				select {
+				case chunks <- buffer[0:n]:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	informed := false
+	inform := func() error {
+		position := q.position(entry)
+		if position == 0 {
+			return nil
+		}
+		message := fmt.Sprintf("INFOqueued, position %v, waiting up to %v", position, time.Until(deadline).Round(time.Second))
+		return codec.write(conn, []byte(message))
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case chunk := <-chunks:
+			pending = append(pending, chunk...)
+			// INFO is only expected once the client waits for a response
+			if !informed && netFrameComplete(pending) {
+				informed = true
+				err = inform()
+			}
+		case <-entry.moved:
+			if informed {
+				err = inform()
+			}
+		case err = <-readErr:
+			err = fmt.Errorf("left the queue: %v", err)
+		case <-timer.C:
+			if q.leave(entry) {
+				log.Printf("tcp: %v: still busy after %v in the queue, closed", conn.RemoteAddr(), q.timeout)
+				conn.SetDeadline(time.Now().Add(queueFailGrace))
+				if err = codec.write(conn, []byte("FAILrelay: device still busy")); err != nil {
+					log.Printf("tcp: %v", err)
+				}
+				conn.Close()
+				return
+			}
+		case <-entry.turn:
+			// stop the reader, bytes it has read are not lost
+			conn.SetReadDeadline(time.Now())
+			for done := false; !done; {
+				select {
+				case chunk := <-chunks:
+					pending = append(pending, chunk...)
+				case <-readErr:
+					done = true
+				}
+			}
+			conn.SetDeadline(time.Time{})
+			entry.served <- &queuedConn{Conn: conn, replay: append(header, pending...), swallow: len(magic)}
+			return
+		}
+		if err != nil {
+			log.Printf("tcp: %v: %v", conn.RemoteAddr(), err)
+			q.drop(entry)
+			return
+		}
+	}
+}
+
+// drop closes the connection of a client gone while waiting.
+func (q *queueListener) drop(entry *queueEntry) {
+
+	entry.conn.Close()
+	if !q.leave(entry) {
+		<-entry.turn
+		entry.served <- nil
+	}
+}
+
+// netFrameComplete tells whether data holds at least one whole frame.
+func netFrameComplete(data []byte) bool {
+
+	return len(data) >= 8 && uint64(len(data)-8) >= binary.BigEndian.Uint64(data[0:8])
+}
+
+// queuedConn is the connection of a client which waited in the queue: the
+// handshake and the data it already sent are read again, the handshake
+// answer, already sent, is dropped.
+type queuedConn struct {
+	net.Conn
+	replay  []byte
+	swallow int
+}
+
+func (c *queuedConn) Read(b []byte) (int, error) {
+
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *queuedConn) Write(b []byte) (int, error) {
+
+	if c.swallow > 0 {
+		n := len(b)
+		if n > c.swallow {
+			n = c.swallow
+		}
+		c.swallow -= n
+		if n == len(b) {
+			return n, nil
+		}
+		written, err := c.Conn.Write(b[n:])
+		return n + written, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *queuedConn) SetKeepAlive(keepalive bool) error {
+
+	if tcp, ok := c.Conn.(netKeepAliveConn); ok {
+		return tcp.SetKeepAlive(keepalive)
+	}
+	return nil
+}
+
+func (c *queuedConn) SetKeepAlivePeriod(period time.Duration) error {
+
+	if tcp, ok := c.Conn.(netKeepAliveConn); ok {
+		return tcp.SetKeepAlivePeriod(period)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueTimeout(t *testing.T) {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQueueListener(ln, 300*time.Millisecond, 0, false)
+	defer q.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := q.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	// the session holding the device, queued if it comes before Accept
+	// waits for it
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("FB01"))
+	defer (<-accepted).Close()
+
+	// a slow handshake leaves less of the queue timeout, not none of the answer
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	time.Sleep(100 * time.Millisecond)
+	second.Write([]byte("FB01"))
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var header []byte = make([]byte, 4)
+	if _, err := io.ReadFull(second, header); err != nil || string(header) != "FB01" {
+		t.Fatalf("handshake: got %q, %v", header, err)
+	}
+	if err := netWrite(second, []byte("getvar:product")); err != nil {
+		t.Fatal(err)
+	}
+	var responses []string
+	for {
+		response, err := netRead(second)
+		if err != nil {
+			break
+		}
+		responses = append(responses, string(response))
+	}
+	if len(responses) == 0 || responses[len(responses)-1] != "FAILrelay: device still busy" ||
+		!strings.HasPrefix(responses[0], "INFOqueued, position 1") {
+		t.Errorf("queued client got %q", responses)
+	}
+}
+
+func TestQueueAcceptMagic(t *testing.T) {
+
+	defer func(magics []string) { netAcceptMagics = magics }(netAcceptMagics)
+	netAcceptMagics = []string{"XYZ1"}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := newQueueListener(ln, 5*time.Second, 0, false)
+	defer q.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := q.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	first.Write([]byte("XYZ1"))
+	(<-accepted).Close()
+
+	second, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(5 * time.Second))
+	second.Write([]byte("XYZ1"))
+	var header []byte = make([]byte, 4)
+	if _, err := io.ReadFull(second, header); err != nil || string(header) != "FB01" {
+		t.Fatalf("handshake: got %q, %v", header, err)
+	}
+	if err := netWrite(second, []byte("getvar:product")); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := netRead(second); err != nil || !strings.HasPrefix(string(response), "INFOqueued") {
+		t.Fatalf("queued: got %q, %v", response, err)
+	}
+
+	// its turn: the session reads the handshake and the command again
+	conn, err := q.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	magic, err := netReadHandshake(conn, false)
+	if err != nil || magic != "FB01" {
+		t.Fatalf("replayed handshake: got %q, %v", magic, err)
+	}
+	if err := netWriteHandshake(conn, magic); err != nil {
+		t.Fatal(err)
+	}
+	if command, err := netRead(conn); err != nil || string(command) != "getvar:product" {
+		t.Fatalf("replayed command: got %q, %v", command, err)
+	}
+	if err := netWrite(conn, []byte("OKAYproduct")); err != nil {
+		t.Fatal(err)
+	}
+	// the handshake answer isn't sent twice
+	if response, err := netRead(second); err != nil || string(response) != "OKAYproduct" {
+		t.Errorf("response: got %q, %v", response, err)
+	}
+}
@@ -0,0 +1,104 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// quirkProfiles are the --quirk profiles read from --quirk-file: values of
+// long options known to work for a device family, options given on the
+// command line or in the environment take precedence. None is built in, no
+// values have been verified for a family to ship them as known to work.
+var quirkProfiles = map[string]map[string]string{}
+
+// quirkSet names the profile having set an option, the config file still
+// overrides it, see applyConfig.
+var quirkSet = map[string]string{}
+
+// quirkLoad adds the profiles of the file at path to quirkProfiles: "[name]"
+// lines start a profile followed by its "option = value" lines, # starts a
+// comment.
+func quirkLoad(path string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var profile map[string]string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = strings.TrimSpace(text[0:i])
+		}
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			name := strings.TrimSpace(text[1 : len(text)-1])
+			if name == "" {
+				return fmt.Errorf("%v:%v: empty profile name", path, line)
+			}
+			profile = map[string]string{}
+			quirkProfiles[name] = profile
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%v:%v: \"option = value\" expected", path, line)
+		}
+		if profile == nil {
+			return fmt.Errorf("%v:%v: option outside of a [profile]", path, line)
+		}
+		profile[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return scanner.Err()
+}
+
+// quirkApply sets the options of the profile name not given on the command
+// line or in the environment.
+func quirkApply(name string) error {
+
+	if len(quirkProfiles) == 0 {
+		return fmt.Errorf("quirk %v: no built-in profiles, load it with --quirk-file", name)
+	}
+	profile, ok := quirkProfiles[name]
+	if !ok {
+		var names []string
+		for name := range quirkProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown quirk profile %q, known: %v", name, strings.Join(names, ", "))
+	}
+	var options []string
+	for option := range profile {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	for _, option := range options {
+		opt := optionLookup(option)
+		if opt == nil || option == "quirk" || option == "quirk-file" {
+			return fmt.Errorf("quirk %v: bad option %q", name, option)
+		}
+		if opt.Seen() || envSet[option] {
+			log.Printf("quirk %v: %v ignored, given explicitly", name, option)
+			continue
+		}
+		if err := opt.Value().Set(profile[option], opt); err != nil {
+			return fmt.Errorf("quirk %v: bad %v %q: %v", name, option, profile[option], err)
+		}
+		quirkSet[option] = name
+		log.Printf("quirk %v: %v = %v", name, option, profile[option])
+	}
+	return nil
+}
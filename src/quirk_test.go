@@ -0,0 +1,56 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestQuirkLoad(t *testing.T) {
+
+	defer func(profiles map[string]map[string]string) { quirkProfiles = profiles }(quirkProfiles)
+	tests := []struct {
+		file string
+		err  string
+	}{
+		{"# rigs\n[rig-3]\nalt-setting = 1 # second one\ncontrol-setup = 40:01:0000:0000:01\n", ""},
+		{"alt-setting = 1\n", "option outside of a [profile]"},
+		{"[ ]\n", "empty profile name"},
+		{"[rig-3]\nalt-setting\n", "\"option = value\" expected"},
+	}
+	for _, test := range tests {
+		quirkProfiles = map[string]map[string]string{}
+		path := filepath.Join(t.TempDir(), "quirks")
+		if err := os.WriteFile(path, []byte(test.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := quirkLoad(path)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got %v, error with %q expected", test.file, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.file, err)
+			continue
+		}
+		profile := quirkProfiles["rig-3"]
+		if len(profile) != 2 || profile["alt-setting"] != "1" || profile["control-setup"] != "40:01:0000:0000:01" {
+			t.Errorf("%q: got %v", test.file, quirkProfiles)
+		}
+	}
+}
+
+func TestQuirkApplyNoProfiles(t *testing.T) {
+
+	defer func(profiles map[string]map[string]string) { quirkProfiles = profiles }(quirkProfiles)
+	quirkProfiles = map[string]map[string]string{}
+	if err := quirkApply("pixel"); err == nil || !strings.Contains(err.Error(), "--quirk-file") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per source ip: limit attempts per interval,
+// a burst of up to limit is allowed.
+type rateLimiter struct {
+	lock     sync.Mutex
+	limit    float64
+	interval time.Duration
+	buckets  map[string]*rateBucket
+}
+
+func newRateLimiter(limit int, interval time.Duration) *rateLimiter {
+
+	return &rateLimiter{limit: float64(limit), interval: interval, buckets: map[string]*rateBucket{}}
+}
+
+func (rl *rateLimiter) refill(b *rateBucket, now time.Time) {
+
+	b.tokens += now.Sub(b.last).Seconds() / rl.interval.Seconds() * rl.limit
+	if b.tokens > rl.limit {
+		b.tokens = rl.limit
+	}
+	b.last = now
+}
+
+// allow takes a token of the address ip, returns false if there is none.
+func (rl *rateLimiter) allow(addr net.Addr) bool {
+
+	ip := addr.String()
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		ip = tcp.IP.String()
+	}
+	now := time.Now()
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	b, ok := rl.buckets[ip]
+	if !ok {
+		// forget sources whose buckets are full again
+		for key, other := range rl.buckets {
+			if rl.refill(other, now); other.tokens >= rl.limit {
+				delete(rl.buckets, key)
+			}
+		}
+		b = &rateBucket{tokens: rl.limit, last: now}
+		rl.buckets[ip] = b
+	}
+	rl.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
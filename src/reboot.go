@@ -0,0 +1,39 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// usbRebootAll sends "reboot" to every device matching sel, one by one, and
+// prints the result of each. Returns the number of devices that failed.
+func usbRebootAll(sel usbSelector) int {
+
+	failed := 0
+	devices := usbDeviceList(sel)
+	if len(devices) == 0 {
+		fmt.Printf("no matching devices\n")
+	}
+	for _, found := range devices {
+		name := usbDeviceDescription(found)
+		dev, err := usbDeviceOpen(usbSelector{bus: found.bus, address: found.address})
+		if err == nil {
+			_, err = usbCommand(dev, "reboot")
+			// the device may be gone before its OKAY is read
+			if errors.Is(err, usbErrorNoDevice) || errors.Is(err, usbErrorIO) {
+				err = nil
+			}
+			usbDeviceClose(dev)
+		}
+		if err != nil {
+			fmt.Printf("%v: reboot failed: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%v: rebooted\n", name)
+	}
+	return failed
+}
@@ -0,0 +1,146 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// Soft reboot, enabled with --reboot-resume: a client sending the control
+// frame "relay:reboot-bootloader" has the device rebooted into the bootloader
+// within its session. The OKAY of the device is held back, the relay waits
+// for the device to come back, serves it on the same connection and answers
+// OKAY once it's there, or FAIL if it isn't in time. A relay without the
+// feature fails the frame, see control.go.
+const rebootResumeControl = "relay:reboot-bootloader"
+
+const rebootResumeCommand = "reboot-bootloader"
+
+var errRebootResume = errors.New("device rebooting, session resumed once it's back")
+
+// rebootResumeReplace turns the control frame data into the reboot command
+// sent to the device, returns false if it isn't the control frame.
+func (r *relaySession) rebootResumeReplace(data *[]byte) bool {
+
+	if !r.opts.rebootResume || !r.opts.control || string(*data) != rebootResumeControl {
+		return false
+	}
+	*data = append((*data)[0:0], rebootResumeCommand...)
+	return true
+}
+
+// rebootResumeHold tells whether the device response must be held back: the
+// OKAY of the reboot is answered once the device is back. Called with r.lock
+// held.
+func (r *relaySession) rebootResumeHold(data []byte) bool {
+
+	if !r.rebootPending || len(data) < 4 {
+		return false
+	}
+	switch string(data[0:4]) {
+	case "OKAY":
+		r.logger.Printf("device rebooting into the bootloader, session held")
+		return true
+	case "FAIL":
+		r.rebootPending = false
+	}
+	return false
+}
+
+// rebootResumeSelector returns sel matching the device again after it
+// rebooted, its address changes with the new enumeration.
+func rebootResumeSelector(sel usbSelector, dev *usbDevice) usbSelector {
+
+	sel.bus, sel.address = 0, 0
+	if dev.serial != "" {
+		sel.serial = dev.serial
+	}
+	return sel
+}
+
+// rebootResumeWait waits up to timeout for the device matching sel to come
+// back and answers the client accordingly, returns the device opened.
+func rebootResumeWait(ctx context.Context, conn net.Conn, compress bool, sel usbSelector, timeout time.Duration) (*usbDevice, error) {
+
+	codec := &netCodec{compress: compress}
+	log.Printf("waiting up to %v for the device to come back", timeout)
+	if err := codec.write(conn, []byte("INFOrelay: waiting for the device")); err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	retry := newBackoff(500*time.Millisecond, 5*time.Second)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry.next()):
+		}
+		dev, err := usbDeviceOpen(sel)
+		if err == nil {
+			dev.logger.Printf("device back after reboot, session resumed")
+			eventPublish(eventConnected, usbDeviceName(dev), conn.RemoteAddr().String(), usbDeviceDescription(dev))
+			if err = codec.write(conn, []byte("OKAY")); err != nil {
+				usbDeviceClose(dev)
+				return nil, err
+			}
+			return dev, nil
+		}
+		if time.Now().After(deadline) {
+			reason := fmt.Sprintf("device not back after %v", timeout)
+			if err := codec.write(conn, []byte("FAILrelay: "+reason)); err != nil {
+				log.Printf("tcp: %v", err)
+			} else {
+				netDrain(conn)
+			}
+			return nil, fmt.Errorf("%v: %v", reason, err)
+		}
+	}
+}
+
+// clientRebootBootloader reboots the device into the bootloader and returns
+// the connection to go on with once it's back: conn if the server resumes the
+// session, see --reboot-resume, else a new one and conn is closed.
+func clientRebootBootloader(address string, conn net.Conn) (net.Conn, error) {
+
+	fmt.Printf("Rebooting into the bootloader\n")
+	if clientControl(conn) {
+		if err := netWrite(conn, []byte(rebootResumeControl)); err != nil {
+			return nil, err
+		}
+		token, message, err := clientReply(conn, rebootResumeControl)
+		if err != nil {
+			return nil, err
+		}
+		if token == "OKAY" {
+			return conn, nil
+		}
+		if message != relayControlOff {
+			return nil, fmt.Errorf("%v: %v", rebootResumeCommand, message)
+		}
+	}
+	fmt.Printf("Server doesn't resume sessions across reboots, reconnecting\n")
+	// the device may be gone before its OKAY reaches us
+	_, _, err := clientCommand(conn, rebootResumeCommand)
+	conn.Close()
+	if errors.Is(err, errClientRemote) {
+		return nil, err
+	}
+	deadline := time.Now().Add(clientRebootTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(2 * time.Second)
+		if conn, err = clientConnect(address); err != nil {
+			continue
+		}
+		if _, _, err = clientCommand(conn, "getvar:version"); err == nil {
+			return conn, nil
+		}
+		conn.Close()
+	}
+	return nil, fmt.Errorf("device not back in the bootloader after %v", clientRebootTimeout)
+}
@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const registerTimeout = 5 * time.Second
+
+// on failure registration is retried sooner than the regular heartbeat
+const registerRetryInterval = 5 * time.Second
+
+type registration struct {
+	// the first of addresses
+	Address   string          `json:"address"`
+	Addresses []string        `json:"addresses"`
+	Devices   []usbDeviceInfo `json:"devices"`
+}
+
+// registerAddresses returns the addresses of listeners the registry at
+// registryURL is told: a listener on the unspecified address ("[::]:5554")
+// is announced with host if set, else the local address the registry is
+// reached from, the one it's likely to reach the server at.
+func registerAddresses(listeners []net.Listener, registryURL string, host string) ([]string, error) {
+
+	var addresses []string
+	for _, ln := range listeners {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || !addr.IP.IsUnspecified() {
+			addresses = append(addresses, ln.Addr().String())
+			continue
+		}
+		if host == "" {
+			local, err := registerLocalHost(registryURL)
+			if err != nil {
+				return nil, fmt.Errorf("find the address the registry reaches: %v, set --register-address", err)
+			}
+			host = local
+		}
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(addr.Port)))
+	}
+	return addresses, nil
+}
+
+// registerLocalHost returns the local address routed to the registry at
+// registryURL, no packet is sent.
+func registerLocalHost(registryURL string) (string, error) {
+
+	u, err := url.Parse(registryURL)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+func registerSend(method string, url string, payload registration) error {
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: registerTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("registry answered %v", resp.Status)
+	}
+	return nil
+}
+
+// registerServe announces the server addresses and its devices to the
+// registry at url: POST on start and every interval as a heartbeat, DELETE
+// with the same payload on shutdown. It runs in background and never blocks
+// serving.
+func registerServe(url string, addresses []string, sel usbSelector, interval time.Duration) {
+
+	// device serials are read by opening the devices, so during a session
+	// the last known list is announced instead
+	var lock sync.Mutex
+	var devices []usbDeviceInfo = []usbDeviceInfo{}
+	payload := func() registration {
+		lock.Lock()
+		defer lock.Unlock()
+		if !sessionActive() {
+			devices = []usbDeviceInfo{}
+			for _, dev := range usbDeviceList(sel) {
+				devices = append(devices, usbDeviceInfoOf(dev))
+			}
+		}
+		return registration{Address: addresses[0], Addresses: addresses, Devices: devices}
+	}
+
+	atExit(func() {
+		if err := registerSend(http.MethodDelete, url, payload()); err != nil {
+			log.Printf("registry: deregister failed: %v", err)
+		}
+	})
+
+	log.Printf("registering at %v as %v", url, strings.Join(addresses, ", "))
+	go func() {
+		for {
+			wait := interval
+			if err := registerSend(http.MethodPost, url, payload()); err != nil {
+				log.Printf("registry: %v", err)
+				wait = registerRetryInterval
+			}
+			time.Sleep(wait)
+		}
+	}()
+}
@@ -0,0 +1,42 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestRegisterAddresses(t *testing.T) {
+
+	wildcard, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wildcard.Close()
+	loopback, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loopback.Close()
+	port := strconv.Itoa(wildcard.Addr().(*net.TCPAddr).Port)
+	listeners := []net.Listener{wildcard, loopback}
+
+	addresses, err := registerAddresses(listeners, "http://127.0.0.1:8080/relays", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// reached from loopback, the registry reaches the server there
+	if len(addresses) != 2 || addresses[0] != "127.0.0.1:"+port || addresses[1] != loopback.Addr().String() {
+		t.Errorf("got %q", addresses)
+	}
+	addresses, err = registerAddresses(listeners, "http://127.0.0.1:8080/relays", "rig-7.lab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addresses) != 2 || addresses[0] != "rig-7.lab:"+port {
+		t.Errorf("with --register-address: got %q", addresses)
+	}
+}
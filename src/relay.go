@@ -0,0 +1,811 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// read buffer for device output, a multiple of any packet size so a device
+// sending a full packet never overflows it
+const usbReadChunk = 64 * 1024
+
+type relayOptions struct {
+	minCommandInterval time.Duration
+	drainTimeout       time.Duration
+	parse              bool
+	readonly           bool
+	policy             partitionPolicy
+	// answer FAIL to a command failed by a usb error instead of ending the session
+	keepOnError bool
+	// characters of FAIL/INFO/TEXT messages to log in parse mode, 0 for none
+	responseLogMax int
+	// idle time after which a keepalive is sent, 0 to disable
+	keepalive time.Duration
+	// frame size of forwarded upload data, 0 to forward every usb read as is
+	coalesce int
+	// limit of bytes the client may send to the device, 0 for none
+	maxSessionBytes uint64
+	// download throughput floor in bytes/s measured over stallWindow, 0 for none
+	minDownloadRate uint64
+	stallWindow     time.Duration
+	// statistics of the session, may be nil
+	stats *sessionStats
+	// session audit trail, may be nil
+	audit *auditLog
+	// recent packets of the session, may be nil
+	forensic *forensicBuffer
+	// hold every command until acknowledged by the operator
+	step bool
+	// answer repeated getvar of fastbootConstantVars without the device
+	cacheGetvar bool
+	// device name of the published events
+	device string
+	// check downloads against the sha256 announced by the client
+	verifyDownload bool
+	// send download progress to clients asking for it
+	progressInfo bool
+	// resume the session after a reboot into the bootloader asked for by the
+	// client
+	rebootResume bool
+	// the client negotiated control frames in the handshake, see control.go
+	control bool
+}
+
+func (opts relayOptions) validate() error {
+
+	if !opts.parse && (len(opts.policy.allow) > 0 || len(opts.policy.deny) > 0) {
+		return fmt.Errorf("partition policy requires --parse")
+	}
+	if opts.coalesce < 0 {
+		return fmt.Errorf("bad coalesce frame size %v", opts.coalesce)
+	}
+	if opts.keepalive < 0 || (opts.keepalive > 0 && opts.keepalive < time.Second) {
+		return fmt.Errorf("bad keepalive interval %v, at least 1s expected", opts.keepalive)
+	}
+	if opts.minDownloadRate > 0 && !opts.parse {
+		return fmt.Errorf("minimum download rate requires --parse")
+	}
+	if opts.verifyDownload && !opts.parse {
+		return fmt.Errorf("download verification requires --parse")
+	}
+	if opts.progressInfo && !opts.parse {
+		return fmt.Errorf("download progress requires --parse")
+	}
+	if opts.minDownloadRate > 0 && opts.stallWindow < time.Second {
+		return fmt.Errorf("bad stall window %v, at least 1s expected", opts.stallWindow)
+	}
+	return nil
+}
+
+// reject returns the reason command must not be forwarded, empty if it may be.
+func (opts relayOptions) reject(command string) string {
+
+	if opts.readonly && !fastbootIsReadOnly(command) {
+		return "command is not allowed, relay is read-only"
+	}
+	return opts.policy.check(command)
+}
+
+// netKeepAliveConn is a connection with tcp keepalive: net.TCPConn, the
+// splitConn and queuedConn wrapping it.
+type netKeepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(period time.Duration) error
+}
+
+// relaySession is the state shared by the client to device and the device to
+// client goroutines of a session.
+type relaySession struct {
+	conn   net.Conn
+	codec  *netCodec
+	dev    usbTransport
+	opts   relayOptions
+	logger *log.Logger
+
+	// serializes frames sent to the client
+	netLock sync.Mutex
+	// unix time in ns of the last frame sent or received
+	lastFrame atomic.Int64
+
+	lock sync.Mutex
+	// last command sent to the device
+	command string
+	// incremented with every command
+	commandSeq uint64
+	// download bytes the device still expects from the client
+	downloadRemaining uint64
+	// the rest of a failed download is dropped
+	downloadFailed bool
+	// reported in parse mode
+	progress flashProgress
+	// bytes sent by the client to the device
+	deviceBytes uint64
+	// set when a session limit ends the session
+	limitErr error
+	// the usb error ending the session
+	usbErr error
+	// responses of constant variables by command, see opts.cacheGetvar
+	getvarCache map[string][]byte
+	// the getvar forwarded to the device whose OKAY is to be cached
+	pendingGetvar string
+	// see opts.verifyDownload
+	verify verifyState
+	// see opts.progressInfo
+	progressInfoState progressInfoState
+	// the reboot of opts.rebootResume is in progress
+	rebootPending bool
+}
+
+// usbErrorFatal tells whether the session can't continue after err.
+func usbErrorFatal(err error) bool {
+
+	return errors.Is(err, usbErrorNoDevice) || errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// deviceLeft tells whether err is the device disconnecting after a command
+// expected to end the session, which is logged as a normal end.
+func (r *relaySession) deviceLeft(err error) bool {
+
+	if !errors.Is(err, usbErrorNoDevice) && !errors.Is(err, usbErrorIO) {
+		return false
+	}
+	r.lock.Lock()
+	command := r.command
+	resume := r.rebootPending
+	r.lock.Unlock()
+	if !fastbootEndsSession(command) {
+		return false
+	}
+	if resume {
+		r.lock.Lock()
+		r.limitErr = errRebootResume
+		r.lock.Unlock()
+		r.logger.Printf("device disconnected after %q, waiting for it", command)
+	} else {
+		r.logger.Printf("device disconnected after %q, session ended", command)
+	}
+	r.opts.audit.Printf("device disconnected after %q", command)
+	eventPublish(eventRebooted, r.opts.device, r.conn.RemoteAddr().String(), command)
+	return true
+}
+
+// usbFailed records err as the usb error ending the session.
+func (r *relaySession) usbFailed(err error) {
+
+	r.lock.Lock()
+	if r.usbErr == nil {
+		r.usbErr = err
+	}
+	r.lock.Unlock()
+}
+
+// fail answers the current command with a synthetic FAIL after a usb error,
+// returns false if the session must end instead.
+func (r *relaySession) fail(err error) bool {
+
+	if !r.opts.keepOnError || usbErrorFatal(err) {
+		return false
+	}
+	r.logger.Printf("usb: %v, failing the command", err)
+	if err = r.write([]byte("FAILrelay: usb error: " + err.Error())); err != nil {
+		r.logger.Printf("tcp: %v", err)
+		return false
+	}
+	return true
+}
+
+var errSessionBytes = errors.New("session byte limit exceeded")
+var errDownloadStalled = errors.New("download stalled")
+var errUploadTruncated = errors.New("upload truncated by a usb timeout or overflow")
+
+// relay forwards fastboot packets between client and device until either side
+// fails or ctx is cancelled. Each direction is copied by its own goroutine so
+// device output (e.g. INFO lines) reaches the client as soon as it's produced,
+// independently of what the client is sending. Returns errSessionBytes if the
+// session was ended for sending too much, errDownloadStalled if a download
+// was too slow, errDownloadCorrupt if it didn't match its sha256,
+// errUploadTruncated if upload data may have been lost, the device state is
+// unknown then. A usb error ending the session is returned too.
+func relay(ctx context.Context, conn net.Conn, compress bool, dev usbTransport, logger *log.Logger, opts relayOptions) error {
+
+	r := &relaySession{
+		conn:   conn,
+		codec:  &netCodec{compress: compress},
+		dev:    dev,
+		opts:   opts,
+		logger: logger,
+	}
+	r.codec.limit = r.frameLimit
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the deadline unblocks netRead/netWrite on cancel, the connection is
+	// closed by the caller once drained
+	unblocked := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		conn.SetDeadline(time.Now())
+		close(unblocked)
+	}()
+
+	if compress {
+		r.logger.Printf("protocol version 1, compressed")
+	} else {
+		r.logger.Printf("protocol version 1")
+	}
+	r.lastFrame.Store(time.Now().UnixNano())
+	if opts.keepalive > 0 {
+		if tcp, ok := conn.(netKeepAliveConn); ok {
+			tcp.SetKeepAlive(true)
+			tcp.SetKeepAlivePeriod(opts.keepalive)
+		}
+		if compress {
+			go r.keepalive(ctx)
+		}
+	}
+	if opts.minDownloadRate > 0 {
+		go r.watchDownload(ctx, cancel)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		r.clientToDevice(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		r.deviceToClient(ctx)
+	}()
+	wg.Wait()
+	<-unblocked
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.limitErr == errRebootResume {
+		// the client stays connected
+		conn.SetDeadline(time.Time{})
+	} else {
+		netDrain(conn)
+	}
+	r.codec.logStats(r.logger)
+	if r.limitErr == nil && r.usbErr != nil {
+		return fmt.Errorf("usb error: %w", r.usbErr)
+	}
+	return r.limitErr
+}
+
+func (r *relaySession) clientToDevice(ctx context.Context) {
+
+	var lastCommand time.Time
+	var data []byte
+	var err error
+	for {
+		// nothing keeps the previous frame past its iteration
+		netBufferRelease(data)
+		data, err = r.codec.read(r.conn)
+		r.lastFrame.Store(time.Now().UnixNano())
+		if err == io.EOF {
+			r.logger.Printf("tcp: client disconnected")
+			// let the device finish, its trailing output is still forwarded
+			select {
+			case <-time.After(r.opts.drainTimeout):
+			case <-ctx.Done():
+			}
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logger.Printf("tcp: %v", err)
+			}
+			return
+		}
+		r.opts.forensic.packet(forensicToDevice, data)
+
+		r.lock.Lock()
+		r.deviceBytes += uint64(len(data))
+		if r.opts.maxSessionBytes > 0 && r.deviceBytes > r.opts.maxSessionBytes {
+			r.limitErr = errSessionBytes
+			r.lock.Unlock()
+			r.logger.Printf("session aborted: client sent more than %v bytes", r.opts.maxSessionBytes)
+			r.opts.audit.Printf("session byte limit %v exceeded", r.opts.maxSessionBytes)
+			if err = r.write([]byte("FAILrelay: session byte limit exceeded")); err != nil {
+				r.logger.Printf("tcp: %v", err)
+			}
+			return
+		}
+		download := r.downloadRemaining > 0
+		resume := !download && r.rebootResumeReplace(&data)
+		dropped := false
+		control := false
+		var progress []byte
+		if download {
+			// payload of a download, the device answers after the last byte
+			if uint64(len(data)) > r.downloadRemaining {
+				r.logger.Printf("tcp: download overrun: %v bytes, %v expected", len(data), r.downloadRemaining)
+				r.opts.forensic.fail("download overrun")
+				r.lock.Unlock()
+				return
+			}
+			r.downloadRemaining -= uint64(len(data))
+			r.verifyData(data)
+			dropped = r.downloadFailed
+			if r.opts.parse {
+				r.progress.data(len(data), r.logger)
+			}
+			progress = r.progressInfo()
+		} else if relayIsControl(data) {
+			control = true
+		}
+		r.lock.Unlock()
+		if dropped {
+			continue
+		}
+		if control {
+			if err = r.write(r.control(string(data))); err != nil {
+				r.logger.Printf("tcp: %v", err)
+				return
+			}
+			continue
+		}
+		if progress != nil {
+			if err = r.write(progress); err != nil {
+				r.logger.Printf("tcp: %v", err)
+				return
+			}
+		}
+
+		if !download {
+			r.opts.stats.command(string(data))
+		} else {
+			r.opts.stats.setState("download")
+		}
+		if !download && r.opts.parse {
+			r.logger.Printf("command: %q", data)
+			if reason := r.opts.reject(string(data)); reason != "" {
+				r.logger.Printf("command rejected: %v", reason)
+				r.opts.audit.Printf("rejected %q: %v", data, reason)
+				if err = r.write([]byte("FAIL" + reason)); err != nil {
+					r.logger.Printf("tcp: %v", err)
+					return
+				}
+				continue
+			}
+		}
+		if !download && r.opts.verifyDownload && r.verifyRefused(string(data)) {
+			r.lock.Lock()
+			r.limitErr = errDownloadCorrupt
+			r.lock.Unlock()
+			r.logger.Printf("session aborted: %q refused, %v", data, errDownloadCorrupt)
+			r.opts.audit.Printf("refused %q: %v", data, errDownloadCorrupt)
+			if err = r.write([]byte("FAILrelay: " + errDownloadCorrupt.Error())); err != nil {
+				r.logger.Printf("tcp: %v", err)
+			}
+			return
+		}
+		if !download && r.opts.cacheGetvar {
+			if response, ok := r.cachedGetvar(string(data)); ok {
+				debugf(r.logger, "command %q answered from cache", data)
+				r.opts.audit.Printf("command %q answered from cache: %q", data, response)
+				if err = r.write(response); err != nil {
+					r.logger.Printf("tcp: %v", err)
+					return
+				}
+				continue
+			}
+		}
+		if !download && r.opts.step {
+			r.opts.stats.setState("step " + strconv.Quote(string(data)))
+			if !stepWait(ctx, string(data), r.logger) {
+				return
+			}
+		}
+		if !download {
+			if wait := r.opts.minCommandInterval - time.Since(lastCommand); wait > 0 {
+				time.Sleep(wait)
+			}
+			lastCommand = time.Now()
+			r.forwardCommand(string(data), resume)
+			r.logger.Printf("command, size: %v", len(data))
+		}
+		r.opts.stats.sent(len(data), 0)
+		if err = r.dev.Write(ctx, data); err != nil {
+			if ctx.Err() != nil || r.deviceLeft(err) {
+				return
+			}
+			r.opts.audit.Printf("usb error: %v", err)
+			if !r.fail(err) {
+				r.logger.Printf("usb: %v", err)
+				r.opts.forensic.fail(fmt.Sprintf("usb error: %v", err))
+				r.usbFailed(err)
+				return
+			}
+			if download {
+				r.lock.Lock()
+				r.downloadFailed = true
+				r.lock.Unlock()
+			}
+		}
+	}
+}
+
+func (r *relaySession) deviceToClient(ctx context.Context) {
+
+	var buffer []byte = make([]byte, usbReadChunk)
+	// upload bytes the device is still going to send
+	var uploadRemaining uint64
+	// the command already answered with FAIL by the reader
+	var failedSeq uint64
+	// upload data not sent yet with opts.coalesce
+	var pending []byte
+	var err error
+	for ctx.Err() == nil {
+		var n int
+		if uploadRemaining > 0 {
+			// can't be sliced without losing data, see usbReadTimeout
+			n, err = r.dev.ReadTimeout(buffer, usbTimeout)
+		} else {
+			n, err = r.dev.Read(ctx, buffer)
+		}
+		if (err == errUsbTimeout || errors.Is(err, errUsbOverflow)) && uploadRemaining > 0 {
+			// the wrapper drops what a timed out transfer received, the
+			// upload can't be completed intact
+			r.logger.Printf("usb: upload read failed with %v bytes outstanding, data may be lost: %v", uploadRemaining, err)
+			r.opts.audit.Printf("usb error: %v", errUploadTruncated)
+			r.opts.forensic.fail(errUploadTruncated.Error())
+			r.lock.Lock()
+			r.limitErr = errUploadTruncated
+			r.lock.Unlock()
+			return
+		}
+		if errors.Is(err, errUsbOverflow) {
+			// a lost response must not leave the client waiting for it, the
+			// session goes on
+			r.logger.Printf("usb: %v", err)
+			r.opts.audit.Printf("usb error: %v", err)
+			r.opts.forensic.fail(fmt.Sprintf("usb error: %v", err))
+			if err = r.write([]byte("FAILrelay: usb error: " + errUsbOverflow.Error())); err != nil {
+				r.logger.Printf("tcp: %v", err)
+				return
+			}
+			continue
+		}
+		if err == errUsbTimeout && n == 0 {
+			// device is just silent, e.g. busy flashing: responses are read
+			// a packet at a time, see usbRead, so nothing was lost
+			if pending, err = r.writeCoalesced(pending, true); err != nil {
+				r.logger.Printf("tcp: %v", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// err is the usb error handled below
+			var writeErr error
+			if pending, writeErr = r.writeCoalesced(pending, true); writeErr != nil {
+				r.logger.Printf("tcp: %v", writeErr)
+				return
+			}
+			if r.deviceLeft(err) {
+				return
+			}
+			r.lock.Lock()
+			seq := r.commandSeq
+			r.lock.Unlock()
+			r.opts.audit.Printf("usb error: %v", err)
+			if !r.opts.keepOnError || usbErrorFatal(err) {
+				r.logger.Printf("usb: %v", err)
+				r.opts.forensic.fail(fmt.Sprintf("usb error: %v", err))
+				r.usbFailed(err)
+				return
+			}
+			uploadRemaining = 0
+			if seq != failedSeq {
+				failedSeq = seq
+				if !r.fail(err) {
+					return
+				}
+			}
+			// don't spin on a persistent error
+			time.Sleep(usbPollTimeout * time.Millisecond)
+			continue
+		}
+		data := buffer[0:n]
+		if uploadRemaining == 0 {
+			if r.opts.cacheGetvar {
+				r.storeGetvar(data)
+			}
+			r.opts.audit.Printf("response: %q", data)
+			if r.opts.parse && r.opts.responseLogMax > 0 {
+				if message, ok := fastbootMessage(data, r.opts.responseLogMax); ok {
+					r.logger.Printf("response %s: %v", data[0:4], message)
+				}
+			}
+			r.lock.Lock()
+			hold := r.rebootResumeHold(data)
+			r.lock.Unlock()
+			if hold {
+				continue
+			}
+		}
+
+		if uploadRemaining > 0 {
+			if uint64(n) < uploadRemaining {
+				uploadRemaining -= uint64(n)
+			} else {
+				uploadRemaining = 0
+			}
+			if r.opts.coalesce > 0 {
+				pending = append(pending, data...)
+				if pending, err = r.writeCoalesced(pending, uploadRemaining == 0); err != nil {
+					r.logger.Printf("tcp: %v", err)
+					return
+				}
+				continue
+			}
+		} else if r.opts.parse && fastbootUnknownCommand(data) {
+			r.lock.Lock()
+			command := r.command
+			r.lock.Unlock()
+			r.logger.Printf("warning: device doesn't know command %q (%q), client/bootloader mismatch?", command, data[4:])
+		} else if size, ok := fastbootDataSize(data); ok {
+			// must be known before the client sees DATA and starts sending
+			r.lock.Lock()
+			if fastbootIsUpload(r.command) {
+				uploadRemaining = size
+			} else {
+				r.downloadRemaining = size
+				r.progress.start(size)
+			}
+			r.lock.Unlock()
+		}
+
+		if err = r.write(data); err != nil {
+			if ctx.Err() == nil {
+				r.logger.Printf("tcp: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// forwardCommand makes command, allowed by the policies and about to be sent
+// to the device, the current one.
+func (r *relaySession) forwardCommand(command string, resume bool) {
+
+	r.lock.Lock()
+	r.command = command
+	r.rebootPending = resume
+	r.commandSeq++
+	r.downloadFailed = false
+	if r.opts.verifyDownload {
+		r.verifyCommand(command)
+	}
+	if r.opts.parse {
+		r.progress.command(command, r.logger)
+	}
+	r.lock.Unlock()
+	r.opts.audit.Printf("command: %q", command)
+	r.opts.stats.setState("command " + strconv.Quote(command))
+}
+
+// frameLimit returns the largest frame the client may send next: the rest of
+// the download payload once the device answered DATA, a command otherwise.
+func (r *relaySession) frameLimit() uint64 {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.downloadRemaining > fastbootCommandMax {
+		return r.downloadRemaining
+	}
+	return fastbootCommandMax
+}
+
+// write sends a frame to the client.
+func (r *relaySession) write(data []byte) error {
+
+	r.netLock.Lock()
+	defer r.netLock.Unlock()
+	r.lastFrame.Store(time.Now().UnixNano())
+	r.opts.stats.sent(0, len(data))
+	r.opts.forensic.packet(forensicToClient, data)
+	return r.codec.write(r.conn, data)
+}
+
+// writeCoalesced sends pending upload data in frames of opts.coalesce bytes,
+// the last shorter one only if all is set, and returns what is left. Device
+// responses are never coalesced, the fastboot client expects one per frame.
+func (r *relaySession) writeCoalesced(pending []byte, all bool) ([]byte, error) {
+
+	for len(pending) > 0 && (len(pending) >= r.opts.coalesce || all) {
+		size := len(pending)
+		if size > r.opts.coalesce {
+			size = r.opts.coalesce
+		}
+		if err := r.write(pending[0:size]); err != nil {
+			return nil, err
+		}
+		pending = pending[size:]
+	}
+	return pending, nil
+}
+
+// keepalive sends a keepalive frame whenever the connection has been idle for
+// opts.keepalive, so NAT and firewalls don't drop it between commands.
+func (r *relaySession) keepalive(ctx context.Context) {
+
+	ticker := time.NewTicker(r.opts.keepalive / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, r.lastFrame.Load())) < r.opts.keepalive {
+			continue
+		}
+		r.netLock.Lock()
+		r.lastFrame.Store(time.Now().UnixNano())
+		err := r.codec.writeKeepalive(r.conn)
+		r.netLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// variables which can't change while the device stays in the same mode,
+// unlike e.g. unlocked, current-slot or partition sizes
+var fastbootConstantVars = map[string]bool{
+	"version":            true,
+	"version-bootloader": true,
+	"version-baseband":   true,
+	"product":            true,
+	"serialno":           true,
+	"max-download-size":  true,
+	"variant":            true,
+	"hw-revision":        true,
+}
+
+// cachedGetvar returns the cached response to command. Any command which may
+// change the device drops the cache.
+func (r *relaySession) cachedGetvar(command string) ([]byte, bool) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.pendingGetvar = ""
+	if !fastbootIsReadOnly(command) {
+		r.getvarCache = nil
+		return nil, false
+	}
+	if !strings.HasPrefix(command, "getvar:") || !fastbootConstantVars[strings.TrimPrefix(command, "getvar:")] {
+		return nil, false
+	}
+	if response, ok := r.getvarCache[command]; ok {
+		return response, true
+	}
+	r.pendingGetvar = command
+	return nil, false
+}
+
+// storeGetvar caches the response if it's the OKAY to a pending getvar.
+func (r *relaySession) storeGetvar(response []byte) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.pendingGetvar == "" {
+		return
+	}
+	// only a plain OKAY, nothing printed before it
+	if len(response) >= 4 && string(response[0:4]) == "OKAY" {
+		if r.getvarCache == nil {
+			r.getvarCache = map[string][]byte{}
+		}
+		r.getvarCache[r.pendingGetvar] = append([]byte(nil), response...)
+	}
+	r.pendingGetvar = ""
+}
+
+// watchDownload ends the session if a download moves slower than
+// opts.minDownloadRate over opts.stallWindow, a wedged transfer would
+// otherwise hang until the client gives up.
+func (r *relaySession) watchDownload(ctx context.Context, cancel context.CancelFunc) {
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var windowStart time.Time
+	var windowBytes uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.lock.Lock()
+		downloading := r.downloadRemaining > 0
+		sent := r.deviceBytes
+		r.lock.Unlock()
+		if !downloading {
+			windowStart = time.Time{}
+			continue
+		}
+		if windowStart.IsZero() {
+			windowStart, windowBytes = time.Now(), sent
+			continue
+		}
+		elapsed := time.Since(windowStart)
+		if elapsed < r.opts.stallWindow {
+			continue
+		}
+		if rate := float64(sent-windowBytes) / elapsed.Seconds(); rate < float64(r.opts.minDownloadRate) {
+			r.logger.Printf("download stalled: %.0f bytes/s over %v, %v expected at least, session aborted",
+				rate, elapsed.Round(time.Second), r.opts.minDownloadRate)
+			r.opts.audit.Printf("download stalled at %.0f bytes/s", rate)
+			r.opts.forensic.fail("download stalled")
+			r.lock.Lock()
+			r.limitErr = errDownloadStalled
+			r.lock.Unlock()
+			if err := r.write([]byte("FAILrelay: download stalled")); err != nil {
+				r.logger.Printf("tcp: %v", err)
+			}
+			cancel()
+			return
+		}
+		windowStart, windowBytes = time.Now(), sent
+	}
+}
+
+// fastbootEndsSession tells whether the device may disconnect from usb after
+// answering command, e.g. to reboot.
+func fastbootEndsSession(command string) bool {
+
+	return command == "continue" || command == "reboot" || strings.HasPrefix(command, "reboot-") ||
+		strings.HasPrefix(command, "reboot:")
+}
+
+// fastbootIsUpload tells whether command makes the device send data to the
+// host after its DATA response.
+func fastbootIsUpload(command string) bool {
+
+	return strings.HasPrefix(command, "upload") || strings.HasPrefix(command, "fetch:")
+}
+
+// fastbootUnknownCommand tells whether response is the bootloader refusing a
+// command it doesn't implement.
+func fastbootUnknownCommand(response []byte) bool {
+
+	return len(response) >= 4 && string(response[0:4]) == "FAIL" &&
+		strings.Contains(strings.ToLower(string(response[4:])), "unknown command")
+}
+
+// fastbootDataSize parses a "DATAxxxxxxxx" device response, which announces
+// how many bytes of payload are going to be transferred next.
+func fastbootDataSize(response []byte) (uint64, bool) {
+
+	if len(response) != 12 || string(response[0:4]) != "DATA" {
+		return 0, false
+	}
+	size, err := strconv.ParseUint(string(response[4:]), 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	return size, true
+}
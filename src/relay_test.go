@@ -0,0 +1,637 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// how long a usbMock read waits before timing out like a silent device
+const usbMockTimeout = 20 * time.Millisecond
+
+// usbMockRead is the result of a read of a usbMock.
+type usbMockRead struct {
+	data []byte
+	err  error
+}
+
+// usbMock is a usbTransport standing in for a device: every write is
+// answered with the reads respond returns for it, read back in order.
+type usbMock struct {
+	respond func(data []byte) []usbMockRead
+	reads   chan usbMockRead
+
+	lock sync.Mutex
+	// every write, copied
+	written [][]byte
+	// returned by the next writes instead of answering them
+	writeErr error
+	closed   bool
+}
+
+func newUsbMock(respond func(data []byte) []usbMockRead) *usbMock {
+
+	return &usbMock{respond: respond, reads: make(chan usbMockRead, 1024)}
+}
+
+// newFastbootMock returns a usbMock answering like a bootloader: OKAY
+// followed by the command to commands, DATA to downloads and OKAY once all
+// the download data arrived.
+func newFastbootMock() *usbMock {
+
+	var remaining uint64
+	return newUsbMock(func(data []byte) []usbMockRead {
+		if remaining > 0 {
+			if uint64(len(data)) >= remaining {
+				remaining = 0
+				return []usbMockRead{{data: []byte("OKAY")}}
+			}
+			remaining -= uint64(len(data))
+			return nil
+		}
+		if size, ok := strings.CutPrefix(string(data), "download:"); ok {
+			remaining, _ = strconv.ParseUint(size, 16, 32)
+			return []usbMockRead{{data: []byte(fmt.Sprintf("DATA%08x", remaining))}}
+		}
+		return []usbMockRead{{data: append([]byte("OKAY"), data...)}}
+	})
+}
+
+func (m *usbMock) Write(ctx context.Context, data []byte) error {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	m.written = append(m.written, append([]byte(nil), data...))
+	for _, read := range m.respond(data) {
+		m.reads <- read
+	}
+	return nil
+}
+
+func (m *usbMock) Read(ctx context.Context, data []byte) (int, error) {
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case read := <-m.reads:
+		return copy(data, read.data), read.err
+	case <-time.After(usbMockTimeout):
+		return 0, errUsbTimeout
+	}
+}
+
+// ReadTimeout times out after usbMockTimeout whatever timeout is, to keep
+// the tests short.
+func (m *usbMock) ReadTimeout(data []byte, timeout int) (int, error) {
+
+	select {
+	case read := <-m.reads:
+		return copy(data, read.data), read.err
+	case <-time.After(usbMockTimeout):
+		return 0, errUsbTimeout
+	}
+}
+
+func (m *usbMock) Close() {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+}
+
+// writes returns what was written to the device so far.
+func (m *usbMock) writes() [][]byte {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([][]byte(nil), m.written...)
+}
+
+func (m *usbMock) setWriteErr(err error) {
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.writeErr = err
+}
+
+// relayTest runs a relay session of dev over a pipe, returns the client end
+// of the pipe and the channel the result of relay is sent to.
+func relayTest(t *testing.T, dev usbTransport, opts relayOptions) (net.Conn, <-chan error) {
+
+	t.Helper()
+	client, server := net.Pipe()
+	if opts.drainTimeout == 0 {
+		opts.drainTimeout = 10 * time.Millisecond
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- relay(context.Background(), server, false, dev, log.New(io.Discard, "", 0), opts)
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	return client, done
+}
+
+// relayWait closes the client end and returns the result of the session.
+func relayWait(t *testing.T, client net.Conn, done <-chan error) error {
+
+	t.Helper()
+	client.Close()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatalf("relay didn't end after the client disconnected")
+		return nil
+	}
+}
+
+// relayExchange sends a frame and returns the response.
+func relayExchange(t *testing.T, client net.Conn, data string) string {
+
+	t.Helper()
+	if err := netWrite(client, []byte(data)); err != nil {
+		t.Fatalf("send %q: %v", data, err)
+	}
+	return relayResponse(t, client)
+}
+
+func relayResponse(t *testing.T, client net.Conn) string {
+
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := netRead(client)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return string(response)
+}
+
+func TestRelayOptionsValidate(t *testing.T) {
+
+	for _, test := range []struct {
+		opts relayOptions
+		ok   bool
+	}{
+		{relayOptions{}, true},
+		{relayOptions{verifyDownload: true}, false},
+		{relayOptions{verifyDownload: true, parse: true}, true},
+		{relayOptions{progressInfo: true}, false},
+		{relayOptions{progressInfo: true, parse: true}, true},
+	} {
+		if err := test.opts.validate(); (err == nil) != test.ok {
+			t.Errorf("%+v: got %v", test.opts, err)
+		}
+	}
+}
+
+func TestRelayCommand(t *testing.T) {
+
+	dev := newFastbootMock()
+	client, done := relayTest(t, dev, relayOptions{})
+	for _, command := range []string{"getvar:product", "getvar:max-download-size", "set_active:b"} {
+		if response := relayExchange(t, client, command); response != "OKAY"+command {
+			t.Errorf("response to %q: got %q", command, response)
+		}
+	}
+	if err := relayWait(t, client, done); err != nil {
+		t.Errorf("relay: %v", err)
+	}
+	if written := dev.writes(); len(written) != 3 || string(written[2]) != "set_active:b" {
+		t.Errorf("device got %q", written)
+	}
+}
+
+func TestRelayDownload(t *testing.T) {
+
+	dev := newFastbootMock()
+	client, done := relayTest(t, dev, relayOptions{})
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	if response := relayExchange(t, client, fmt.Sprintf("download:%08x", len(payload))); response != fmt.Sprintf("DATA%08x", len(payload)) {
+		t.Fatalf("download: got %q", response)
+	}
+	if err := netWrite(client, payload[0:100000]); err != nil {
+		t.Fatal(err)
+	}
+	if response := relayExchange(t, client, string(payload[100000:])); response != "OKAY" {
+		t.Fatalf("download data: got %q", response)
+	}
+	if response := relayExchange(t, client, "flash:boot"); response != "OKAYflash:boot" {
+		t.Fatalf("flash: got %q", response)
+	}
+	if err := relayWait(t, client, done); err != nil {
+		t.Errorf("relay: %v", err)
+	}
+	written := dev.writes()
+	if len(written) != 4 || !bytes.Equal(append(written[1], written[2]...), payload) {
+		t.Errorf("device got %v writes, download data mismatch", len(written))
+	}
+}
+
+func TestRelayResponses(t *testing.T) {
+
+	dev := newUsbMock(func(data []byte) []usbMockRead {
+		return []usbMockRead{{data: []byte("INFOline 1")}, {data: []byte("TEXTline 2")}, {data: []byte("OKAY")}}
+	})
+	client, done := relayTest(t, dev, relayOptions{})
+	var got []string
+	got = append(got, relayExchange(t, client, "oem log"))
+	got = append(got, relayResponse(t, client), relayResponse(t, client))
+	if strings.Join(got, ",") != "INFOline 1,TEXTline 2,OKAY" {
+		t.Errorf("got %q", got)
+	}
+	relayWait(t, client, done)
+}
+
+func TestRelayUsbError(t *testing.T) {
+
+	dev := newFastbootMock()
+	dev.setWriteErr(fmt.Errorf("write failed: %w", usbErrorIO))
+	client, done := relayTest(t, dev, relayOptions{})
+	if err := netWrite(client, []byte("getvar:product")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response, err := netRead(client); err == nil {
+		t.Errorf("session went on after a usb error, got %q", response)
+	}
+	if err := relayWait(t, client, done); !errors.Is(err, usbErrorIO) {
+		t.Errorf("relay result: got %v, want the usb error", err)
+	}
+}
+
+func TestRelayUsbErrorKeepSession(t *testing.T) {
+
+	dev := newFastbootMock()
+	dev.setWriteErr(fmt.Errorf("write failed: %w", usbErrorIO))
+	client, done := relayTest(t, dev, relayOptions{keepOnError: true})
+	if response := relayExchange(t, client, "flash:boot"); !strings.HasPrefix(response, "FAILrelay: usb error") {
+		t.Errorf("usb error: got %q", response)
+	}
+	dev.setWriteErr(nil)
+	if response := relayExchange(t, client, "getvar:product"); response != "OKAYgetvar:product" {
+		t.Errorf("after the usb error: got %q", response)
+	}
+	relayWait(t, client, done)
+}
+
+func TestRelayDeviceLeft(t *testing.T) {
+
+	dev := newUsbMock(func(data []byte) []usbMockRead {
+		return []usbMockRead{{data: []byte("OKAY")}, {err: fmt.Errorf("read failed: %w", usbErrorNoDevice)}}
+	})
+	client, done := relayTest(t, dev, relayOptions{keepOnError: true})
+	if response := relayExchange(t, client, "reboot"); response != "OKAY" {
+		t.Fatalf("reboot: got %q", response)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response, err := netRead(client); err == nil {
+		t.Errorf("session went on after the device left, got %q", response)
+	}
+	if err := relayWait(t, client, done); err != nil {
+		t.Errorf("relay: %v", err)
+	}
+}
+
+func TestRelaySessionBytes(t *testing.T) {
+
+	client, done := relayTest(t, newFastbootMock(), relayOptions{maxSessionBytes: 10})
+	if response := relayExchange(t, client, "getvar:all-too-long"); response != "FAILrelay: session byte limit exceeded" {
+		t.Errorf("got %q", response)
+	}
+	if err := relayWait(t, client, done); !errors.Is(err, errSessionBytes) {
+		t.Errorf("relay: got %v, %v expected", err, errSessionBytes)
+	}
+}
+
+func TestRelayCancel(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- relay(ctx, server, false, newFastbootMock(), log.New(io.Discard, "", 0), relayOptions{})
+	}()
+	if response := relayExchange(t, client, "getvar:product"); response != "OKAYgetvar:product" {
+		t.Fatalf("got %q", response)
+	}
+	cancel()
+	go io.Copy(io.Discard, client)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("relay didn't end when cancelled")
+	}
+}
+
+// stagePayload returns size bytes of test data.
+func stagePayload(size int) []byte {
+
+	var payload []byte = make([]byte, size)
+	for i := range payload {
+		payload[i] = byte(i * 7 / 3)
+	}
+	return payload
+}
+
+func TestRelayStage(t *testing.T) {
+
+	for _, size := range []int{usbReadChunk - 1, usbReadChunk + 1, 5<<20 + 3} {
+		dev := newFastbootMock()
+		client, done := relayTest(t, dev, relayOptions{})
+		payload := stagePayload(size)
+		if response := relayExchange(t, client, fmt.Sprintf("download:%08x", size)); response != fmt.Sprintf("DATA%08x", size) {
+			t.Fatalf("download: got %q", response)
+		}
+		// frames as sent by the fastboot client, the last one answered
+		for start := 0; start < size; start += clientChunk {
+			end := start + clientChunk
+			if end > size {
+				end = size
+			}
+			if err := netWrite(client, payload[start:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if response := relayResponse(t, client); response != "OKAY" {
+			t.Fatalf("%v bytes staged: got %q", size, response)
+		}
+		if response := relayExchange(t, client, "oem run-staged"); response != "OKAYoem run-staged" {
+			t.Fatalf("after staging: got %q", response)
+		}
+		relayWait(t, client, done)
+		written := dev.writes()
+		if received := bytes.Join(written[1:len(written)-1], nil); !bytes.Equal(received, payload) {
+			t.Errorf("%v bytes staged: device got %v bytes", size, len(received))
+		}
+	}
+}
+
+// newUploadMock returns a usbMock answering upload with payload sent in
+// packets of packetSize.
+func newUploadMock(payload []byte, packetSize int) *usbMock {
+
+	return newUsbMock(func(data []byte) []usbMockRead {
+		if string(data) != "upload" {
+			return []usbMockRead{{data: []byte("OKAY")}}
+		}
+		reads := []usbMockRead{{data: []byte(fmt.Sprintf("DATA%08x", len(payload)))}}
+		for start := 0; start < len(payload); start += packetSize {
+			end := start + packetSize
+			if end > len(payload) {
+				end = len(payload)
+			}
+			reads = append(reads, usbMockRead{data: payload[start:end]})
+		}
+		return append(reads, usbMockRead{data: []byte("OKAY")})
+	})
+}
+
+func TestRelayGetStaged(t *testing.T) {
+
+	for _, coalesce := range []int{0, 1 << 20} {
+		payload := stagePayload(3<<20 + 17)
+		client, done := relayTest(t, newUploadMock(payload, usbReadChunk), relayOptions{coalesce: coalesce})
+		if response := relayExchange(t, client, "upload"); response != fmt.Sprintf("DATA%08x", len(payload)) {
+			t.Fatalf("upload: got %q", response)
+		}
+		var received []byte
+		frames := 0
+		for len(received) < len(payload) {
+			frame := relayResponse(t, client)
+			received = append(received, frame...)
+			frames++
+		}
+		if !bytes.Equal(received, payload) {
+			t.Errorf("coalesce %v: got %v bytes, %v expected", coalesce, len(received), len(payload))
+		}
+		if coalesce > 0 && frames != (len(payload)+coalesce-1)/coalesce {
+			t.Errorf("coalesce %v: got %v frames", coalesce, frames)
+		}
+		if response := relayResponse(t, client); response != "OKAY" {
+			t.Errorf("after the upload: got %q", response)
+		}
+		relayWait(t, client, done)
+	}
+}
+
+func TestRelayUploadTimeout(t *testing.T) {
+
+	// the device stops sending in the middle of the upload
+	payload := stagePayload(3 * usbReadChunk)
+	dev := newUsbMock(func(data []byte) []usbMockRead {
+		return []usbMockRead{{data: []byte(fmt.Sprintf("DATA%08x", len(payload)))}, {data: payload[0:usbReadChunk]}}
+	})
+	client, done := relayTest(t, dev, relayOptions{})
+	if response := relayExchange(t, client, "upload"); response != fmt.Sprintf("DATA%08x", len(payload)) {
+		t.Fatalf("upload: got %q", response)
+	}
+	if frame := relayResponse(t, client); len(frame) != usbReadChunk {
+		t.Fatalf("got %v bytes", len(frame))
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if frame, err := netRead(client); err == nil {
+		t.Errorf("session went on after a truncated upload, got %v bytes", len(frame))
+	}
+	if err := relayWait(t, client, done); !errors.Is(err, errUploadTruncated) {
+		t.Errorf("relay: got %v, %v expected", err, errUploadTruncated)
+	}
+}
+
+func TestRelayPartitionPolicy(t *testing.T) {
+
+	dev := newFastbootMock()
+	client, done := relayTest(t, dev, relayOptions{parse: true, policy: partitionPolicy{deny: []string{"boot_a"}}})
+	for _, command := range []string{"flash:boot_a", "flash:boot", "erase:boot"} {
+		if response := relayExchange(t, client, command); response != "FAILpartition boot_a is not allowed by relay policy" &&
+			response != "FAILpartition boot is not allowed by relay policy" {
+			t.Errorf("response to %q: got %q", command, response)
+		}
+	}
+	if response := relayExchange(t, client, "flash:boot_b"); response != "OKAYflash:boot_b" {
+		t.Errorf("response to the allowed slot: got %q", response)
+	}
+	relayWait(t, client, done)
+	if written := dev.writes(); len(written) != 1 || string(written[0]) != "flash:boot_b" {
+		t.Errorf("device got %q", written)
+	}
+}
+
+func TestRelayRejectedCommand(t *testing.T) {
+
+	audit, err := auditOpen(t.TempDir(), "client", "mock")
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	stats := &sessionStats{}
+	dev := newFastbootMock()
+	client, done := relayTest(t, dev, relayOptions{parse: true, readonly: true, audit: audit, stats: stats})
+	if response := relayExchange(t, client, "getvar:product"); response != "OKAYgetvar:product" {
+		t.Errorf("response to getvar: got %q", response)
+	}
+	if response := relayExchange(t, client, "flash:boot"); !strings.HasPrefix(response, "FAIL") {
+		t.Errorf("response to flash: got %q", response)
+	}
+	if state, _ := stats.state.Load().(string); state != `command "getvar:product"` {
+		t.Errorf("state after the rejected command: %q", state)
+	}
+	if err := relayWait(t, client, done); err != nil {
+		t.Errorf("relay: %v", err)
+	}
+	if written := dev.writes(); len(written) != 1 {
+		t.Errorf("device got %q", written)
+	}
+	name := audit.file.Name()
+	audit.Close()
+	trail, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("audit: %v", err)
+	}
+	if strings.Contains(string(trail), `command: "flash:boot"`) || !strings.Contains(string(trail), `rejected "flash:boot"`) {
+		t.Errorf("audit trail:\n%s", trail)
+	}
+}
+
+func TestRelayFrameLimit(t *testing.T) {
+
+	dev := newFastbootMock()
+	client, done := relayTest(t, dev, relayOptions{})
+	// payload larger than a command is accepted once the device asked for it
+	payload := stagePayload(3 * fastbootCommandMax)
+	command := fmt.Sprintf("download:%08x", len(payload))
+	if response := relayExchange(t, client, command); response != "DATA"+command[9:] {
+		t.Fatalf("response to %q: got %q", command, response)
+	}
+	if response := relayExchange(t, client, string(payload)); response != "OKAY" {
+		t.Errorf("response to the payload: got %q", response)
+	}
+	// a command of that size ends the session
+	if err := netWrite(client, payload); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if response, err := netRead(client); err == nil {
+		t.Errorf("oversized command answered with %q", response)
+	}
+	relayWait(t, client, done)
+	if written := dev.writes(); len(written) != 2 {
+		t.Errorf("device got %v frames", len(written))
+	}
+}
+
+func TestRelayUsbOverflow(t *testing.T) {
+
+	dev := newUsbMock(func(data []byte) []usbMockRead {
+		if string(data) == "oem log" {
+			return []usbMockRead{{err: fmt.Errorf("read failed: %w", errUsbOverflow)}}
+		}
+		return []usbMockRead{{data: append([]byte("OKAY"), data...)}}
+	})
+	// the lost response is reported even without --keep-on-error
+	client, done := relayTest(t, dev, relayOptions{})
+	if response := relayExchange(t, client, "oem log"); !strings.HasPrefix(response, "FAILrelay: usb error") {
+		t.Errorf("overflowed response: got %q", response)
+	}
+	if response := relayExchange(t, client, "getvar:product"); response != "OKAYgetvar:product" {
+		t.Errorf("after the overflow: got %q", response)
+	}
+	if err := relayWait(t, client, done); err != nil {
+		t.Errorf("relay: %v", err)
+	}
+}
+
+func TestRelayFinalResponse(t *testing.T) {
+
+	// over tcp: closing a socket with unread data resets the connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan error, 1)
+	go func() {
+		server, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		err = relay(context.Background(), server, false, newFastbootMock(), log.New(io.Discard, "", 0),
+			relayOptions{maxSessionBytes: 20, drainTimeout: 10 * time.Millisecond})
+		server.Close()
+		done <- err
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the client keeps sending past the limit, the relay leaves it unread
+	var stream bytes.Buffer
+	for i := 0; i < 64; i++ {
+		stream.Write(append(netTestHeader(14), "getvar:product"...))
+	}
+	if _, err := client.Write(stream.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// read only once the relay closed its end
+	if err := <-done; !errors.Is(err, errSessionBytes) {
+		t.Errorf("relay: got %v, %v expected", err, errSessionBytes)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// the response to the first command may come after the FAIL, or not at
+	// all if the session ended first
+	var responses []string
+	for {
+		response, err := netRead(client)
+		if err != nil {
+			// a reset instead of an orderly close may drop the final response
+			if err != io.EOF {
+				t.Errorf("after %q: got %v, EOF expected", responses, err)
+			}
+			break
+		}
+		responses = append(responses, string(response))
+	}
+	if !strings.Contains(strings.Join(responses, "\n"), "FAILrelay: session byte limit exceeded") {
+		t.Errorf("final response lost, got %q", responses)
+	}
+}
+
+func TestRelayCoalesceUsbError(t *testing.T) {
+
+	// the device fails in the middle of an upload coalesced into one frame
+	payload := stagePayload(3 * usbReadChunk)
+	dev := newUsbMock(func(data []byte) []usbMockRead {
+		return []usbMockRead{{data: []byte(fmt.Sprintf("DATA%08x", len(payload)))}, {data: payload[0:usbReadChunk]},
+			{err: fmt.Errorf("read failed: %w", usbErrorIO)}}
+	})
+	client, done := relayTest(t, dev, relayOptions{coalesce: 1 << 20, keepOnError: true})
+	if response := relayExchange(t, client, "upload"); response != fmt.Sprintf("DATA%08x", len(payload)) {
+		t.Fatalf("upload: got %q", response)
+	}
+	// what was received is flushed, then the usb error is reported
+	if frame := relayResponse(t, client); !bytes.Equal([]byte(frame), payload[0:usbReadChunk]) {
+		t.Errorf("got %v bytes, %v expected", len(frame), usbReadChunk)
+	}
+	if response := relayResponse(t, client); response != "FAILrelay: usb error: "+fmt.Errorf("read failed: %w", usbErrorIO).Error() {
+		t.Errorf("after the usb error: got %q", response)
+	}
+	relayWait(t, client, done)
+}
@@ -0,0 +1,162 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Script client mode runs a fixed command sequence, e.g. an OEM unlock flow.
+// One command per line as sent to the device ("oem unlock", "getvar:unlocked"),
+// # starts a comment, directives:
+//
+//	expect TOKEN [text] - the previous command must end with TOKEN (OKAY or
+//	                      FAIL) and a message containing text
+//	sleep DURATION      - wait, e.g. sleep 5s
+//	pause [message]     - print message and wait for Enter, e.g. to confirm
+//	                      unlock on the device
+//	reboot fastbootd    - reboot into fastbootd unless is-userspace already
+//	                      is yes, and continue once the device is back
+//	reboot bootloader   - reboot into the bootloader and continue once the
+//	                      device is back, in the same session if the server
+//	                      runs with --reboot-resume
+//
+// A command without expect must end with OKAY.
+
+type scriptStep struct {
+	line int
+	// a command, or a directive: "sleep", "pause", "reboot fastbootd",
+	// "reboot bootloader"
+	command  string
+	argument string
+	// expected final response of a command
+	expectToken string
+	expectText  string
+}
+
+func scriptLoad(path string) ([]scriptStep, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var steps []scriptStep
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		directive, argument, _ := strings.Cut(line, " ")
+		argument = strings.TrimSpace(argument)
+		switch directive {
+		case "expect":
+			if len(steps) == 0 || steps[len(steps)-1].expectToken == "" {
+				return nil, fmt.Errorf("%v:%v: expect doesn't follow a command", path, number)
+			}
+			token, text, _ := strings.Cut(argument, " ")
+			if token != "OKAY" && token != "FAIL" {
+				return nil, fmt.Errorf("%v:%v: expect OKAY or FAIL, got %q", path, number, token)
+			}
+			steps[len(steps)-1].expectToken = token
+			steps[len(steps)-1].expectText = strings.TrimSpace(text)
+		case "sleep":
+			if _, err := time.ParseDuration(argument); err != nil {
+				return nil, fmt.Errorf("%v:%v: bad sleep duration %q", path, number, argument)
+			}
+			steps = append(steps, scriptStep{line: number, command: directive, argument: argument})
+		case "pause":
+			steps = append(steps, scriptStep{line: number, command: directive, argument: argument})
+		case "reboot":
+			if argument != "fastbootd" && argument != "bootloader" {
+				steps = append(steps, scriptStep{line: number, command: line, expectToken: "OKAY"})
+				break
+			}
+			steps = append(steps, scriptStep{line: number, command: line})
+		default:
+			steps = append(steps, scriptStep{line: number, command: line, expectToken: "OKAY"})
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// clientScript runs the script at path over the server at address, stops at
+// the first step failing its expectation.
+func clientScript(address string, path string) error {
+
+	steps, err := scriptLoad(path)
+	if err != nil {
+		return err
+	}
+	conn, err := clientConnect(address)
+	if err != nil {
+		return err
+	}
+	defer func() { conn.Close() }()
+
+	stdin := bufio.NewReader(os.Stdin)
+	for _, step := range steps {
+		switch step.command {
+		case "sleep":
+			duration, _ := time.ParseDuration(step.argument)
+			fmt.Printf("sleep %v\n", duration)
+			time.Sleep(duration)
+			continue
+		case "pause":
+			fmt.Printf("%v [press Enter] ", step.argument)
+			if _, err = stdin.ReadString('\n'); err != nil {
+				return fmt.Errorf("line %v: pause: %v", step.line, err)
+			}
+			continue
+		case "reboot fastbootd":
+			userspace, err := clientGetvarYes(conn, "is-userspace")
+			if err != nil {
+				return err
+			}
+			if !userspace {
+				// conn stays set for the deferred Close if the reboot fails
+				rebooted, err := clientRebootFastbootd(address, conn)
+				if err != nil {
+					return fmt.Errorf("line %v: %v", step.line, err)
+				}
+				conn = rebooted
+			}
+			continue
+		case "reboot bootloader":
+			rebooted, err := clientRebootBootloader(address, conn)
+			if err != nil {
+				return fmt.Errorf("line %v: %v", step.line, err)
+			}
+			conn = rebooted
+			continue
+		}
+
+		fmt.Printf("%v\n", step.command)
+		if err = netWrite(conn, []byte(step.command)); err != nil {
+			return err
+		}
+		token, message, err := clientReply(conn, step.command)
+		if err != nil {
+			return err
+		}
+		if token == "DATA" {
+			return fmt.Errorf("line %v: %v: data phase is not supported in scripts", step.line, step.command)
+		}
+		fmt.Printf("%v %v\n", token, message)
+		if token != step.expectToken || !strings.Contains(message, step.expectText) {
+			return fmt.Errorf("line %v: %v: expected %v %q, got %v %q", step.line, step.command,
+				step.expectToken, step.expectText, token, message)
+		}
+	}
+	return nil
+}
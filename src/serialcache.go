@@ -0,0 +1,82 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"log"
+	"sync"
+
+	libusb "github.com/gotmc/libusb/v2"
+)
+
+// serials read from devices, so matching by serial doesn't open every
+// candidate on every discovery. Keyed by location and descriptor fields, any
+// hotplug event drops the whole cache: the event doesn't tell the location.
+type usbSerialKey struct {
+	bus     int
+	address int
+	vendor  uint16
+	product uint16
+	release uint16
+	index   uint8
+}
+
+var usbSerialCacheLock sync.Mutex
+var usbSerialCacheEnabled bool
+var usbSerialCache map[usbSerialKey]string
+
+// usbSerialCacheStart enables the cache, only if hotplug events are
+// available to invalidate it.
+func usbSerialCacheStart() {
+
+	err := usbCtx.HotplugRegisterCallbackEvent(0, 0, libusb.HotplugUndefined, func(vendor, product uint16, event libusb.HotPlugEventType) {
+		usbSerialCacheLock.Lock()
+		defer usbSerialCacheLock.Unlock()
+		if len(usbSerialCache) > 0 {
+			debugf(log.Default(), "serial cache dropped on hotplug event of %04x:%04x", vendor, product)
+		}
+		usbSerialCache = map[usbSerialKey]string{}
+	})
+	if err != nil {
+		log.Printf("serial cache disabled, no hotplug events: %v", err)
+		return
+	}
+	usbSerialCacheLock.Lock()
+	defer usbSerialCacheLock.Unlock()
+	usbSerialCacheEnabled = true
+	usbSerialCache = map[usbSerialKey]string{}
+}
+
+func usbSerialKeyOf(device *libusb.Device, desc *libusb.Descriptor) usbSerialKey {
+
+	key := usbSerialKey{
+		vendor:  desc.VendorID,
+		product: desc.ProductID,
+		release: uint16(desc.DeviceReleaseNumber),
+		index:   desc.SerialNumberIndex,
+	}
+	key.bus, _ = device.BusNumber()
+	key.address, _ = device.DeviceAddress()
+	return key
+}
+
+func usbSerialCacheGet(key usbSerialKey) (string, bool) {
+
+	usbSerialCacheLock.Lock()
+	defer usbSerialCacheLock.Unlock()
+	if !usbSerialCacheEnabled {
+		return "", false
+	}
+	serial, ok := usbSerialCache[key]
+	return serial, ok
+}
+
+func usbSerialCachePut(key usbSerialKey, serial string) {
+
+	usbSerialCacheLock.Lock()
+	defer usbSerialCacheLock.Unlock()
+	if usbSerialCacheEnabled {
+		usbSerialCache[key] = serial
+	}
+}
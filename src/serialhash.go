@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// serialHash is the hex HMAC-SHA256 of a device serial, it lets configs
+// name devices without exposing their serials.
+func serialHash(key []byte, serial string) string {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(serial))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseSerialHashes validates and normalizes --serial-hash values.
+func parseSerialHashes(hashes []string) ([]string, error) {
+
+	var result []string
+	for _, hash := range hashes {
+		hash = strings.ToLower(strings.TrimSpace(hash))
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("bad serial hash %q, hex HMAC-SHA256 expected", hash)
+		}
+		result = append(result, hash)
+	}
+	return result, nil
+}
+
+// serialHashListed tells whether the serial hash is one of hashes.
+func serialHashListed(key []byte, hashes []string, serial string) bool {
+
+	hash := serialHash(key, serial)
+	for _, h := range hashes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,216 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats is updated by the relay while the session runs. A nil
+// sessionStats records nothing.
+type sessionStats struct {
+	toDevice atomic.Uint64
+	toClient atomic.Uint64
+	// what the session is doing, e.g. the last command
+	state atomic.Value
+	// commands sent by verb
+	verbLock sync.Mutex
+	verbs    map[string]uint64
+}
+
+// distinct verbs counted, others are counted as "other" along with the verbs
+// not looking like one, they are sent by the client
+const sessionVerbsMax = 32
+
+// commands of all the sessions by verb, exported on admin server /metrics
+var commandTotalsLock sync.Mutex
+var commandTotals = map[string]uint64{}
+
+func (s *sessionStats) sent(toDevice int, toClient int) {
+
+	if s == nil {
+		return
+	}
+	s.toDevice.Add(uint64(toDevice))
+	s.toClient.Add(uint64(toClient))
+}
+
+func (s *sessionStats) setState(state string) {
+
+	if s == nil {
+		return
+	}
+	s.state.Store(state)
+}
+
+// command counts a command of the session and of the process totals.
+func (s *sessionStats) command(command string) {
+
+	if s == nil {
+		return
+	}
+	verb, _ := fastbootParse(command)
+	if verb == "" || strings.Trim(verb, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") != "" {
+		verb = "other"
+	}
+	s.verbLock.Lock()
+	if s.verbs == nil {
+		s.verbs = map[string]uint64{}
+	}
+	if _, ok := s.verbs[verb]; !ok && len(s.verbs) >= sessionVerbsMax {
+		verb = "other"
+	}
+	s.verbs[verb]++
+	s.verbLock.Unlock()
+
+	commandTotalsLock.Lock()
+	if _, ok := commandTotals[verb]; !ok && len(commandTotals) >= sessionVerbsMax {
+		verb = "other"
+	}
+	commandTotals[verb]++
+	commandTotalsLock.Unlock()
+}
+
+// commands returns a copy of the command counts by verb.
+func (s *sessionStats) commands() map[string]uint64 {
+
+	s.verbLock.Lock()
+	defer s.verbLock.Unlock()
+	verbs := map[string]uint64{}
+	for verb, n := range s.verbs {
+		verbs[verb] = n
+	}
+	return verbs
+}
+
+// commandSummary returns the command counts by verb as "flash 3, getvar 12",
+// empty if the session sent no command.
+func (s *sessionStats) commandSummary() string {
+
+	verbs := s.commands()
+	var summary []string
+	for _, verb := range sortedVerbs(verbs) {
+		summary = append(summary, fmt.Sprintf("%v %v", verb, verbs[verb]))
+	}
+	return strings.Join(summary, ", ")
+}
+
+func sortedVerbs(verbs map[string]uint64) []string {
+
+	var sorted []string
+	for verb := range verbs {
+		sorted = append(sorted, verb)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+type session struct {
+	conn   net.Conn
+	dev    *usbDevice
+	cancel context.CancelFunc
+	start  time.Time
+	stats  *sessionStats
+}
+
+// sessionInfo is a session as reported by the admin server.
+type sessionInfo struct {
+	Client   string    `json:"client"`
+	Device   string    `json:"device"`
+	Start    time.Time `json:"start"`
+	ToDevice uint64    `json:"bytes_to_device"`
+	ToClient uint64    `json:"bytes_to_client"`
+	State    string    `json:"state"`
+	// commands sent by verb
+	Commands map[string]uint64 `json:"commands"`
+}
+
+var activeSessionLock sync.Mutex
+var activeSessions = map[*session]bool{}
+
+// sessionStart registers the session of dev, just opened for conn, so it can
+// be reached from the admin server. It's registered before the session is
+// set up: an abort meanwhile must not be lost. The returned context is
+// cancelled when the session is aborted and expires after maxDuration unless
+// it's zero.
+func sessionStart(conn net.Conn, dev *usbDevice, maxDuration time.Duration) (context.Context, *session) {
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if maxDuration > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), maxDuration)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	s := &session{conn: conn, dev: dev, cancel: cancel, start: time.Now(), stats: &sessionStats{}}
+	s.stats.setState("started")
+
+	activeSessionLock.Lock()
+	activeSessions[s] = true
+	activeSessionLock.Unlock()
+	return ctx, s
+}
+
+// sessionSetConn replaces the connection of s, e.g. by the split connection.
+func sessionSetConn(s *session, conn net.Conn) {
+
+	activeSessionLock.Lock()
+	s.conn = conn
+	activeSessionLock.Unlock()
+}
+
+func sessionEnd(s *session) {
+
+	activeSessionLock.Lock()
+	delete(activeSessions, s)
+	activeSessionLock.Unlock()
+	s.cancel()
+}
+
+// sessionAbort cancels the active sessions, returns false if there are none.
+func sessionAbort() bool {
+
+	activeSessionLock.Lock()
+	defer activeSessionLock.Unlock()
+	for s := range activeSessions {
+		log.Printf("aborting session from %v", s.conn.RemoteAddr())
+		s.cancel()
+	}
+	return len(activeSessions) > 0
+}
+
+func sessionsSnapshot() []sessionInfo {
+
+	activeSessionLock.Lock()
+	defer activeSessionLock.Unlock()
+	sessions := []sessionInfo{}
+	for s := range activeSessions {
+		state, _ := s.stats.state.Load().(string)
+		sessions = append(sessions, sessionInfo{
+			Client:   s.conn.RemoteAddr().String(),
+			Device:   usbDeviceName(s.dev),
+			Start:    s.start,
+			ToDevice: s.stats.toDevice.Load(),
+			ToClient: s.stats.toClient.Load(),
+			State:    state,
+			Commands: s.stats.commands(),
+		})
+	}
+	return sessions
+}
+
+func sessionActive() bool {
+
+	activeSessionLock.Lock()
+	defer activeSessionLock.Unlock()
+	return len(activeSessions) > 0
+}
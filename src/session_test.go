@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionAbortDuringSetup(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	dev := newUsbDeviceMock(newUsbHandleMock(t, nil), 512)
+	// registered once the device is opened, aborted before the relay starts
+	ctx, s := sessionStart(server, dev, 0)
+	defer sessionEnd(s)
+	if !sessionAbort() {
+		t.Fatalf("session being set up not found")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("aborted session: got %v", ctx.Err())
+	}
+	// the relay of an aborted session ends at once
+	done := make(chan error, 1)
+	go func() {
+		done <- relay(ctx, server, false, newFastbootMock(), dev.logger, relayOptions{drainTimeout: time.Millisecond})
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("relay of an aborted session didn't end")
+	}
+}
+
+func TestSessionMaxDuration(t *testing.T) {
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, s := sessionStart(server, newUsbDeviceMock(newUsbHandleMock(t, nil), 512), 10*time.Millisecond)
+	defer sessionEnd(s)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		t.Errorf("session past its max duration: got %v", ctx.Err())
+	}
+}
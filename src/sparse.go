@@ -0,0 +1,218 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Android sparse image format, see libsparse sparse_format.h. An image
+// exceeding max-download-size is flashed as several sparse images, each one
+// covering the whole partition: its own blocks are data, the rest "don't care".
+
+const sparseMagic = 0xed26ff3a
+const sparseHeaderSize = 28
+const sparseChunkHeaderSize = 12
+const sparseBlockSize = 4096
+
+const (
+	sparseChunkRaw      = 0xcac1
+	sparseChunkFill     = 0xcac2
+	sparseChunkDontCare = 0xcac3
+	sparseChunkCRC      = 0xcac4
+)
+
+// sparseChunk is a run of blocks of the image, raw data is read from the file
+// at offset, size bytes, the rest of the last block is zero padded.
+type sparseChunk struct {
+	kind   uint16
+	blocks uint32
+	offset int64
+	size   int64
+	fill   uint32
+}
+
+func (c sparseChunk) dataSize() int64 {
+
+	switch c.kind {
+	case sparseChunkRaw:
+		return int64(c.blocks) * sparseBlockSize
+	case sparseChunkFill:
+		return 4
+	}
+	return 0
+}
+
+// sparseImage is the chunk list of an image of totalBlocks blocks.
+type sparseImage struct {
+	blockSize   uint32
+	totalBlocks uint32
+	chunks      []sparseChunk
+}
+
+// sparseRead returns the chunks of an image file: of a sparse image as they
+// are, of a raw one as a single raw chunk.
+func sparseRead(file io.ReaderAt, size int64) (*sparseImage, error) {
+
+	var header []byte = make([]byte, sparseHeaderSize)
+	if size >= sparseHeaderSize {
+		if _, err := file.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+	}
+	if binary.LittleEndian.Uint32(header[0:4]) != sparseMagic {
+		blocks := (size + sparseBlockSize - 1) / sparseBlockSize
+		if blocks > 0xffffffff {
+			return nil, fmt.Errorf("image too large")
+		}
+		image := &sparseImage{blockSize: sparseBlockSize, totalBlocks: uint32(blocks)}
+		image.chunks = []sparseChunk{{kind: sparseChunkRaw, blocks: uint32(blocks), size: size}}
+		return image, nil
+	}
+
+	fileHeaderSize := int64(binary.LittleEndian.Uint16(header[8:10]))
+	chunkHeaderSize := int64(binary.LittleEndian.Uint16(header[10:12]))
+	image := &sparseImage{
+		blockSize:   binary.LittleEndian.Uint32(header[12:16]),
+		totalBlocks: binary.LittleEndian.Uint32(header[16:20]),
+	}
+	if image.blockSize != sparseBlockSize || chunkHeaderSize < sparseChunkHeaderSize {
+		return nil, fmt.Errorf("unsupported sparse image: block size %v, chunk header size %v",
+			image.blockSize, chunkHeaderSize)
+	}
+	count := binary.LittleEndian.Uint32(header[20:24])
+	offset := fileHeaderSize
+	var chunkHeader []byte = make([]byte, sparseChunkHeaderSize)
+	for i := uint32(0); i < count; i++ {
+		if _, err := file.ReadAt(chunkHeader, offset); err != nil {
+			return nil, fmt.Errorf("read sparse chunk %v failed: %v", i, err)
+		}
+		chunk := sparseChunk{
+			kind:   binary.LittleEndian.Uint16(chunkHeader[0:2]),
+			blocks: binary.LittleEndian.Uint32(chunkHeader[4:8]),
+			offset: offset + chunkHeaderSize,
+		}
+		total := int64(binary.LittleEndian.Uint32(chunkHeader[8:12]))
+		chunk.size = total - chunkHeaderSize
+		switch chunk.kind {
+		case sparseChunkFill:
+			var fill []byte = make([]byte, 4)
+			if _, err := file.ReadAt(fill, chunk.offset); err != nil {
+				return nil, fmt.Errorf("read sparse chunk %v failed: %v", i, err)
+			}
+			chunk.fill = binary.LittleEndian.Uint32(fill)
+		case sparseChunkRaw, sparseChunkDontCare:
+		case sparseChunkCRC:
+			offset += total
+			continue
+		default:
+			return nil, fmt.Errorf("bad sparse chunk %v type %04x", i, chunk.kind)
+		}
+		image.chunks = append(image.chunks, chunk)
+		offset += total
+	}
+	return image, nil
+}
+
+// split groups the chunks into sparse images of at most max bytes each,
+// raw chunks are cut at block boundaries if needed.
+func (image *sparseImage) split(max int64) ([][]sparseChunk, error) {
+
+	// room for the file header and the leading and trailing don't care chunks
+	budget := max - sparseHeaderSize - 2*sparseChunkHeaderSize
+	if budget < sparseChunkHeaderSize+int64(image.blockSize) {
+		return nil, fmt.Errorf("max-download-size %v is too small", max)
+	}
+	var pieces [][]sparseChunk
+	var piece []sparseChunk
+	used := int64(0)
+	for _, chunk := range image.chunks {
+		for {
+			need := sparseChunkHeaderSize + chunk.dataSize()
+			if used+need <= budget {
+				piece = append(piece, chunk)
+				used += need
+				break
+			}
+			room := (budget - used - sparseChunkHeaderSize) / int64(image.blockSize)
+			if chunk.kind == sparseChunkRaw && room > 0 {
+				// fill the piece with the head of the chunk
+				head := chunk
+				head.blocks = uint32(room)
+				head.size = room * int64(image.blockSize)
+				if head.size > chunk.size {
+					head.size = chunk.size
+				}
+				piece = append(piece, head)
+				chunk.blocks -= head.blocks
+				chunk.offset += head.size
+				chunk.size -= head.size
+			}
+			pieces = append(pieces, piece)
+			piece = nil
+			used = 0
+		}
+	}
+	if len(piece) > 0 {
+		pieces = append(pieces, piece)
+	}
+	return pieces, nil
+}
+
+// piece returns the sparse image made of chunks starting at block start,
+// and its size. Blocks outside of the chunks are "don't care".
+func (image *sparseImage) piece(file io.ReaderAt, chunks []sparseChunk, start uint32) (io.Reader, int64) {
+
+	var parts []io.Reader
+	var header bytes.Buffer
+	size := int64(sparseHeaderSize)
+	count := uint32(0)
+	chunkHeader := func(kind uint16, blocks uint32, dataSize int64) []byte {
+		var b []byte = make([]byte, sparseChunkHeaderSize)
+		binary.LittleEndian.PutUint16(b[0:2], kind)
+		binary.LittleEndian.PutUint32(b[4:8], blocks)
+		binary.LittleEndian.PutUint32(b[8:12], uint32(sparseChunkHeaderSize+dataSize))
+		count++
+		size += sparseChunkHeaderSize + dataSize
+		return b
+	}
+
+	if start > 0 {
+		parts = append(parts, bytes.NewReader(chunkHeader(sparseChunkDontCare, start, 0)))
+	}
+	end := start
+	for _, chunk := range chunks {
+		parts = append(parts, bytes.NewReader(chunkHeader(chunk.kind, chunk.blocks, chunk.dataSize())))
+		switch chunk.kind {
+		case sparseChunkRaw:
+			parts = append(parts, io.NewSectionReader(file, chunk.offset, chunk.size))
+			if padding := chunk.dataSize() - chunk.size; padding > 0 {
+				parts = append(parts, bytes.NewReader(make([]byte, padding)))
+			}
+		case sparseChunkFill:
+			var fill []byte = make([]byte, 4)
+			binary.LittleEndian.PutUint32(fill, chunk.fill)
+			parts = append(parts, bytes.NewReader(fill))
+		}
+		end += chunk.blocks
+	}
+	if end < image.totalBlocks {
+		parts = append(parts, bytes.NewReader(chunkHeader(sparseChunkDontCare, image.totalBlocks-end, 0)))
+	}
+
+	var b []byte = make([]byte, sparseHeaderSize)
+	binary.LittleEndian.PutUint32(b[0:4], sparseMagic)
+	binary.LittleEndian.PutUint16(b[4:6], 1)
+	binary.LittleEndian.PutUint16(b[6:8], 0)
+	binary.LittleEndian.PutUint16(b[8:10], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(b[10:12], sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint32(b[12:16], image.blockSize)
+	binary.LittleEndian.PutUint32(b[16:20], image.totalBlocks)
+	binary.LittleEndian.PutUint32(b[20:24], count)
+	header.Write(b)
+	return io.MultiReader(append([]io.Reader{&header}, parts...)...), size
+}
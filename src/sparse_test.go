@@ -0,0 +1,223 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// sparseTestChunk is a chunk of a test sparse image.
+type sparseTestChunk struct {
+	kind   uint16
+	blocks uint32
+	fill   uint32
+}
+
+// sparseTestBuild returns a sparse image of chunks, raw blocks are filled
+// with bytes depending on their position.
+func sparseTestBuild(chunks []sparseTestChunk) []byte {
+
+	var body bytes.Buffer
+	total := uint32(0)
+	for _, chunk := range chunks {
+		var data []byte
+		switch chunk.kind {
+		case sparseChunkRaw:
+			data = make([]byte, int(chunk.blocks)*sparseBlockSize)
+			for i := range data {
+				data[i] = byte(i/7) ^ byte(total)
+			}
+		case sparseChunkFill, sparseChunkCRC:
+			data = binary.LittleEndian.AppendUint32(nil, chunk.fill)
+		}
+		var header []byte = make([]byte, sparseChunkHeaderSize)
+		binary.LittleEndian.PutUint16(header[0:2], chunk.kind)
+		binary.LittleEndian.PutUint32(header[4:8], chunk.blocks)
+		binary.LittleEndian.PutUint32(header[8:12], uint32(sparseChunkHeaderSize+len(data)))
+		body.Write(header)
+		body.Write(data)
+		total += chunk.blocks
+	}
+	var header []byte = make([]byte, sparseHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], sparseMagic)
+	binary.LittleEndian.PutUint16(header[4:6], 1)
+	binary.LittleEndian.PutUint16(header[8:10], sparseHeaderSize)
+	binary.LittleEndian.PutUint16(header[10:12], sparseChunkHeaderSize)
+	binary.LittleEndian.PutUint32(header[12:16], sparseBlockSize)
+	binary.LittleEndian.PutUint32(header[16:20], total)
+	binary.LittleEndian.PutUint32(header[20:24], uint32(len(chunks)))
+	return append(header, body.Bytes()...)
+}
+
+// sparseTestExpand decodes an image independently of sparseRead: it returns
+// the content of every block, whether the block is written, and the chunks.
+func sparseTestExpand(t *testing.T, image []byte) ([]byte, []bool, []sparseTestChunk) {
+
+	t.Helper()
+	if len(image) < sparseHeaderSize || binary.LittleEndian.Uint32(image[0:4]) != sparseMagic {
+		blocks := (len(image) + sparseBlockSize - 1) / sparseBlockSize
+		var data []byte = make([]byte, blocks*sparseBlockSize)
+		copy(data, image)
+		var written []bool = make([]bool, blocks)
+		for i := range written {
+			written[i] = true
+		}
+		return data, written, []sparseTestChunk{{kind: sparseChunkRaw, blocks: uint32(blocks)}}
+	}
+	total := int(binary.LittleEndian.Uint32(image[16:20]))
+	count := int(binary.LittleEndian.Uint32(image[20:24]))
+	var data []byte = make([]byte, total*sparseBlockSize)
+	var written []bool = make([]bool, total)
+	var chunks []sparseTestChunk
+	offset, block := sparseHeaderSize, 0
+	for i := 0; i < count; i++ {
+		if offset+sparseChunkHeaderSize > len(image) {
+			t.Fatalf("chunk %v: header past the end of the image", i)
+		}
+		kind := binary.LittleEndian.Uint16(image[offset : offset+2])
+		blocks := int(binary.LittleEndian.Uint32(image[offset+4 : offset+8]))
+		size := int(binary.LittleEndian.Uint32(image[offset+8 : offset+12]))
+		payload := image[offset+sparseChunkHeaderSize : offset+size]
+		if block+blocks > total {
+			t.Fatalf("chunk %v: blocks %v..%v past %v", i, block, block+blocks, total)
+		}
+		switch kind {
+		case sparseChunkRaw:
+			if len(payload) != blocks*sparseBlockSize {
+				t.Fatalf("chunk %v: %v raw bytes for %v blocks", i, len(payload), blocks)
+			}
+			copy(data[block*sparseBlockSize:], payload)
+		case sparseChunkFill:
+			for j := block * sparseBlockSize; j < (block+blocks)*sparseBlockSize; j += 4 {
+				copy(data[j:j+4], payload)
+			}
+		case sparseChunkCRC:
+			offset += size
+			continue
+		}
+		if kind != sparseChunkDontCare {
+			for j := block; j < block+blocks; j++ {
+				written[j] = true
+			}
+		}
+		chunks = append(chunks, sparseTestChunk{kind: kind, blocks: uint32(blocks)})
+		block += blocks
+		offset += size
+	}
+	if block != total || offset != len(image) {
+		t.Fatalf("chunks cover %v of %v blocks, %v of %v bytes", block, total, offset, len(image))
+	}
+	return data, written, chunks
+}
+
+func TestSparseSplit(t *testing.T) {
+
+	var raw []byte = make([]byte, 9*sparseBlockSize+100)
+	for i := range raw {
+		raw[i] = byte(i * 13)
+	}
+	sparse := sparseTestBuild([]sparseTestChunk{
+		{kind: sparseChunkDontCare, blocks: 3},
+		{kind: sparseChunkRaw, blocks: 8},
+		{kind: sparseChunkFill, blocks: 100, fill: 0xdeadbeef},
+		{kind: sparseChunkCRC, fill: 0x12345678},
+		{kind: sparseChunkRaw, blocks: 1},
+		{kind: sparseChunkDontCare, blocks: 20},
+		{kind: sparseChunkRaw, blocks: 5},
+		{kind: sparseChunkFill, blocks: 2, fill: 0},
+	})
+	// the smallest max fits a single block per piece
+	smallest := int64(sparseHeaderSize + 3*sparseChunkHeaderSize + sparseBlockSize)
+	maxes := []int64{1 << 20, 6 * sparseBlockSize, 3*sparseBlockSize + 100, smallest}
+
+	for _, test := range []struct {
+		name string
+		file []byte
+	}{
+		{"raw", raw},
+		{"sparse", sparse},
+	} {
+		want, wantWritten, _ := sparseTestExpand(t, test.file)
+		for _, max := range maxes {
+			file := bytes.NewReader(test.file)
+			image, err := sparseRead(file, int64(len(test.file)))
+			if err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			if int(image.totalBlocks) != len(wantWritten) {
+				t.Fatalf("%v: %v blocks, want %v", test.name, image.totalBlocks, len(wantWritten))
+			}
+			pieces, err := image.split(max)
+			if err != nil {
+				t.Fatalf("%v, max %v: %v", test.name, max, err)
+			}
+			var got []byte = make([]byte, len(want))
+			var written []bool = make([]bool, len(wantWritten))
+			start := uint32(0)
+			for i, chunks := range pieces {
+				reader, size := image.piece(file, chunks, start)
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("%v, max %v, piece %v: %v", test.name, max, i, err)
+				}
+				if int64(len(data)) != size || size > max {
+					t.Errorf("%v, max %v, piece %v: %v bytes, size %v", test.name, max, i, len(data), size)
+				}
+				content, pieceWritten, pieceChunks := sparseTestExpand(t, data)
+				if len(pieceWritten) != len(wantWritten) {
+					t.Fatalf("%v, max %v, piece %v: %v blocks", test.name, max, i, len(pieceWritten))
+				}
+				// the piece starts where the previous one ended
+				covered := uint32(0)
+				for _, chunk := range chunks {
+					covered += chunk.blocks
+				}
+				if start > 0 && (pieceChunks[0].kind != sparseChunkDontCare || pieceChunks[0].blocks != start) {
+					t.Errorf("%v, max %v, piece %v: starts with %+v, want %v blocks skipped",
+						test.name, max, i, pieceChunks[0], start)
+				}
+				for block := range pieceWritten {
+					inside := uint32(block) >= start && uint32(block) < start+covered
+					if pieceWritten[block] && !inside {
+						t.Errorf("%v, max %v, piece %v: block %v written outside of %v..%v",
+							test.name, max, i, block, start, start+covered)
+					}
+					if pieceWritten[block] {
+						written[block] = true
+						copy(got[block*sparseBlockSize:(block+1)*sparseBlockSize],
+							content[block*sparseBlockSize:(block+1)*sparseBlockSize])
+					}
+				}
+				start += covered
+			}
+			if start != image.totalBlocks {
+				t.Errorf("%v, max %v: pieces cover %v of %v blocks", test.name, max, start, image.totalBlocks)
+			}
+			for block := range written {
+				if written[block] != wantWritten[block] {
+					t.Errorf("%v, max %v: block %v written %v, want %v",
+						test.name, max, block, written[block], wantWritten[block])
+				}
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%v, max %v: flashed content differs from the image", test.name, max)
+			}
+			if max == smallest && len(pieces) < 9 {
+				t.Errorf("%v, max %v: %v pieces", test.name, max, len(pieces))
+			}
+		}
+	}
+}
+
+func TestSparseSplitTooSmall(t *testing.T) {
+
+	image := &sparseImage{blockSize: sparseBlockSize, totalBlocks: 1,
+		chunks: []sparseChunk{{kind: sparseChunkRaw, blocks: 1, size: sparseBlockSize}}}
+	if _, err := image.split(sparseHeaderSize + 3*sparseChunkHeaderSize + sparseBlockSize - 1); err == nil {
+		t.Error("max-download-size below a single block accepted")
+	}
+}
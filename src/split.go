@@ -0,0 +1,166 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Split connections, enabled with --split-connections: a client sending
+// "FBS1" followed by a session id of splitIDSize hex digits sends its frames
+// on that connection only. Once the handshake is answered it opens a second
+// one sending "FBR1" and the same id, answered with "FBR1", which carries
+// the frames of the device. Framing is the same as over a single connection,
+// uncompressed. A server without the option closes the first connection as
+// an unsupported protocol version.
+const (
+	netHandshakeSplit    = "FBS1"
+	netHandshakeResponse = "FBR1"
+)
+
+const splitIDSize = 16
+
+// time the client has to open the response connection
+const splitTimeout = 10 * time.Second
+
+var netSplitConnections bool
+
+// client mode: talk to the server over split connections
+var clientSplit bool
+
+var errAcceptTimeout = errors.New("accept timed out")
+
+// splitConn is a session over split connections: read from the embedded
+// connection, written to out. On the server that's the command connection
+// and the response one, on the client the other way around.
+type splitConn struct {
+	net.Conn
+	out net.Conn
+}
+
+func (c *splitConn) Write(b []byte) (int, error) {
+
+	return c.out.Write(b)
+}
+
+func (c *splitConn) Close() error {
+
+	c.out.Close()
+	return c.Conn.Close()
+}
+
+func (c *splitConn) SetDeadline(t time.Time) error {
+
+	c.out.SetDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *splitConn) SetWriteDeadline(t time.Time) error {
+
+	return c.out.SetWriteDeadline(t)
+}
+
+// SetKeepAlive sets tcp keepalive on both connections.
+func (c *splitConn) SetKeepAlive(keepalive bool) error {
+
+	for _, conn := range []net.Conn{c.Conn, c.out} {
+		if tcp, ok := conn.(netKeepAliveConn); ok {
+			if err := tcp.SetKeepAlive(keepalive); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *splitConn) SetKeepAlivePeriod(period time.Duration) error {
+
+	for _, conn := range []net.Conn{c.Conn, c.out} {
+		if tcp, ok := conn.(netKeepAliveConn); ok {
+			if err := tcp.SetKeepAlivePeriod(period); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitReadID reads the session id following the split handshake magic.
+func splitReadID(conn net.Conn) (string, error) {
+
+	var id []byte = make([]byte, splitIDSize)
+	if _, err := io.ReadFull(conn, id); err != nil {
+		return "", fmt.Errorf("read split session id failed: %v", err)
+	}
+	if _, err := hex.DecodeString(string(id)); err != nil {
+		return "", fmt.Errorf("bad split session id %q", id)
+	}
+	return string(id), nil
+}
+
+// splitAccept waits for the response connection of the session id whose
+// command connection is conn, returns both as a single connection. Other
+// clients connecting meanwhile are closed, the device is taken.
+func splitAccept(ml *multiListener, conn net.Conn, id string) (net.Conn, error) {
+
+	deadline := time.Now().Add(splitTimeout)
+	for {
+		responses, err := ml.acceptTimeout(time.Until(deadline))
+		if err != nil {
+			return nil, fmt.Errorf("no response connection from %v: %v", conn.RemoteAddr(), err)
+		}
+		responses.SetReadDeadline(time.Now().Add(time.Second))
+		var header []byte = make([]byte, len(netHandshakeResponse)+splitIDSize)
+		_, err = io.ReadFull(responses, header)
+		responses.SetReadDeadline(time.Time{})
+		if err != nil || string(header) != netHandshakeResponse+id {
+			log.Printf("tcp: %v: %q while waiting for a response connection, closed", responses.RemoteAddr(), header)
+			responses.Close()
+			continue
+		}
+		if err = netWriteHandshake(responses, netHandshakeResponse); err != nil {
+			responses.Close()
+			return nil, err
+		}
+		log.Printf("response connection from %v", responses.RemoteAddr())
+		return &splitConn{Conn: conn, out: responses}, nil
+	}
+}
+
+// clientConnectSplit opens the command and response connections of a
+// session over split connections.
+func clientConnectSplit(address string) (net.Conn, error) {
+
+	var random []byte = make([]byte, splitIDSize/2)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(random)
+	commands, err := clientConnectMagic(address, netControlMagic(netHandshakeSplit)+id)
+	if errors.Is(err, errClientHandshake) {
+		commands, err = clientConnectMagic(address, netHandshakeSplit+id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v (does the server run with --split-connections?)", err)
+	}
+	responses, err := clientConnectMagic(address, netHandshakeResponse+id)
+	if err != nil {
+		// a server rejecting the session answers on the command connection
+		commands.SetReadDeadline(time.Now().Add(time.Second))
+		if data, readErr := netRead(commands); readErr == nil && strings.HasPrefix(string(data), "FAIL") {
+			err = fmt.Errorf("%w: %s", errClientRemote, data[4:])
+		}
+		commands.Close()
+		return nil, err
+	}
+	return &splitConn{Conn: responses, out: commands}, nil
+}
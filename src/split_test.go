@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// keepAliveMock is a connection recording its tcp keepalive settings.
+type keepAliveMock struct {
+	net.Conn
+	keepalive bool
+	period    time.Duration
+}
+
+func (m *keepAliveMock) SetKeepAlive(keepalive bool) error {
+
+	m.keepalive = keepalive
+	return nil
+}
+
+func (m *keepAliveMock) SetKeepAlivePeriod(period time.Duration) error {
+
+	m.period = period
+	return nil
+}
+
+func TestSplitKeepAlive(t *testing.T) {
+
+	clientCommands, serverCommands := net.Pipe()
+	clientResponses, serverResponses := net.Pipe()
+	defer clientCommands.Close()
+	defer clientResponses.Close()
+	commands := &keepAliveMock{Conn: serverCommands}
+	responses := &keepAliveMock{Conn: serverResponses}
+	done := make(chan error, 1)
+	go func() {
+		conn := &splitConn{Conn: commands, out: responses}
+		done <- relay(context.Background(), conn, false, newFastbootMock(), log.New(io.Discard, "", 0),
+			relayOptions{keepalive: time.Minute, drainTimeout: time.Millisecond})
+		conn.Close()
+	}()
+	if err := netWrite(clientCommands, []byte("getvar:product")); err != nil {
+		t.Fatal(err)
+	}
+	if response, err := netRead(clientResponses); err != nil || string(response) != "OKAYgetvar:product" {
+		t.Errorf("response: got %q, %v", response, err)
+	}
+	clientCommands.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay didn't end after the client disconnected")
+	}
+	for name, conn := range map[string]*keepAliveMock{"command": commands, "response": responses} {
+		if !conn.keepalive || conn.period != time.Minute {
+			t.Errorf("%v connection: keepalive %v, period %v", name, conn.keepalive, conn.period)
+		}
+	}
+}
+
+func TestQueuedKeepAlive(t *testing.T) {
+
+	conn := &keepAliveMock{}
+	var queued net.Conn = &queuedConn{Conn: conn}
+	tcp, ok := queued.(netKeepAliveConn)
+	if !ok {
+		t.Fatal("queued connection without tcp keepalive")
+	}
+	tcp.SetKeepAlive(true)
+	tcp.SetKeepAlivePeriod(time.Minute)
+	if !conn.keepalive || conn.period != time.Minute {
+		t.Errorf("keepalive %v, period %v", conn.keepalive, conn.period)
+	}
+}
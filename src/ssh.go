@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// SSH tunnel, client mode with --ssh [user@]host: the connection to the
+// server is made by "ssh -W" on that host, so keys, agent, known_hosts and
+// ~/.ssh/config are those of the local ssh client, and so are the prompts.
+// The server address is resolved on the ssh host, e.g. localhost:5554 for a
+// server listening there only.
+
+// client mode: ssh destination to reach the server through
+var clientSSH string
+
+// ssh client run for --ssh
+var sshCommand = "ssh"
+
+// time an ssh process has to exit once its connection is closed
+const sshCloseTimeout = 2 * time.Second
+
+// sshConn is the client end of a pipe copied to and from an ssh process.
+type sshConn struct {
+	net.Conn
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// clientDial connects to the server at address, through ssh with --ssh.
+func clientDial(address string) (net.Conn, error) {
+
+	if clientSSH != "" {
+		return sshDial(clientSSH, address)
+	}
+	return net.DialTimeout("tcp", address, clientTimeout)
+}
+
+// sshDial connects to address through ssh -W on destination.
+func sshDial(destination string, address string) (net.Conn, error) {
+
+	cmd := exec.Command(sshCommand, "-W", address,
+		"-o", fmt.Sprintf("ConnectTimeout=%v", int(clientTimeout.Seconds())), destination)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("ssh: %v", err)
+	}
+	local, remote := net.Pipe()
+	conn := &sshConn{Conn: local, cmd: cmd, done: make(chan struct{})}
+	go func() {
+		// the client closing its end ends the input of ssh
+		io.Copy(stdin, remote)
+		stdin.Close()
+	}()
+	go func() {
+		// ssh exiting shows as the server closing the connection
+		io.Copy(remote, stdout)
+		remote.Close()
+		cmd.Wait()
+		close(conn.done)
+	}()
+	return conn, nil
+}
+
+func (c *sshConn) Close() error {
+
+	err := c.Conn.Close()
+	select {
+	case <-c.done:
+	case <-time.After(sshCloseTimeout):
+		c.cmd.Process.Kill()
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSSHHelperProcess stands for ssh -W when run by the script of
+// sshTestCommand: it connects to the address following -W and copies stdin
+// and stdout to and from it.
+func TestSSHHelperProcess(t *testing.T) {
+
+	if os.Getenv("SSH_TEST_HELPER") == "" {
+		return
+	}
+	var address string
+	for i, arg := range os.Args {
+		if arg == "-W" && i+1 < len(os.Args) {
+			address = os.Args[i+1]
+		}
+	}
+	if os.Args[len(os.Args)-1] != "user@rig" {
+		os.Exit(2)
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		os.Exit(1)
+	}
+	go func() {
+		io.Copy(conn, os.Stdin)
+		conn.(*net.TCPConn).CloseWrite()
+	}()
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+// sshTestCommand returns an ssh command running TestSSHHelperProcess.
+func sshTestCommand(t *testing.T) string {
+
+	t.Helper()
+	t.Setenv("SSH_TEST_HELPER", "1")
+	script := filepath.Join(t.TempDir(), "ssh")
+	content := "#!/bin/sh\nexec '" + os.Args[0] + "' -test.run='^TestSSHHelperProcess$' -- \"$@\"\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script
+}
+
+func TestClientConnectSSH(t *testing.T) {
+
+	defer func(command, destination string) { sshCommand, clientSSH = command, destination }(sshCommand, clientSSH)
+	sshCommand, clientSSH = sshTestCommand(t), "user@rig"
+	address := clientTestServer(t, newFastbootMock())
+	conn, err := clientConnect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !clientControl(conn) {
+		t.Errorf("control frames not negotiated through ssh")
+	}
+	if token, message, err := clientCommand(conn, "getvar:product"); err != nil || token != "OKAY" || message != "getvar:product" {
+		t.Errorf("getvar:product: got %q %q, %v", token, message, err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+}
+
+func TestClientConnectSSHFailed(t *testing.T) {
+
+	defer func(command, destination string) { sshCommand, clientSSH = command, destination }(sshCommand, clientSSH)
+	// the helper exits at once for another destination, as ssh failing to connect
+	sshCommand, clientSSH = sshTestCommand(t), "other@rig"
+	if conn, err := clientConnect(clientTestServer(t, newFastbootMock())); err == nil {
+		conn.Close()
+		t.Error("connected through a failed ssh")
+	}
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Step mode, a manual debugging aid: every command is held until the
+// operator acknowledges it by POST /step on the admin server or Enter on the
+// terminal.
+
+var stepLock sync.Mutex
+
+// the command waiting for acknowledgment and its release, nil if none
+var stepCommand string
+var stepRelease chan struct{}
+
+// stepWait holds command until it's acknowledged, returns false if ctx is
+// done first.
+func stepWait(ctx context.Context, command string, logger *log.Logger) bool {
+
+	release := make(chan struct{})
+	stepLock.Lock()
+	stepCommand = command
+	stepRelease = release
+	stepLock.Unlock()
+	logger.Printf("step: %q waits for acknowledgment (POST /step or Enter)", command)
+
+	select {
+	case <-release:
+		return true
+	case <-ctx.Done():
+		stepLock.Lock()
+		if stepRelease == release {
+			stepRelease = nil
+		}
+		stepLock.Unlock()
+		return false
+	}
+}
+
+// stepAcknowledge releases the waiting command, returns it and false if
+// there is none.
+func stepAcknowledge() (string, bool) {
+
+	stepLock.Lock()
+	defer stepLock.Unlock()
+	if stepRelease == nil {
+		return "", false
+	}
+	close(stepRelease)
+	stepRelease = nil
+	return stepCommand, true
+}
+
+// stepTerminal acknowledges commands on every line read from the terminal.
+func stepTerminal() {
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if command, ok := stepAcknowledge(); ok {
+				log.Printf("step: %q acknowledged", command)
+			} else {
+				log.Printf("step: no command waiting")
+			}
+		}
+	}()
+}
+
+// adminStep shows the waiting command on GET and releases it on POST.
+func adminStep(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+	case http.MethodGet:
+		stepLock.Lock()
+		command, waiting := stepCommand, stepRelease != nil
+		stepLock.Unlock()
+		if !waiting {
+			http.Error(w, "no command waiting", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "%q\n", command)
+	case http.MethodPost:
+		command, ok := stepAcknowledge()
+		if !ok {
+			http.Error(w, "no command waiting", http.StatusConflict)
+			return
+		}
+		log.Printf("step: %q acknowledged", command)
+		fmt.Fprintf(w, "acknowledged %q\n", command)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,16 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+func syslogOpen(facility string, tag string) (io.Writer, error) {
+
+	return nil, fmt.Errorf("syslog is not supported on this platform")
+}
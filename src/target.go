@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// serial of the device new sessions go to, set at runtime thru the admin
+// server when the relay isn't bound to a serial by -s
+var usbTargetLock sync.Mutex
+var usbTargetSerial string
+
+// usbTargetSelect returns sel narrowed to the active target, if any.
+func usbTargetSelect(sel usbSelector) usbSelector {
+
+	usbTargetLock.Lock()
+	defer usbTargetLock.Unlock()
+	if sel.serial == "" && usbTargetSerial != "" {
+		sel.serial = usbTargetSerial
+		// a bus/address of -i names another device
+		sel.bus, sel.address = 0, 0
+	}
+	return sel
+}
+
+// adminTarget shows the active target on GET, sets it to the serial parameter
+// on POST, once the device is found, and clears it on DELETE.
+func adminTarget(w http.ResponseWriter, r *http.Request, sel usbSelector) {
+
+	switch r.Method {
+	case http.MethodGet:
+		usbTargetLock.Lock()
+		serial := usbTargetSerial
+		usbTargetLock.Unlock()
+		if serial == "" {
+			http.Error(w, "no target set", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, serial)
+	case http.MethodPost:
+		serial := r.URL.Query().Get("serial")
+		if serial == "" {
+			http.Error(w, "serial parameter expected", http.StatusBadRequest)
+			return
+		}
+		if sel.serial != "" {
+			http.Error(w, "the server is bound to a serial by -s", http.StatusConflict)
+			return
+		}
+		sel.serial = serial
+		sel.bus, sel.address = 0, 0
+		if len(usbDeviceList(sel)) == 0 {
+			http.Error(w, "no device with serial "+serial, http.StatusNotFound)
+			return
+		}
+		usbTargetLock.Lock()
+		usbTargetSerial = serial
+		usbTargetLock.Unlock()
+		log.Printf("admin: target set to %v", serial)
+		fmt.Fprintf(w, "target %v\n", serial)
+	case http.MethodDelete:
+		usbTargetLock.Lock()
+		usbTargetSerial = ""
+		usbTargetLock.Unlock()
+		log.Printf("admin: target cleared")
+		fmt.Fprintln(w, "target cleared")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
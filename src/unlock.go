@@ -0,0 +1,157 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Unlock state of a device, normalized from the "unlocked" variable and the
+// "flashing get_unlock_ability" command. Devices not supporting either one
+// report unknown.
+
+const (
+	unlockUnknown = "unknown"
+	unlockYes     = "yes"
+	unlockNo      = "no"
+)
+
+// variables added to the --collect-info ones
+const (
+	unlockStateVar   = "unlock-state"
+	unlockAbilityVar = "unlock-ability"
+)
+
+// unlockNormalize returns the unlocked variable value as yes, no or unknown.
+func unlockNormalize(value string) string {
+
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "true", "1":
+		return unlockYes
+	case "no", "false", "0":
+		return unlockNo
+	}
+	return unlockUnknown
+}
+
+// unlockAbility returns the ability reported by "flashing get_unlock_ability"
+// as yes, no or unknown. It's an INFO line like "get_unlock_ability: 1" or,
+// with some bootloaders, the OKAY message.
+func unlockAbility(lines []string) string {
+
+	for _, line := range lines {
+		if i := strings.LastIndex(line, ":"); i >= 0 {
+			line = line[i+1:]
+		}
+		if ability := unlockNormalize(line); ability != unlockUnknown {
+			return ability
+		}
+	}
+	return unlockUnknown
+}
+
+// usbUnlockState queries the unlock state and ability of the device, a
+// command the device fails is reported unknown, a transfer error is returned.
+func usbUnlockState(dev usbTransport) (state string, ability string, err error) {
+
+	state = unlockUnknown
+	ability = unlockUnknown
+	lines, failed, err := usbCommandLines(dev, "getvar:unlocked")
+	if err != nil {
+		return
+	}
+	if !failed {
+		state = unlockNormalize(lines[len(lines)-1])
+	}
+	lines, failed, err = usbCommandLines(dev, "flashing get_unlock_ability")
+	if err != nil {
+		return
+	}
+	if !failed {
+		ability = unlockAbility(lines)
+	}
+	return
+}
+
+// usbCommandLines runs a fastboot command and returns its INFO messages
+// followed by the message of the final response, and whether it's FAIL.
+func usbCommandLines(dev usbTransport, command string) ([]string, bool, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectVarsTimeout)
+	defer cancel()
+
+	if err := dev.Write(ctx, []byte(command)); err != nil {
+		return nil, false, err
+	}
+	var lines []string
+	var response []byte = make([]byte, usbResponseSize)
+	for {
+		n, err := dev.Read(ctx, response)
+		if err != nil {
+			usbDrainResponse(ctx, dev)
+			return nil, false, err
+		}
+		if n < 4 {
+			continue
+		}
+		message := string(response[4:n])
+		switch string(response[0:4]) {
+		case "INFO":
+			lines = append(lines, message)
+		case "OKAY":
+			return append(lines, message), false, nil
+		case "FAIL":
+			return append(lines, message), true, nil
+		}
+	}
+}
+
+// clientUnlockState prints the unlock state and ability of the device served
+// at address.
+func clientUnlockState(address string) error {
+
+	conn, err := clientConnect(address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := unlockUnknown
+	_, value, err := clientCommand(conn, "getvar:unlocked")
+	if err == nil {
+		state = unlockNormalize(value)
+	} else if !errors.Is(err, errClientRemote) {
+		return err
+	}
+	ability := unlockUnknown
+	lines, err := clientCommandLines(conn, "flashing get_unlock_ability")
+	if err == nil {
+		ability = unlockAbility(lines)
+	} else if !errors.Is(err, errClientRemote) {
+		return err
+	}
+	fmt.Printf("unlocked: %v\nunlock ability: %v\n", state, ability)
+	return nil
+}
+
+// clientCommandLines is clientCommand returning the INFO messages, followed
+// by the message of the final response, instead of printing them.
+func clientCommandLines(conn net.Conn, command string) ([]string, error) {
+
+	if err := netWrite(conn, []byte(command)); err != nil {
+		return nil, err
+	}
+	var lines []string
+	token, message, err := clientReplyInfo(conn, command, func(line string) {
+		lines = append(lines, line)
+	})
+	if err == nil && token == "FAIL" {
+		err = fmt.Errorf("%v: %w: %v", command, errClientRemote, message)
+	}
+	return append(lines, message), err
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const usbPortPathSupported = true
+
+// usbPortPath returns the physical port path of the device at bus/address,
+// e.g. "1-2.3.1": the bus and the hub port numbers down to the device, as
+// named by sysfs. The wrapper only exposes the last port number. Empty for
+// a root hub or if it can't be found.
+func usbPortPath(bus int, address int) string {
+
+	entries, err := os.ReadDir("/sys/bus/usb/devices")
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		// interfaces are named like "1-2.3.1:1.0", root hubs "usb1"
+		if strings.ContainsAny(name, ":") || !strings.HasPrefix(name, strconv.Itoa(bus)+"-") {
+			continue
+		}
+		if usbSysfsInt(filepath.Join("/sys/bus/usb/devices", name, "devnum")) == address &&
+			usbSysfsInt(filepath.Join("/sys/bus/usb/devices", name, "busnum")) == bus {
+			return name
+		}
+	}
+	return ""
+}
+
+func usbSysfsInt(path string) int {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,14 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+//go:build !linux
+
+package main
+
+const usbPortPathSupported = false
+
+// usbPortPath is only known from linux sysfs.
+func usbPortPath(bus int, address int) string {
+
+	return ""
+}
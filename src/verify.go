@@ -0,0 +1,117 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+)
+
+// Download verification, enabled with --verify-download: before a download
+// the client may send the control frame "relay:sha256:<hex>", answered by the
+// relay itself. The payload of the next download is hashed as it passes, if
+// it doesn't match the flash or boot using it is answered with FAIL and the
+// session ends. A relay without the feature fails the frame, see control.go,
+// so the client knows not to count on the check.
+const verifyControlSha256 = "relay:sha256:"
+
+var errDownloadCorrupt = errors.New("download doesn't match its sha256")
+
+// verifyState is the download verification state of a session.
+type verifyState struct {
+	// sha256 announced for the next download
+	expected []byte
+	// of the download in progress
+	hash    hash.Hash
+	hashSum []byte
+	// the last download didn't match, what uses it is refused
+	corrupt bool
+}
+
+// verifyControl handles a control frame, returns the response.
+func (r *relaySession) verifyControl(command string) []byte {
+
+	sum, err := hex.DecodeString(strings.TrimPrefix(command, verifyControlSha256))
+	if err != nil || len(sum) != sha256.Size {
+		return []byte("FAILrelay: bad sha256")
+	}
+	r.lock.Lock()
+	r.verify.expected = sum
+	r.lock.Unlock()
+	r.opts.audit.Printf("next download sha256: %x", sum)
+	return []byte("OKAY")
+}
+
+// verifyCommand is called with r.lock held for every command, starts
+// hashing a download announced with a sha256.
+func (r *relaySession) verifyCommand(command string) {
+
+	verb, _ := fastbootParse(command)
+	if verb != "download" {
+		return
+	}
+	r.verify.corrupt = false
+	r.verify.hash = nil
+	if r.verify.expected != nil {
+		r.verify.hash = sha256.New()
+		r.verify.hashSum = r.verify.expected
+		r.verify.expected = nil
+	}
+}
+
+// verifyData is called with r.lock held for every download frame.
+func (r *relaySession) verifyData(data []byte) {
+
+	if r.verify.hash == nil {
+		return
+	}
+	r.verify.hash.Write(data)
+	if r.downloadRemaining > 0 {
+		return
+	}
+	if sum := r.verify.hash.Sum(nil); !bytes.Equal(sum, r.verify.hashSum) {
+		r.verify.corrupt = true
+		r.logger.Printf("download corrupted: sha256 %x, %x expected", sum, r.verify.hashSum)
+		r.opts.audit.Printf("download sha256 mismatch: %x, %x expected", sum, r.verify.hashSum)
+	} else {
+		debugf(r.logger, "download sha256 verified")
+	}
+	r.verify.hash = nil
+}
+
+// verifyRefused tells whether command uses a corrupted download.
+func (r *relaySession) verifyRefused(command string) bool {
+
+	verb, _ := fastbootParse(command)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.verify.corrupt && (verb == "flash" || verb == "boot")
+}
+
+// clientSendSha256 announces the sha256 of the next download, read from
+// reader. Returns false if the server doesn't verify downloads.
+func clientSendSha256(conn net.Conn, reader io.Reader) (bool, error) {
+
+	// the handshake already told control frames aren't known
+	err := errClientRemote
+	if clientControl(conn) {
+		hash := sha256.New()
+		if _, err := io.Copy(hash, reader); err != nil {
+			return false, fmt.Errorf("read image failed: %v", err)
+		}
+		_, _, err = clientCommand(conn, fmt.Sprintf("%v%x", verifyControlSha256, hash.Sum(nil)))
+	}
+	if errors.Is(err, errClientRemote) {
+		fmt.Printf("Server doesn't verify downloads, sending unverified\n")
+		return false, nil
+	}
+	return err == nil, err
+}
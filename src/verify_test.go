@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestVerifyDownload(t *testing.T) {
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	verifying := relayOptions{control: true, parse: true, verifyDownload: true}
+	tests := []struct {
+		name string
+		opts relayOptions
+		// hashed by the client as the download
+		hashed []byte
+		verify bool
+		flash  string
+		err    error
+	}{
+		{"match", verifying, payload, true, "OKAYflash:boot", nil},
+		{"mismatch", verifying, payload[1:], true, "FAILrelay: " + errDownloadCorrupt.Error(), errDownloadCorrupt},
+		// sent unverified
+		{"unsupported", relayOptions{control: true, parse: true}, payload, false, "OKAYflash:boot", nil},
+	}
+	for _, test := range tests {
+		dev := newFastbootMock()
+		client, done := relayTest(t, dev, test.opts)
+		verify, err := clientSendSha256(&controlConn{Conn: client}, bytes.NewReader(test.hashed))
+		if err != nil || verify != test.verify {
+			t.Fatalf("%v: sha256: got %v, %v", test.name, verify, err)
+		}
+		if response := relayExchange(t, client, fmt.Sprintf("download:%08x", len(payload))); response != fmt.Sprintf("DATA%08x", len(payload)) {
+			t.Fatalf("%v: download: got %q", test.name, response)
+		}
+		if err := netWrite(client, payload[0:100000]); err != nil {
+			t.Fatal(err)
+		}
+		if response := relayExchange(t, client, string(payload[100000:])); response != "OKAY" {
+			t.Fatalf("%v: download data: got %q", test.name, response)
+		}
+		if response := relayExchange(t, client, "flash:boot"); response != test.flash {
+			t.Errorf("%v: flash: got %q, %q expected", test.name, response, test.flash)
+		}
+		if err := relayWait(t, client, done); !errors.Is(err, test.err) {
+			t.Errorf("%v: relay: got %v, %v expected", test.name, err, test.err)
+		}
+		// the sha256 never reaches the device, nor does a flash of a corrupted download
+		written := dev.writes()
+		if len(written) == 0 || string(written[0]) != fmt.Sprintf("download:%08x", len(payload)) {
+			t.Fatalf("%v: device got %q", test.name, written)
+		}
+		flashed := string(written[len(written)-1]) == "flash:boot"
+		if flashed != (test.err == nil) {
+			t.Errorf("%v: flashed %v", test.name, flashed)
+		}
+	}
+}
+
+func TestVerifyBadSha256(t *testing.T) {
+
+	dev := newFastbootMock()
+	client, done := relayTest(t, dev, relayOptions{control: true, parse: true, verifyDownload: true})
+	for _, command := range []string{verifyControlSha256 + "00", verifyControlSha256 + "xyz"} {
+		if response := relayExchange(t, client, command); response != "FAILrelay: bad sha256" {
+			t.Errorf("%q: got %q", command, response)
+		}
+	}
+	relayWait(t, client, done)
+	if written := dev.writes(); len(written) != 0 {
+		t.Errorf("device got %q", written)
+	}
+}
@@ -0,0 +1,19 @@
+// SPDX-FileCopyrightText: 2024 George Stark <stark.georgy@gmail.com>
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package main
+
+import "fmt"
+
+// build metadata, set at build time:
+// go build -ldflags "-X main.version=1.2 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%F)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+func versionString() string {
+
+	return fmt.Sprintf("remote-fastboot %v (commit %v, built %v)", version, commit, buildDate)
+}